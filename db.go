@@ -1,19 +1,31 @@
 package teepeedb
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/stangelandcl/teepeedb/internal/cache"
+	"github.com/stangelandcl/teepeedb/internal/manifest"
+	"github.com/stangelandcl/teepeedb/internal/memtable"
 	"github.com/stangelandcl/teepeedb/internal/merge"
+	"github.com/stangelandcl/teepeedb/internal/ratelimit"
 	"github.com/stangelandcl/teepeedb/internal/shared"
+	"github.com/stangelandcl/teepeedb/internal/vlog"
+	"github.com/stangelandcl/teepeedb/internal/wal"
 	"github.com/stangelandcl/teepeedb/internal/writer"
 )
 
+// returned when a file fails a checksum or has out of range offsets.
+// use errors.As to get the filename and offset
+type ErrCorrupt = shared.ErrCorrupt
+
 type DB struct {
 	directory string
 	// one write at a time
@@ -23,19 +35,70 @@ type DB struct {
 	// so deleting old files from merge doesn't coincide with opening
 	// a new reader on those files
 	mergeLock sync.Mutex
-	// counter counts down so lower numbered L0 files are newer values
-	// and can be sorted the same as L1,L2,L3 files etc which are the same
-	// lower numbered files contain newer values
-	counter         int64
+	// so readers reopened by concurrent merges and flushes are swapped
+	// in the order they saw the manifest
+	reloadLock sync.Mutex
+	// files in each level. edited under mergeLock
+	manifest *manifest.Manifest
+	// sequence of the last Put or Writer batch. taken under memLock
+	sequence        uint64
 	mergerChan      chan int
+	compactChan     chan compactRequest
 	mergerWaitGroup sync.WaitGroup
-	reader          *merge.Reader
-	closed          bool
+	// canceled by Close to stop merges in flight
+	mergeCtx    context.Context
+	mergeCancel context.CancelFunc
+	reader      *merge.Reader
+	closed      bool
+	// decompressed blocks shared by every cursor. nil if disabled
+	cache *cache.Cache
+	// picks merges. used by the merge goroutine only
+	policy CompactionPolicy
+	// merges run at once
+	workers int
+	// level 0 limits where writes slow down and wait for merges
+	stall stall
+	// merge I/O rate limit
+	rate rate
+	// live snapshots and a counter naming the links that keep their
+	// files. guarded by mergeLock
+	snapshots   map[*Snapshot]bool
+	linkCounter int64
+
+	// unsorted writes go to mem. when full it is frozen and moved to imm
+	// until flushed to a level 0 file. imm is newest first and guarded
+	// by readLock. memLock serializes writes to mem
+	memLock        sync.Mutex
+	mem            *memtable.Table
+	imm            []*frozen
+	flushChan      chan int
+	flushWaitGroup sync.WaitGroup
+	// write-ahead log for mem
+	wal        *wal.Log
+	logCounter int64
+
+	// values at least vlogThreshold long are written to vlog and data
+	// blocks hold a pointer. vlog is guarded by writeLock. values is
+	// swapped under readLock with writeLock held
+	vlog        *vlog.Writer
+	vlogCounter int64
+	values      *valueLogs
+	pointer     []byte
 
 	// options
 	blockSize      int
 	mergeFrequency time.Duration
-
+	memtableSize   int
+	syncMode       SyncMode
+	bitsPerKey     int
+	vlogThreshold  int
+	cacheSize      int
+	retention      uint64
+	// folds Writer.Merge operands. nil if merges aren't allowed
+	mergeOperator MergeOperator
+
+	// merge output files are split at this size
+	fileSize int
 	// size of level 1
 	baseSize int
 	// size of level N + 1 = multiplier + size of level N
@@ -43,13 +106,16 @@ type DB struct {
 }
 
 const (
-	counterMax = 999_999_999_999_999
-	maxLevel   = 10
+	maxLevel = 10
 
-	MaxKeySize = shared.MaxKeySize
+	MaxKeySize   = shared.MaxKeySize
+	MaxValueSize = shared.MaxValueSize
 )
 
-var ErrKeyTooBig = shared.ErrKeyTooBig
+var (
+	ErrKeyTooBig   = shared.ErrKeyTooBig
+	ErrValueTooBig = shared.ErrValueTooBig
+)
 
 type Stats struct {
 	// number of data blocks
@@ -68,6 +134,21 @@ type Stats struct {
 	KeyBytes int
 	// uncompressed value bytes
 	ValueBytes int
+	// bloom filter bytes
+	FilterBytes int
+	// range tombstone block bytes. see Writer.DeleteRange
+	TombstoneBytes int
+	// blocks found in and missing from the block cache since Open
+	CacheHits   int
+	CacheMisses int
+	// level 0 files and their bytes
+	Level0Files int
+	Level0Bytes int
+	// writes slowed at the soft level 0 limit and stopped at the hard
+	// limit since Open and the time they waited
+	Slowdowns int
+	Stops     int
+	StallTime time.Duration
 }
 
 // estimated compressed size
@@ -97,29 +178,83 @@ func Open(directory string, opts ...Opt) (*DB, error) {
 		return nil, err
 	}
 	db := &DB{
-		directory:  directory,
-		mergerChan: make(chan int, 2),
-		counter:    counterMax,
+		directory:   directory,
+		mergerChan:  make(chan int, 2),
+		compactChan: make(chan compactRequest),
+		flushChan:   make(chan int, 1),
+		mem:         memtable.New(),
+		snapshots:   map[*Snapshot]bool{},
 
 		// options
 		blockSize:      4096,
 		mergeFrequency: time.Hour,
+		memtableSize:   4 * 1024 * 1024,
+		bitsPerKey:     10,
 
+		workers:    2,
+		stall:      stall{softFiles: 20, hardFiles: 36},
+		rate:       rate{limiter: ratelimit.New(0)},
+		fileSize:   4 * 1024 * 1024,
 		baseSize:   16 * 1024 * 1024,
 		multiplier: 10,
 	}
 	for _, opt := range opts {
 		opt(db)
 	}
+	if db.policy == nil {
+		db.policy = LeveledPolicy(db.baseSize, db.multiplier)
+	}
+	db.adaptRate()
+	if db.cacheSize > 0 {
+		db.cache = cache.New(db.cacheSize)
+	}
+
+	db.removeSnapshotLinks()
+	err = db.openManifest()
+	if err != nil {
+		return nil, err
+	}
+	err = db.recoverCommits()
+	if err == nil {
+		db.removeOrphans()
+		err = db.openValueLogs()
+	}
+	if err != nil {
+		db.manifest.Close()
+		return nil, err
+	}
+
+	err = db.openLogs()
+	if err != nil {
+		db.values.release()
+		db.manifest.Close()
+		return nil, err
+	}
 
 	err = db.reloadReader()
 	if err != nil {
+		db.wal.Close()
+		db.values.release()
+		db.manifest.Close()
 		close(db.mergerChan)
 		return nil, err
 	}
+	for _, f := range db.reader.Stats().Footers {
+		if f.MaxSequence > db.sequence {
+			db.sequence = f.MaxSequence
+		}
+	}
 
+	db.mergeCtx, db.mergeCancel = context.WithCancel(context.Background())
 	db.mergerWaitGroup.Add(1)
-	go db.mergeLoop()
+	go db.mergeLoop(db.mergerChan)
+	// the tree may not fit the policy it was opened with
+	db.wakeMerger()
+	db.flushWaitGroup.Add(1)
+	go db.flushLoop()
+	if len(db.imm) > 0 {
+		db.wakeFlusher()
+	}
 
 	return db, nil
 }
@@ -142,6 +277,17 @@ func (db *DB) Stats() Stats {
 		rs.Inserts += s.Inserts
 		rs.KeyBytes = s.RawKeyBytes
 		rs.ValueBytes = s.RawValueBytes
+		rs.FilterBytes += s.FilterSize
+		rs.TombstoneBytes += s.TombstoneSize
+	}
+	rs.Level0Files = int(atomic.LoadInt64(&db.stall.files))
+	rs.Level0Bytes = int(atomic.LoadInt64(&db.stall.bytes))
+	rs.Slowdowns = int(atomic.LoadInt64(&db.stall.slowdowns))
+	rs.Stops = int(atomic.LoadInt64(&db.stall.stops))
+	rs.StallTime = time.Duration(atomic.LoadInt64(&db.stall.nanos))
+	if db.cache != nil {
+		rs.CacheHits = db.cache.Hits()
+		rs.CacheMisses = db.cache.Misses()
 	}
 	return rs
 }
@@ -150,21 +296,57 @@ func (db *DB) Stats() Stats {
 // atomic with respect to the final rename and cleanup of merged files
 // also with respect to opening a cursor
 func (db *DB) reloadReader() error {
+	db.reloadLock.Lock()
+	defer db.reloadLock.Unlock()
+
 	var r *merge.Reader
+	// memtables already in a level 0 file opened by this reader
+	var flushed []*frozen
+	// level 0 size for write stalls
+	var files0 int
+	var bytes0 int64
 	err := func() error {
 		// lock so merger can't delete files while we are opening them
 		db.mergeLock.Lock()
 		defer db.mergeLock.Unlock()
 
-		matches, err := filepath.Glob(fmt.Sprintf("%v/*.lsm", db.directory))
-		if err != nil {
-			return err
+		// flushed is only set under mergeLock so this matches the files
+		// found below
+		db.readLock.Lock()
+		for _, t := range db.imm {
+			if t.flushed {
+				flushed = append(flushed, t)
+			}
+		}
+		old := db.reader
+		db.readLock.Unlock()
+
+		// each level 0 file is read on its own. other levels are read
+		// as one source
+		var levels [][]string
+		for i := 0; i < db.manifest.Levels(); i++ {
+			var names []string
+			for _, f := range db.manifest.Level(i) {
+				name := filepath.Join(db.directory, f.Name)
+				if i == 0 {
+					levels = append(levels, []string{name})
+					files0++
+					bytes0 += f.Size
+				} else {
+					names = append(names, name)
+				}
+			}
+			if len(names) > 0 {
+				levels = append(levels, names)
+			}
+		}
+		var err error
+		if old == nil {
+			r, err = merge.NewLevelReader(levels, db.cache)
+		} else {
+			// keep unchanged files so their cached blocks stay valid
+			r, err = old.Reopen(levels)
 		}
-
-		sort.Slice(matches, func(i, j int) bool {
-			return matches[i] < matches[j]
-		})
-		r, err = merge.NewReader(matches)
 		return err
 	}()
 	if err != nil {
@@ -181,6 +363,8 @@ func (db *DB) reloadReader() error {
 	if old != nil {
 		old.Close()
 	}
+	db.removeFlushed(flushed)
+	db.setLevel0(files0, bytes0)
 
 	return nil
 }
@@ -190,58 +374,173 @@ func (db *DB) Cursor() Cursor {
 	defer db.readLock.Unlock()
 
 	c := Cursor{}
-	c.m = db.reader.Cursor()
+	c.m = db.reader.Cursor(db.memCursors(math.MaxUint64)...)
+	c.values = db.values.acquire()
+	db.setMergeOperator(c.m, c.values)
 	return c
 }
 
+// cursor that reads the database as it was at sequence seq from
+// Sequence, Writer.Sequence or Snapshot.Sequence. versions written after
+// seq are skipped. merges only keep overwritten versions newer than the
+// retention window and the oldest snapshot so older reads may see a
+// newer version. see WithRetention
+func (db *DB) CursorAt(seq uint64) Cursor {
+	db.readLock.Lock()
+	defer db.readLock.Unlock()
+
+	c := Cursor{}
+	c.m = db.reader.Cursor(db.memCursors(seq)...)
+	c.m.SetAsOf(seq)
+	c.values = db.values.acquire()
+	db.setMergeOperator(c.m, c.values)
+	return c
+}
+
+// sequence of the last Put, Delete or Writer batch
+func (db *DB) Sequence() uint64 {
+	return atomic.LoadUint64(&db.sequence)
+}
+
+// merges keep versions newer than this. caller must not hold mergeLock
+func (db *DB) horizon() uint64 {
+	h := db.Sequence()
+	if h > db.retention {
+		h -= db.retention
+	} else {
+		h = 0
+	}
+	db.mergeLock.Lock()
+	defer db.mergeLock.Unlock()
+	for s := range db.snapshots {
+		if s.seq < h {
+			h = s.seq
+		}
+	}
+	return h
+}
+
 func (db *DB) Write() (Writer, error) {
+	return db.WriteContext(context.Background())
+}
+
+// Write that returns ctx's error if it is done while level 0 is over
+// its limits. see WithLevel0Limits
+func (db *DB) WriteContext(ctx context.Context) (Writer, error) {
+	err := db.stallWrite(ctx, true)
+	if err != nil {
+		return Writer{}, err
+	}
 	db.writeLock.Lock()
 	if db.closed {
 		db.writeLock.Unlock()
 		return Writer{}, fmt.Errorf("teepeedb: database closed")
 	}
 
-	files, err := filepath.Glob(fmt.Sprintf("%v/l00.*.lsm", db.directory))
-	if err == nil && len(files) == 0 {
-		db.counter = counterMax
+	// unsorted writes made before this batch must be in older files.
+	// the batch sequence is taken with the memtable frozen so every
+	// later Put has a higher sequence and is read before the batch
+	db.memLock.Lock()
+	if db.mem.Len() > 0 {
+		err = db.freeze()
+	}
+	seq := atomic.AddUint64(&db.sequence, 1)
+	db.memLock.Unlock()
+	if err == nil {
+		err = db.flushMemtables(false)
+	}
+	if err != nil {
+		db.writeLock.Unlock()
+		return Writer{}, err
 	}
 
-	filename := fmt.Sprintf("%v/l00.%015d.lsm", db.directory, db.counter)
-	db.counter--
-	w, err := writer.NewFile(filename+".tmp", db.blockSize)
+	filename := db.newFilename()
+	w, err := writer.NewFile(filename+".tmp", db.blockSize, db.bitsPerKey)
 	if err != nil {
 		db.writeLock.Unlock()
 		return Writer{}, err
 	}
+	w.SetSequence(seq)
 
 	return Writer{
 		db:       db,
 		filename: filename,
 		w:        w,
+		seq:      seq,
 	}, nil
 }
 
+// path of a new file not used by any other
+func (db *DB) newFilename() string {
+	return filepath.Join(db.directory, db.manifest.NewName())
+}
+
 // caller's responsibility to ensure no more new reads or writes come in once
-// close has started.
+// close has started. merges in flight are canceled and their output removed
 func (db *DB) Close() {
+	db.CloseContext(context.Background())
+}
+
+// Close that cancels merges in flight and stops waiting for them once
+// ctx is done. the merge goroutine then finishes closing in the
+// background and ctx's error is returned
+func (db *DB) CloseContext(ctx context.Context) error {
 	// allow double close
 	if db.mergerChan == nil {
-		return
+		return nil
 	}
-	db.closed = true
+
+	// flusher takes writeLock so stop it first
+	close(db.flushChan)
+	db.flushWaitGroup.Wait()
 
 	if !db.writeLock.TryLock() {
 		log.Println("teepeedb: waiting for write to close")
 		db.writeLock.Lock()
 	}
 	defer db.writeLock.Unlock()
+	// set under writeLock so Write and Flush see it
+	db.closed = true
+
+	err := db.flushMemtables(true)
+	if err != nil {
+		log.Println("teepeedb: error flushing memtable on close", db.directory, err)
+	}
+	db.wal.Close()
+	// memtable is empty so the log has nothing to replay
+	if db.mem.Len() == 0 {
+		os.Remove(db.wal.Filename)
+	}
+	if db.vlog != nil {
+		db.vlog.Close()
+	}
 
-	// signal merge to close
+	// stop merges and signal merge to close
+	db.mergeCancel()
 	close(db.mergerChan)
-	// wait for merger to close
-	db.mergerWaitGroup.Wait()
 	db.mergerChan = nil
+	// wait for merger to close
+	done := make(chan struct{})
+	go func() {
+		db.mergerWaitGroup.Wait()
+		db.release()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
+// close files once the merge goroutine is done with them
+func (db *DB) release() {
 	db.reader.Close()
 	db.reader = nil
+	db.manifest.Close()
+	db.values.release()
+	if db.cache != nil {
+		db.cache.Close()
+	}
 }
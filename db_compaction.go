@@ -0,0 +1,310 @@
+package teepeedb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// file in the tree as seen by a CompactionPolicy
+type FileInfo struct {
+	Name  string
+	Level int
+	Size  int64
+	// first and last key. nil if the file is empty
+	Smallest, Largest []byte
+	// when the file was written
+	Created time.Time
+	// every entry in the file except deletes has expired by then. zero
+	// if one never expires. see ExpireAt
+	Expires time.Time
+	// in a running job. new jobs must leave it out
+	Busy bool
+}
+
+// merge Inputs, newest first, into files in Level along with any files
+// in Level they overlap. Inputs that don't overlap each other or
+// anything else in Level are moved without being rewritten. with Drop
+// the inputs are removed from the tree instead
+type CompactionJob struct {
+	Level  int
+	Inputs []FileInfo
+	Drop   bool
+}
+
+// decides which files to merge. levels has one entry for every level
+// the database supports. level 0 is newest first and may overlap, the
+// others are disjoint files in key order. Pick is called from one
+// goroutine after every flush, commit and merge and returns nil once
+// nothing needs merged. a policy may keep state between calls so give
+// each database its own. jobs must keep newer data above older data.
+// jobs run in parallel when they share no files and either their key
+// ranges or the levels they span are disjoint. others wait for a later
+// Pick so order jobs most urgent first
+type CompactionPolicy interface {
+	Pick(levels [][]FileInfo) []CompactionJob
+}
+
+// true if any of files is in a running job
+func busy(files []FileInfo) bool {
+	for _, f := range files {
+		if f.Busy {
+			return true
+		}
+	}
+	return false
+}
+
+func levelSize(files []FileInfo) int64 {
+	var sz int64
+	for _, f := range files {
+		sz += f.Size
+	}
+	return sz
+}
+
+// smallest and largest key of files
+func keyRange(files []FileInfo) (smallest, largest []byte) {
+	for _, f := range files {
+		if f.Smallest == nil {
+			continue
+		}
+		if smallest == nil || bytes.Compare(f.Smallest, smallest) < 0 {
+			smallest = f.Smallest
+		}
+		if largest == nil || bytes.Compare(f.Largest, largest) > 0 {
+			largest = f.Largest
+		}
+	}
+	return
+}
+
+// files in level with a key from smallest to largest
+func overlapping(level []FileInfo, smallest, largest []byte) []FileInfo {
+	var files []FileInfo
+	for _, f := range level {
+		if f.Smallest != nil && bytes.Compare(f.Smallest, largest) <= 0 && bytes.Compare(f.Largest, smallest) >= 0 {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+type leveled struct {
+	baseSize, multiplier int64
+	// largest key of the last file merged out of each level so the
+	// next merge starts after it
+	mergeKey [][]byte
+}
+
+// every level 0 file is merged into level 1 with the level 1 files it
+// overlaps. otherwise the first level over its size merges its next file,
+// taking turns through its key range, into the files it overlaps in the
+// level below. level 1 holds baseSize bytes and each level after
+// multiplier times the one above. keeps reads fast and space small at
+// the cost of rewriting data more often. 0 uses the defaults of 16 MB and 10
+func LeveledPolicy(baseSize, multiplier int) CompactionPolicy {
+	if baseSize <= 0 {
+		baseSize = 16 * 1024 * 1024
+	}
+	if multiplier < 2 {
+		multiplier = 10
+	}
+	return &leveled{baseSize: int64(baseSize), multiplier: int64(multiplier)}
+}
+
+func (p *leveled) Pick(levels [][]FileInfo) []CompactionJob {
+	var jobs []CompactionJob
+	// level 0 drains first and all at once so its files stay newest
+	// first above level 1
+	if len(levels[0]) > 0 && !busy(levels[0]) {
+		smallest, largest := keyRange(levels[0])
+		inputs := append(levels[0][:len(levels[0]):len(levels[0])], overlapping(levels[1], smallest, largest)...)
+		if !busy(inputs) {
+			jobs = append(jobs, CompactionJob{Level: 1, Inputs: inputs})
+		}
+	}
+	if p.mergeKey == nil {
+		p.mergeKey = make([][]byte, len(levels))
+	}
+
+	max := p.baseSize
+	for i := 1; i < len(levels)-1; i++ {
+		level := levels[i]
+		if levelSize(level) > max {
+			// next idle file after the last one merged whose
+			// overlaps below are idle too
+			start := 0
+			for start < len(level) && bytes.Compare(level[start].Smallest, p.mergeKey[i]) <= 0 {
+				start++
+			}
+			for j := range level {
+				f := level[(start+j)%len(level)]
+				inputs := append([]FileInfo{f}, overlapping(levels[i+1], f.Smallest, f.Largest)...)
+				if !busy(inputs) {
+					p.mergeKey[i] = f.Largest
+					jobs = append(jobs, CompactionJob{Level: i + 1, Inputs: inputs})
+					break
+				}
+			}
+		}
+		max *= p.multiplier
+	}
+	return jobs
+}
+
+type tiered struct {
+	minFiles int
+	ratio    float64
+}
+
+// each level below 0 holds one sorted run, newer runs above older ones.
+// once level 0 has minFiles files they become a new run in level 1,
+// moving older runs down to make room. a run is merged with the one
+// below once that one is at most ratio times its size. writes far less
+// than LeveledPolicy for write heavy loads at the cost of reads and
+// space. 0 uses the defaults of 4 files and a ratio of 2
+func TieredPolicy(minFiles int, ratio float64) CompactionPolicy {
+	if minFiles <= 0 {
+		minFiles = 4
+	}
+	if ratio < 1 {
+		ratio = 2
+	}
+	return &tiered{minFiles: minFiles, ratio: ratio}
+}
+
+func (p *tiered) Pick(levels [][]FileInfo) []CompactionJob {
+	last := len(levels) - 1
+	// runs move as a whole so one job at a time
+	for _, level := range levels {
+		if busy(level) {
+			return nil
+		}
+	}
+	// similar sized runs
+	for i := 1; i < last; i++ {
+		newer, older := levels[i], levels[i+1]
+		if len(newer) > 0 && len(older) > 0 && float64(levelSize(older)) <= p.ratio*float64(levelSize(newer)) {
+			return []CompactionJob{{Level: i + 1, Inputs: append(newer[:len(newer):len(newer)], older...)}}
+		}
+	}
+
+	if len(levels[0]) < p.minFiles {
+		return nil
+	}
+	if len(levels[1]) == 0 {
+		return []CompactionJob{{Level: 1, Inputs: levels[0]}}
+	}
+	// move the run above the first empty level down into it
+	for i := 2; i <= last; i++ {
+		if len(levels[i]) == 0 {
+			return []CompactionJob{{Level: i, Inputs: levels[i-1]}}
+		}
+	}
+	// every level has a run. merge the oldest two
+	return []CompactionJob{{Level: last, Inputs: append(levels[last-1][:len(levels[last-1]):len(levels[last-1])], levels[last]...)}}
+}
+
+type fifo struct {
+	maxSize int64
+	ttl     time.Duration
+}
+
+// never merges. files stay in level 0 and the oldest are dropped while
+// the total size is over maxSize or once they are older than ttl.
+// for logs and metrics read by recent time ranges. 0 turns off either
+// limit
+func FIFOPolicy(maxSize int64, ttl time.Duration) CompactionPolicy {
+	return &fifo{maxSize: maxSize, ttl: ttl}
+}
+
+func (p *fifo) Pick(levels [][]FileInfo) []CompactionJob {
+	// oldest last. files merged by another policy before are older
+	// than every level 0 file
+	var files []FileInfo
+	var total int64
+	for _, level := range levels {
+		files = append(files, level...)
+		total += levelSize(level)
+	}
+	var drop []FileInfo
+	now := time.Now()
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		if f.Busy {
+			break
+		}
+		expired := p.ttl > 0 && now.Sub(f.Created) > p.ttl
+		if !expired && (p.maxSize <= 0 || total <= p.maxSize) {
+			break
+		}
+		drop = append(drop, f)
+		total -= f.Size
+	}
+	if len(drop) == 0 {
+		return nil
+	}
+	return []CompactionJob{{Inputs: drop, Drop: true}}
+}
+
+// drop files whose entries have all expired by now without merging
+// them. their deletes and expired entries still hide keys in older
+// files so only files with no older file overlapping them are dropped
+func expiredFiles(levels [][]FileInfo, now time.Time) []CompactionJob {
+	var jobs []CompactionJob
+	for i, level := range levels {
+		for j, f := range level {
+			if f.Busy || f.Expires.IsZero() || f.Expires.After(now) {
+				continue
+			}
+			// level 0 is newest first
+			older := i == 0 && len(overlapping(level[j+1:], f.Smallest, f.Largest)) > 0
+			for _, lower := range levels[i+1:] {
+				older = older || len(overlapping(lower, f.Smallest, f.Largest)) > 0
+			}
+			if !older {
+				jobs = append(jobs, CompactionJob{Inputs: []FileInfo{f}, Drop: true})
+			}
+		}
+	}
+	return jobs
+}
+
+// tree from the manifest as passed to CompactionPolicy.Pick. files
+// named in busy are marked Busy
+func (db *DB) describeLevels(busy map[string]bool) [][]FileInfo {
+	expires := map[string]int64{}
+	db.readLock.Lock()
+	st := db.reader.Stats()
+	db.readLock.Unlock()
+	for i, f := range st.Footers {
+		if f.Expires != 0 {
+			expires[filepath.Base(st.Filenames[i])] = f.Expires
+		}
+	}
+	levels := make([][]FileInfo, maxLevel)
+	for i := range levels {
+		for _, f := range db.manifest.Level(i) {
+			info := FileInfo{
+				Name:     f.Name,
+				Level:    f.Level,
+				Size:     f.Size,
+				Smallest: f.Smallest,
+				Largest:  f.Largest,
+				Busy:     busy[f.Name],
+			}
+			// files aren't changed after they are written
+			st, err := os.Stat(filepath.Join(db.directory, f.Name))
+			if err == nil {
+				info.Created = st.ModTime()
+			}
+			if e, ok := expires[f.Name]; ok {
+				info.Expires = time.Unix(0, e)
+			}
+			levels[i] = append(levels[i], info)
+		}
+	}
+	return levels
+}
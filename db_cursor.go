@@ -28,6 +28,10 @@ func (r FindResult) Any() bool {
 
 type Cursor struct {
 	m *merge.Cursor
+	// value logs pointers are resolved against
+	values *valueLogs
+	buf    []byte
+	err    error
 }
 
 type KV struct {
@@ -36,11 +40,18 @@ type KV struct {
 
 func (c *Cursor) Close() {
 	c.m.Close()
+	if c.values != nil {
+		c.values.release()
+		c.values = nil
+	}
 }
 
 // call First or Find once before Previous
 // if more is true kv is valid until next call to cursor function
 func (c *Cursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
 	for {
 		more := c.m.Next()
 		if !more {
@@ -56,7 +67,9 @@ func (c *Cursor) Next() bool {
 // call Last or Find once before Previous
 // if more is true kv is valid until next call to cursor function
 func (c *Cursor) Previous() bool {
-
+	if c.err != nil {
+		return false
+	}
 	for {
 		more := c.m.Previous()
 		if !more {
@@ -70,8 +83,11 @@ func (c *Cursor) Previous() bool {
 }
 
 // go to first key-value pair and return it if result is true
-// if result is false then DB is empty
+// if result is false then DB is empty or Err() is set
 func (c *Cursor) First() bool {
+	if c.err != nil {
+		return false
+	}
 	more := c.m.First()
 	for more && c.m.Delete {
 		more = c.m.Next()
@@ -80,8 +96,11 @@ func (c *Cursor) First() bool {
 }
 
 // go to last key-value pair and return it if result is true
-// if result is false then DB is empty
+// if result is false then DB is empty or Err() is set
 func (c *Cursor) Last() bool {
+	if c.err != nil {
+		return false
+	}
 	more := c.m.Last()
 	for more && c.m.Delete {
 		more = c.m.Previous()
@@ -93,8 +112,11 @@ func (c *Cursor) Last() bool {
 // key and value will be set on output if found or partial is true
 // returns Found for exact match
 // FoundGreater for a value greater than key.
-// NotFound for no values >= key
+// NotFound for no values >= key or Err() is set
 func (c *Cursor) Find(find []byte) FindResult {
+	if c.err != nil {
+		return NotFound
+	}
 	rs := c.m.Find(find)
 	result := FindResult(rs)
 	if result == NotFound {
@@ -116,6 +138,27 @@ func (c *Cursor) Key() []byte {
 	return c.m.Key
 }
 
+// returns nil and sets Err() if the value can't be read
 func (c *Cursor) Value() []byte {
-	return c.m.Value()
+	v := c.m.Value()
+	if v == nil || !c.m.Pointer() {
+		return v
+	}
+	var err error
+	v, c.buf, err = c.values.read(v, c.buf)
+	if err != nil {
+		c.err = err
+		return nil
+	}
+	return v
+}
+
+// error that stopped the cursor such as *ErrCorrupt. nil if the cursor
+// only ran out of keys. check after a move returns false to tell the
+// end from a failure. once set every move returns false
+func (c *Cursor) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.m.Err()
 }
@@ -0,0 +1,84 @@
+//go:build go1.23
+
+package teepeedb
+
+import "iter"
+
+// every key-value pair in key order. the cursor is closed when the loop
+// ends or breaks. key and value are only valid until the next iteration.
+// a read error ends the loop early. use ScanErr to see it
+func (db *DB) All() iter.Seq2[[]byte, []byte] {
+	return db.Scan(nil, nil)
+}
+
+// every key-value pair in reverse key order. see All
+func (db *DB) AllBackward() iter.Seq2[[]byte, []byte] {
+	return db.ScanBackward(nil, nil)
+}
+
+// key-value pairs >= lower and < upper in key order. nil is unbounded.
+// see All
+func (db *DB) Scan(lower, upper []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for kv, err := range db.ScanErr(lower, upper, false) {
+			if err != nil || !yield(kv.Key, kv.Value) {
+				return
+			}
+		}
+	}
+}
+
+// key-value pairs >= lower and < upper in reverse key order. see Scan
+func (db *DB) ScanBackward(lower, upper []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for kv, err := range db.ScanErr(lower, upper, true) {
+			if err != nil || !yield(kv.Key, kv.Value) {
+				return
+			}
+		}
+	}
+}
+
+// Scan or ScanBackward that yields an error as the last pair if a
+// failure, rather than the end of the range, stopped the cursor
+func (db *DB) ScanErr(lower, upper []byte, backward bool) iter.Seq2[KV, error] {
+	return func(yield func(KV, error) bool) {
+		c := db.Range(lower, upper)
+		defer c.Close()
+		for kv, err := range c.All(backward) {
+			if !yield(kv, err) {
+				return
+			}
+		}
+	}
+}
+
+// key-value pairs from the cursor's current bounds. the caller still
+// closes the cursor. see ScanErr
+func (c *Cursor) All(backward bool) iter.Seq2[KV, error] {
+	return func(yield func(KV, error) bool) {
+		var more bool
+		if backward {
+			more = c.Last()
+		} else {
+			more = c.First()
+		}
+		for more {
+			kv := KV{Key: c.Key(), Value: c.Value()}
+			if kv.Value == nil && c.Err() != nil {
+				break
+			}
+			if !yield(kv, nil) {
+				return
+			}
+			if backward {
+				more = c.Previous()
+			} else {
+				more = c.Next()
+			}
+		}
+		if err := c.Err(); err != nil {
+			yield(KV{}, err)
+		}
+	}
+}
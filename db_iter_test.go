@@ -0,0 +1,77 @@
+//go:build go1.23
+
+package teepeedb
+
+import (
+	"encoding/binary"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIter(t *testing.T) {
+	os.RemoveAll("test7.db")
+	defer os.RemoveAll("test7.db")
+	db := E(Open("test7.db"))
+
+	count := 1000
+	for i := 0; i < count; i++ {
+		k := binary.BigEndian.AppendUint32(nil, uint32(i))
+		err := db.Put(k, k)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	i := 0
+	for k, v := range db.All() {
+		if binary.BigEndian.Uint32(k) != uint32(i) || binary.BigEndian.Uint32(v) != uint32(i) {
+			log.Panicln("all", i)
+		}
+		i++
+	}
+	if i != count {
+		log.Panicln("all count", i)
+	}
+
+	i = count - 1
+	for k := range db.AllBackward() {
+		if binary.BigEndian.Uint32(k) != uint32(i) {
+			log.Panicln("backward", i)
+		}
+		if i == 500 {
+			break
+		}
+		i--
+	}
+
+	lo := binary.BigEndian.AppendUint32(nil, 100)
+	hi := binary.BigEndian.AppendUint32(nil, 200)
+	i = 199
+	for k := range db.ScanBackward(lo, hi) {
+		if binary.BigEndian.Uint32(k) != uint32(i) {
+			log.Panicln("scan backward", i)
+		}
+		i--
+	}
+	if i != 99 {
+		log.Panicln("scan backward end", i)
+	}
+	db.Close()
+
+	// corrupt the only file so the error variant reports it
+	files := E(filepath.Glob("test7.db/*.lsm"))
+	buf := E(os.ReadFile(files[0]))
+	buf[len(buf)/8] ^= 0x01
+	os.WriteFile(files[0], buf, 0644)
+	db = E(Open("test7.db"))
+	defer db.Close()
+	var err error
+	for _, e := range db.ScanErr(nil, nil, false) {
+		err = e
+	}
+	if err == nil {
+		log.Panicln("error not yielded")
+	}
+}
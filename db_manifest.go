@@ -0,0 +1,123 @@
+package teepeedb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/stangelandcl/teepeedb/internal/manifest"
+	"github.com/stangelandcl/teepeedb/internal/reader"
+)
+
+// level of a file named before manifests. l00.<counter>.lsm for level 0
+// with lower counters newer and l<level>.lsm for the rest
+func legacyLevel(name string) (int, bool) {
+	var level int
+	_, err := fmt.Sscanf(name, "l%02d", &level)
+	return level, err == nil
+}
+
+// read the files in each level from the manifest. a directory from
+// before manifests is described from its file names once
+func (db *DB) openManifest() error {
+	var err error
+	if manifest.Exists(db.directory) {
+		db.manifest, err = manifest.Open(db.directory)
+		return err
+	}
+
+	matches, err := filepath.Glob(fmt.Sprintf("%v/*.lsm", db.directory))
+	if err != nil {
+		return err
+	}
+	// newest first
+	sort.Strings(matches)
+	var files []manifest.File
+	for _, m := range matches {
+		level, ok := legacyLevel(filepath.Base(m))
+		if !ok {
+			continue
+		}
+		f, err := describe(m, level)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	db.manifest, err = manifest.Create(db.directory, files)
+	return err
+}
+
+// remove files left by a crash between writing them and recording them
+// in the manifest or between removing them from it and deleting them
+func (db *DB) removeOrphans() {
+	matches, _ := filepath.Glob(fmt.Sprintf("%v/*.lsm", db.directory))
+	for _, m := range matches {
+		name := filepath.Base(m)
+		_, ours := manifest.Number(name)
+		_, legacy := legacyLevel(name)
+		if (ours || legacy) && !db.manifest.Has(name) {
+			os.Remove(m)
+		}
+	}
+}
+
+// manifest entry for filename in level
+func describe(filename string, level int) (manifest.File, error) {
+	r, err := reader.NewFile(filename)
+	if err != nil {
+		return manifest.File{}, err
+	}
+	defer r.Close()
+	first, last := r.Range()
+	// merges into the level must include the files range tombstones
+	// could hide keys in
+	start, end := r.TombstoneRange()
+	if start != nil && (first == nil || bytes.Compare(start, first) < 0) {
+		first = start
+	}
+	if end != nil && (last == nil || bytes.Compare(end, last) > 0) {
+		last = end
+	}
+	return manifest.File{
+		Name:     filepath.Base(filename),
+		Level:    level,
+		Size:     r.Size(),
+		Smallest: clone(first),
+		Largest:  clone(last),
+	}, nil
+}
+
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// rename a new file from its temp name into level 0 and record it in the
+// manifest. done runs with mergeLock held once the file is in the tree.
+// caller must not hold mergeLock
+func (db *DB) addLevel0(filename string, done func()) error {
+	f, err := describe(filename+".tmp", 0)
+	if err != nil {
+		return err
+	}
+	f.Name = filepath.Base(filename)
+	err = os.Rename(filename+".tmp", filename)
+	if err != nil {
+		return err
+	}
+	// the manifest must not name a file that could vanish on power loss
+	syncDir(db.directory)
+
+	db.mergeLock.Lock()
+	defer db.mergeLock.Unlock()
+	err = db.manifest.Apply(manifest.Edit{Add: []manifest.File{f}})
+	if err == nil && done != nil {
+		done()
+	}
+	return err
+}
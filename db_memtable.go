@@ -0,0 +1,277 @@
+package teepeedb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync/atomic"
+
+	"github.com/stangelandcl/teepeedb/internal/memtable"
+	"github.com/stangelandcl/teepeedb/internal/merge"
+	"github.com/stangelandcl/teepeedb/internal/shared"
+	"github.com/stangelandcl/teepeedb/internal/wal"
+	"github.com/stangelandcl/teepeedb/internal/writer"
+)
+
+// memtable waiting to be written to a level 0 file
+type frozen struct {
+	t *memtable.Table
+	// write-ahead log to remove once flushed
+	wal string
+	// set under mergeLock once the level 0 file is renamed into place
+	flushed bool
+}
+
+// insert or update key. keys can be written in any order.
+// writes are appended to the write-ahead log then buffered in memory and
+// visible to the next Cursor() opened.
+// the buffer is written to a level 0 file in the background once it
+// reaches the memtable size. see WithMemtableSize and WithSyncMode
+func (db *DB) Put(key, val []byte, opts ...WriteOpt) error {
+	return db.put(key, val, false, opts)
+}
+
+// delete key. keys can be deleted in any order.
+// see Put
+func (db *DB) Delete(key []byte, opts ...WriteOpt) error {
+	return db.put(key, nil, true, opts)
+}
+
+func (db *DB) put(key, val []byte, delete bool, opts []WriteOpt) error {
+	if len(key) > shared.MaxKeySize {
+		return shared.ErrKeyTooBig
+	}
+	if len(val) > shared.MaxValueSize {
+		return shared.ErrValueTooBig
+	}
+	o := writeOpts{sync: db.syncMode, ctx: context.Background()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	err := db.stallWrite(o.ctx, false)
+	if err != nil {
+		return err
+	}
+	kind := wal.Put
+	if delete {
+		kind = wal.Delete
+	}
+
+	db.memLock.Lock()
+	// log and memtable must be in the same order
+	log := db.wal
+	seq := atomic.AddUint64(&db.sequence, 1)
+	pos, err := log.Append(kind, key, val, seq, o.sync)
+	if err != nil {
+		db.memLock.Unlock()
+		return err
+	}
+	db.mem.PutSeq(key, val, delete, seq)
+	froze := false
+	if db.mem.Size() >= db.memtableSize {
+		// on error keep writing to the current memtable and retry next time
+		froze = db.freeze() == nil
+		if froze {
+			db.wakeFlusher()
+		}
+	}
+	db.memLock.Unlock()
+
+	// wait outside memLock so concurrent writers share an fsync
+	if o.sync == SyncGroup {
+		err = log.Sync(pos)
+	}
+	// slow the writer that will add a level 0 file. the write is done
+	// so a canceled wait isn't an error
+	if err == nil && froze {
+		db.stallWrite(o.ctx, true)
+	}
+	return err
+}
+
+// write every Put and Delete so far to a level 0 file
+func (db *DB) Flush() error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	if db.closed {
+		return fmt.Errorf("teepeedb: database closed")
+	}
+	return db.flushMemtables(true)
+}
+
+// move current memtable to the immutable list and start a new log.
+// caller must hold memLock
+func (db *DB) freeze() error {
+	l, err := wal.Create(db.logFilename())
+	if err != nil {
+		return err
+	}
+	// old log must be on disk before its memtable can be flushed
+	// and the log removed. on failure keep it as the log of the live
+	// memtable so nothing is replayed twice or lost
+	old := db.wal
+	err = old.Close()
+	if err != nil {
+		l.Close()
+		os.Remove(l.Filename)
+		return err
+	}
+	db.wal = l
+
+	db.readLock.Lock()
+	defer db.readLock.Unlock()
+
+	db.imm = append([]*frozen{{t: db.mem, wal: old.Filename}}, db.imm...)
+	db.mem = memtable.New()
+	return nil
+}
+
+// cursors for memtables newest first that see writes up to seq.
+// caller must hold readLock
+func (db *DB) memCursors(seq uint64) []merge.Source {
+	sources := []merge.Source{db.mem.CursorAt(seq)}
+	for _, f := range db.imm {
+		sources = append(sources, f.t.CursorAt(seq))
+	}
+	return sources
+}
+
+// drop memtables now readable from level 0 files. caller must hold readLock
+func (db *DB) removeFlushed(flushed []*frozen) {
+	if len(flushed) == 0 {
+		return
+	}
+	imm := db.imm[:0]
+	for _, f := range db.imm {
+		found := false
+		for _, x := range flushed {
+			found = found || x == f
+		}
+		if !found {
+			imm = append(imm, f)
+		}
+	}
+	// clear tail so dropped tables can be garbage collected
+	for i := len(imm); i < len(db.imm); i++ {
+		db.imm[i] = nil
+	}
+	db.imm = imm
+}
+
+// write frozen memtables to level 0 files oldest first so file order matches
+// write order. all includes the active memtable. caller must hold writeLock
+func (db *DB) flushMemtables(all bool) error {
+	if all {
+		var err error
+		db.memLock.Lock()
+		if db.mem.Len() > 0 {
+			err = db.freeze()
+		}
+		db.memLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		var f *frozen
+		db.readLock.Lock()
+		for i := len(db.imm) - 1; i >= 0; i-- {
+			if !db.imm[i].flushed {
+				f = db.imm[i]
+				break
+			}
+		}
+		db.readLock.Unlock()
+		if f == nil {
+			return nil
+		}
+
+		err := db.flush(f)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (db *DB) flush(f *frozen) error {
+	filename := db.newFilename()
+	w, err := writer.NewFile(filename+".tmp", db.blockSize, db.bitsPerKey)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	horizon := db.horizon()
+	c := f.t.CursorAt(math.MaxUint64)
+	kv := shared.KV{}
+	var versions []shared.Version
+	more := c.First()
+	for more {
+		versions = c.Versions(versions[:0])
+		kv.Key, _ = c.Key()
+		more = c.Next()
+		if !shared.Collapse(&kv, versions, horizon, false) {
+			continue
+		}
+		err = db.separate(&kv)
+		for i := 0; err == nil && i < len(kv.Older); i++ {
+			err = db.separateVersion(kv.Key, &kv.Older[i])
+		}
+		if err == nil {
+			err = w.Add(&kv)
+		}
+		if err != nil {
+			os.Remove(filename + ".tmp")
+			return err
+		}
+	}
+
+	err = db.syncValueLog()
+	if err == nil {
+		err = w.Commit()
+	}
+	if err == nil {
+		// flushed and the new file must change together for reloadReader
+		err = db.addLevel0(filename, func() { f.flushed = true })
+	}
+	if err != nil {
+		os.Remove(filename + ".tmp")
+		return err
+	}
+
+	// the file now holds everything in the log
+	if f.wal != "" {
+		syncDir(db.directory)
+		os.Remove(f.wal)
+	}
+
+	err = db.reloadReader()
+	db.wakeMerger()
+	return err
+}
+
+func (db *DB) flushLoop() {
+	for range db.flushChan {
+		func() {
+			db.writeLock.Lock()
+			defer db.writeLock.Unlock()
+
+			err := db.flushMemtables(false)
+			if err != nil {
+				log.Println("error flushing memtable", db.directory, err)
+			}
+		}()
+	}
+	db.flushWaitGroup.Done()
+}
+
+// non-blocking try-wake flusher
+func (db *DB) wakeFlusher() {
+	select {
+	case db.flushChan <- 1:
+	default:
+	}
+}
@@ -1,6 +1,8 @@
 package teepeedb
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -8,124 +10,471 @@ import (
 	"sort"
 	"time"
 
+	"github.com/stangelandcl/teepeedb/internal/manifest"
 	"github.com/stangelandcl/teepeedb/internal/merge"
 )
 
-// true if a level at min or greater has data that needs merged
+// true if a level at min or greater has a key from smallest to largest
 // this is for checking if deletes should be tombstones or real deletes
 // lowest level can use real deletes
-func (db *DB) hasLowerLevel(min int) bool {
-	for i := min; i < maxLevel; i++ {
-		_, err := os.Stat(fmt.Sprintf("%v/%02d.lsm", db.directory, i))
-		if err == nil {
+func (db *DB) hasLowerLevel(min int, smallest, largest []byte) bool {
+	for i := min; i < db.manifest.Levels(); i++ {
+		if len(db.manifest.Overlapping(i, smallest, largest)) > 0 {
 			return true
 		}
 	}
 	return false
 }
 
-func fileSize(files ...string) int {
-	sz := 0
-	for _, file := range files {
-		x, err := os.Stat(file)
-		if err != nil {
-			continue
-		}
-		sz += int(x.Size())
+// job started by mergeLoop
+type running struct {
+	job   CompactionJob
+	files []manifest.File
+	// levels from the shallowest input to the output and the key range
+	// of the inputs. no other job may change the same levels in that
+	// range while this one runs
+	lo, hi            int
+	smallest, largest []byte
+	err               error
+}
+
+// true if a and b change the same levels in overlapping key ranges
+func (a *running) conflicts(b *running) bool {
+	if a.hi < b.lo || b.hi < a.lo || a.smallest == nil || b.smallest == nil {
+		return false
 	}
-	return sz
+	return bytes.Compare(a.smallest, b.largest) <= 0 && bytes.Compare(b.smallest, a.largest) <= 0
 }
 
-func (db *DB) mergeLoop() {
-	alive := true
-	for alive {
+func (r *running) level0() bool {
+	return r.lo == 0
+}
+
+// schedules jobs from the policy on up to workers goroutines and runs
+// CompactRange once the others finish. stops once wake is closed
+func (db *DB) mergeLoop(wake chan int) {
+	done := make(chan *running)
+	jobs := map[*running]bool{}
+	// inputs of jobs
+	busy := map[string]bool{}
+	var manual *compactRequest
+	// stop picking after a failed merge until woken
+	failed := false
+	for {
+		if manual != nil && len(jobs) == 0 {
+			manual.done <- db.compactRange(manual.ctx, manual.lower, manual.upper)
+			manual = nil
+		}
+		// nothing new starts once closing
+		if wake != nil && manual == nil && !failed {
+			db.schedule(jobs, busy, done)
+		}
+		db.setMerging(len(jobs) > 0 || manual != nil)
+		if wake == nil && len(jobs) == 0 {
+			break
+		}
+
+		var requests chan compactRequest
+		var timer <-chan time.Time
+		if wake != nil && manual == nil {
+			requests = db.compactChan
+			timer = time.After(db.mergeFrequency)
+		}
 		select {
-		case _, alive = <-db.mergerChan:
-		case <-time.After(db.mergeFrequency):
+		case _, alive := <-wake:
+			if !alive {
+				wake = nil
+			}
+			failed = false
+		case r := <-done:
+			delete(jobs, r)
+			for _, f := range r.files {
+				delete(busy, f.Name)
+			}
+			if r.err != nil && db.mergeCtx.Err() == nil {
+				log.Println("error merging", db.directory, "into level", r.job.Level, r.err)
+				failed = true
+			}
+		case req := <-requests:
+			manual = &req
+			db.setMerging(true)
+		case <-timer:
+			failed = false
 		}
+	}
+
+	files, _ := filepath.Glob(fmt.Sprint(db.directory, "/", "*.tmp"))
+	for _, f := range files {
+		os.Remove(f)
+	}
 
-		// loop because maybe new data came in as we were merging
-		for {
-			files, err := filepath.Glob(fmt.Sprintf("%v/l00.*.lsm", db.directory))
+	db.mergerWaitGroup.Done()
+}
+
+// start jobs until every worker is busy or the policy has nothing that
+// can run beside the running ones. level 0 jobs go first and one worker
+// is kept for them
+func (db *DB) schedule(jobs map[*running]bool, busy map[string]bool, done chan *running) {
+	for len(jobs) < db.workers {
+		var picked []*running
+		levels := db.describeLevels(busy)
+		// expired files are dropped before the policy merges them
+		pick := append(expiredFiles(levels, time.Now()), db.policy.Pick(levels)...)
+		for _, job := range pick {
+			r, err := db.prepare(job)
 			if err != nil {
-				log.Println("error globbing l0 files in", db.directory, err)
-				break
+				log.Println("invalid merge", db.directory, err)
+			} else if r != nil {
+				picked = append(picked, r)
 			}
-			// continue merging until there is no more new data to push down
-			// the tree
-			if len(files) == 0 {
+		}
+		sort.SliceStable(picked, func(i, j int) bool {
+			return picked[i].level0() && !picked[j].level0()
+		})
+
+		started := false
+		for _, r := range picked {
+			if len(jobs) >= db.workers {
 				break
 			}
-			sort.Slice(files, func(i, j int) bool {
-				return files[i] < files[j]
-			})
-
-			totalSize := fileSize(files...)
-
-			max := db.baseSize
-
-			var dst string
-			i := 1
-			for ; i < maxLevel; i++ {
-				current := max
-				max *= db.multiplier
-				dst = fmt.Sprintf("%v/l%02d.lsm", db.directory, i)
-				_, err = os.Stat(dst)
-				if err == nil {
-					files = append(files, dst)
-					totalSize += fileSize(dst)
+			if !db.runnable(r, jobs, busy) {
+				continue
+			}
+			jobs[r] = true
+			for _, f := range r.files {
+				busy[f.Name] = true
+			}
+			go func(r *running) {
+				r.err = db.run(db.mergeCtx, r)
+				if r.err == nil {
+					r.err = db.reloadReader()
 				}
+				done <- r
+			}(r)
+			started = true
+		}
+		if !started {
+			return
+		}
+	}
+}
 
-				if totalSize < current {
-					break
-				}
-			}
+// true if r can start beside jobs
+func (db *DB) runnable(r *running, jobs map[*running]bool, busy map[string]bool) bool {
+	for _, f := range r.files {
+		if busy[f.Name] {
+			return false
+		}
+	}
+	others := 0
+	for x := range jobs {
+		if r.conflicts(x) {
+			return false
+		}
+		if !x.level0() {
+			others++
+		}
+	}
+	return r.level0() || db.workers == 1 || others < db.workers-1
+}
 
-			delete := !db.hasLowerLevel(i + 1)
+type compactRequest struct {
+	ctx          context.Context
+	lower, upper []byte
+	done         chan error
+}
 
-			// merge level 0 into level i
-			err = db.merge(dst, files, delete)
-			if err != nil {
-				log.Println("error merging into", db.directory, "into l1:", err)
-				break
+// flush and merge every file with a key from lower to upper into the
+// bottom level, dropping deletes and versions older than the retention.
+// nil lower or upper is unbounded. blocks until done or ctx is done.
+// keys outside the range in the same files are merged too
+func (db *DB) CompactRange(ctx context.Context, lower, upper []byte) error {
+	err := db.Flush()
+	if err != nil {
+		return err
+	}
+	req := compactRequest{ctx: ctx, lower: lower, upper: upper, done: make(chan error, 1)}
+	select {
+	case db.compactChan <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-db.mergeCtx.Done():
+		return fmt.Errorf("teepeedb: database closed")
+	}
+	select {
+	case err = <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush and merge the whole tree into the bottom level
+func (db *DB) CompactAll(ctx context.Context) error {
+	return db.CompactRange(ctx, nil, nil)
+}
+
+// merge on the merge goroutine for CompactRange. canceled when ctx is
+// done or the database closes
+func (db *DB) compactRange(ctx context.Context, lower, upper []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	mctx, cancel := context.WithCancel(db.mergeCtx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-mctx.Done():
+		}
+	}()
+	bottom := 1
+	for i := 1; i < db.manifest.Levels(); i++ {
+		if len(db.manifest.Level(i)) > 0 {
+			bottom = i
+		}
+	}
+	// grow the range until it covers every file it overlaps so each
+	// key's versions move together
+	var files []manifest.File
+	smallest, largest := lower, upper
+	for {
+		files = files[:0]
+		for i := 0; i < db.manifest.Levels(); i++ {
+			files = append(files, db.manifest.Overlapping(i, smallest, largest)...)
+		}
+		grown := false
+		for _, f := range files {
+			if smallest != nil && bytes.Compare(f.Smallest, smallest) < 0 {
+				smallest = f.Smallest
+				grown = true
+			}
+			if largest != nil && bytes.Compare(f.Largest, largest) > 0 {
+				largest = f.Largest
+				grown = true
 			}
+		}
+		if !grown {
+			break
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	err := db.merge(mctx, bottom, files, true)
+	if err == nil {
+		err = db.reloadReader()
+	}
+	return err
+}
 
-			err = db.reloadReader()
-			if err != nil {
-				log.Println("error reopening readers", db.directory, err)
-				break
+// check a job from the policy and add the files in its level that it
+// overlaps. nil if it has no inputs
+func (db *DB) prepare(job CompactionJob) (*running, error) {
+	if len(job.Inputs) == 0 {
+		return nil, nil
+	}
+	r := &running{job: job, lo: maxLevel}
+	for _, f := range job.Inputs {
+		if !db.manifest.Has(f.Name) {
+			return nil, fmt.Errorf("%v is not in the tree", f.Name)
+		}
+		r.files = append(r.files, manifest.File{
+			Name:     f.Name,
+			Level:    f.Level,
+			Size:     f.Size,
+			Smallest: f.Smallest,
+			Largest:  f.Largest,
+		})
+		if f.Level < r.lo {
+			r.lo = f.Level
+		}
+		if f.Level > r.hi {
+			r.hi = f.Level
+		}
+	}
+	r.smallest, r.largest = keyRange(job.Inputs)
+	if job.Drop {
+		return r, nil
+	}
+	if job.Level < 1 || job.Level >= maxLevel {
+		return nil, fmt.Errorf("invalid level %v", job.Level)
+	}
+	if job.Level > r.hi {
+		r.hi = job.Level
+	}
+	if r.smallest == nil {
+		return r, nil
+	}
+	// keep the level disjoint
+	inputs := map[string]bool{}
+	for _, f := range r.files {
+		inputs[f.Name] = true
+	}
+	for _, f := range db.manifest.Overlapping(job.Level, r.smallest, r.largest) {
+		if !inputs[f.Name] {
+			r.files = append(r.files, f)
+			if bytes.Compare(f.Smallest, r.smallest) < 0 {
+				r.smallest = f.Smallest
+			}
+			if bytes.Compare(f.Largest, r.largest) > 0 {
+				r.largest = f.Largest
 			}
 		}
 	}
+	return r, nil
+}
+
+// run a prepared job
+func (db *DB) run(ctx context.Context, r *running) error {
+	if r.job.Drop {
+		return db.drop(r.files)
+	}
+	// nothing was added to keep the level disjoint
+	if len(r.files) == len(r.job.Inputs) && db.canMove(r.job.Level, r.files) {
+		return db.move(r.job.Level, r.files)
+	}
+	delete := !db.hasLowerLevel(r.job.Level+1, r.smallest, r.largest)
+	return db.merge(ctx, r.job.Level, r.files, delete)
+}
 
-	files, _ := filepath.Glob(fmt.Sprint(db.directory, "/", "*.tmp"))
+// true if files can go to level without being rewritten. they must be
+// one file or disjoint files from one level and nothing else in level
+// may overlap them
+func (db *DB) canMove(level int, files []manifest.File) bool {
+	if len(files) > 1 {
+		for _, f := range files {
+			if f.Level == 0 || f.Level != files[0].Level {
+				return false
+			}
+		}
+	}
+	inputs := map[string]bool{}
 	for _, f := range files {
-		os.Remove(f)
+		inputs[f.Name] = true
 	}
+	for _, f := range files {
+		if f.Smallest == nil {
+			continue
+		}
+		for _, x := range db.manifest.Overlapping(level, f.Smallest, f.Largest) {
+			if !inputs[x.Name] {
+				return false
+			}
+		}
+	}
+	return true
+}
 
-	db.mergerWaitGroup.Done()
+// move files to level by a manifest edit alone
+func (db *DB) move(level int, files []manifest.File) error {
+	edit := manifest.Edit{}
+	for _, f := range files {
+		edit.Remove = append(edit.Remove, f.Name)
+		f.Level = level
+		edit.Add = append(edit.Add, f)
+	}
+	db.mergeLock.Lock()
+	defer db.mergeLock.Unlock()
+	return db.manifest.Apply(edit)
 }
 
-func (db *DB) merge(dstfile string, files []string, delete bool) error {
-	m, err := merge.NewMerger(dstfile, files, delete, db.blockSize)
+// remove files from the tree and delete them
+func (db *DB) drop(files []manifest.File) error {
+	var names, paths []string
+	for _, f := range files {
+		names = append(names, f.Name)
+		paths = append(paths, filepath.Join(db.directory, f.Name))
+	}
+	db.mergeLock.Lock()
+	defer db.mergeLock.Unlock()
+	err := db.preserve(paths)
+	if err == nil {
+		err = db.manifest.Apply(manifest.Edit{Remove: names})
+	}
 	if err != nil {
 		return err
 	}
-	err = m.Run()
+	for _, f := range paths {
+		os.Remove(f)
+	}
+	return nil
+}
+
+// merge files, newest first, into level. the output is split into
+// files of about fileSize. a merge canceled by ctx changes nothing
+func (db *DB) merge(ctx context.Context, level int, files []manifest.File, delete bool) error {
+	var names, paths []string
+	for _, f := range files {
+		names = append(names, f.Name)
+		paths = append(paths, filepath.Join(db.directory, f.Name))
+	}
+	m, err := merge.NewMerger(db.newFilename(), paths, delete, db.blockSize, db.bitsPerKey)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	// a single file is only merged to drop deletes and old versions
+	err = m.Rewrite()
 	if err != nil {
-		m.Close()
 		return err
 	}
-	func() {
-		db.mergeLock.Lock()
-		defer db.mergeLock.Unlock()
+	m.SetLimiter(db.rate.limiter)
+	if db.mergeOperator != nil {
+		db.readLock.Lock()
+		values := db.values.acquire()
+		db.readLock.Unlock()
+		defer values.release()
+		m.SetMergeOperator(db.mergeOperator, values.resolve)
+	}
+	m.SetHorizon(db.horizon())
+	m.SetSplit(db.fileSize, db.newFilename)
+	err = m.Run(ctx)
+	if err != nil {
+		return err
+	}
+	edit := manifest.Edit{Remove: names}
+	// files with every key merged away are left out of the tree
+	var empty []string
+	for _, dst := range m.Outputs() {
+		f, err := describe(dst+".tmp", level)
+		if err != nil {
+			return err
+		}
+		f.Name = filepath.Base(dst)
+		edit.Add = append(edit.Add, f)
+	}
+	add := edit.Add[:0]
+	for _, f := range edit.Add {
+		if f.Smallest == nil {
+			empty = append(empty, filepath.Join(db.directory, f.Name))
+		} else {
+			add = append(add, f)
+		}
+	}
+	edit.Add = add
 
-		// lock during file renames so reader opening at the same time
-		// isn't trying to open as we are deleting
-		err = m.Commit()
-	}()
-	m.Close()
-	return err
+	// lock during file renames so reader opening at the same time
+	// isn't trying to open as we are deleting
+	db.mergeLock.Lock()
+	defer db.mergeLock.Unlock()
+
+	err = db.preserve(paths)
+	if err == nil {
+		err = m.Rename()
+	}
+	if err == nil {
+		err = db.manifest.Apply(edit)
+	}
+	if err != nil {
+		return err
+	}
+	m.RemoveInputs()
+	for _, f := range empty {
+		os.Remove(f)
+	}
+	return nil
 }
 
 // non-blocking try-wake merger
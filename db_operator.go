@@ -0,0 +1,23 @@
+package teepeedb
+
+import (
+	"github.com/stangelandcl/teepeedb/internal/merge"
+)
+
+// combines the operands written by Writer.Merge with the value under
+// them so updates like counters and appends don't read first. operands
+// are folded when read and by merges that reach the value under them.
+// see WithMergeOperator
+type MergeOperator interface {
+	// value of key after applying operands oldest first to existing.
+	// existing is nil if key has no value or was deleted. an error
+	// fails the read or merge
+	Merge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// fold merge operands read by c with the database's operator
+func (db *DB) setMergeOperator(c *merge.Cursor, values *valueLogs) {
+	if db.mergeOperator != nil {
+		c.SetMergeOperator(db.mergeOperator, values.resolve)
+	}
+}
@@ -48,6 +48,18 @@ func WithBaseSize(sz int) Opt {
 	}
 }
 
+// size in bytes merges split their output at so each level is many
+// files with disjoint key ranges and a merge only rewrites the files
+// that overlap its input. default is 4 MB
+func WithFileSize(sz int) Opt {
+	return func(db *DB) {
+		if sz < 1024 {
+			sz = 1024
+		}
+		db.fileSize = sz
+	}
+}
+
 // set multiplier to increase baseSize by when moving to higher levels
 // for example baseSize = 16MB and multiplier = 10
 // L1 = 16 MB, L2 = 160MB, L3 = 1600MB, L4 = 16000 MB, L5 = 160 GB, L6 = 1600 GB, L7 = 16 TB, L8 = 160 TB L9 = 1600 TB
@@ -61,3 +73,141 @@ func WithMultiplier(mult int) Opt {
 		db.multiplier = mult
 	}
 }
+
+// select how files are merged. default is LeveledPolicy with the
+// WithBaseSize and WithMultiplier sizes which are ignored otherwise
+func WithCompactionPolicy(p CompactionPolicy) Opt {
+	return func(db *DB) {
+		db.policy = p
+	}
+}
+
+// merges run at once on non-overlapping files. one is kept free for
+// level 0 so flushed files keep draining during long merges lower in
+// the tree. default is 2
+func WithCompactionWorkers(n int) Opt {
+	return func(db *DB) {
+		if n < 1 {
+			n = 1
+		}
+		db.workers = n
+	}
+}
+
+// level 0 file counts where writes slow down and where they wait for
+// merges to catch up. Write and the Put that fills the memtable sleep
+// about a millisecond per file past soft. Write and Put wait while level
+// 0 has hard files. writes are never held up while the merger has
+// nothing to do. 0 is no limit. default is 20 and 36
+func WithLevel0Limits(soft, hard int) Opt {
+	return func(db *DB) {
+		db.stall.softFiles = int64(soft)
+		db.stall.hardFiles = int64(hard)
+	}
+}
+
+// level 0 sizes in bytes where writes slow down and wait as for
+// WithLevel0Limits. default is no limit
+func WithLevel0ByteLimits(soft, hard int64) Opt {
+	return func(db *DB) {
+		db.stall.softBytes = soft
+		db.stall.hardBytes = hard
+	}
+}
+
+// bytes per second merges read and write together so they leave disk
+// bandwidth for reads. Writer commits and memtable flushes aren't
+// limited. can be changed with SetCompactionRate. default is unlimited
+func WithCompactionRate(bytesPerSec int64) Opt {
+	return func(db *DB) {
+		db.rate.base = bytesPerSec
+	}
+}
+
+// let the compaction rate rise as level 0 grows, from the
+// WithCompactionRate rate when it is empty to max at the level 0 soft
+// limits. default is a fixed rate
+func WithAdaptiveCompactionRate(max int64) Opt {
+	return func(db *DB) {
+		db.rate.max = max
+	}
+}
+
+// size in bytes of the in-memory buffer for Put and Delete.
+// once full it is written to a level 0 file in the background.
+// default is 4 MB
+func WithMemtableSize(sz int) Opt {
+	return func(db *DB) {
+		if sz < 1024 {
+			sz = 1024
+		}
+		db.memtableSize = sz
+	}
+}
+
+// how Put and Delete wait for the write-ahead log. can be overridden
+// per write with WriteSync.
+// default is SyncNone
+func WithSyncMode(mode SyncMode) Opt {
+	return func(db *DB) {
+		db.syncMode = mode
+	}
+}
+
+// bits per key of the bloom filter written to each file. lets Find skip
+// files that can't contain the key. 10 bits is about 1% false positives.
+// 0 disables filters.
+// default is 10
+func WithBloomBitsPerKey(bits int) Opt {
+	return func(db *DB) {
+		if bits < 0 {
+			bits = 0
+		}
+		db.bitsPerKey = bits
+	}
+}
+
+// values at least threshold bytes long are written once to an append-only
+// value log and data blocks hold a pointer so merges don't rewrite them.
+// reclaim space from overwritten values with GCValueLog.
+// 0 disables the value log.
+// default is 0
+func WithValueLog(threshold int) Opt {
+	return func(db *DB) {
+		if threshold < 0 {
+			threshold = 0
+		}
+		db.vlogThreshold = threshold
+	}
+}
+
+// combine Writer.Merge operands with op. needed to read or merge a
+// database with operands in it
+func WithMergeOperator(op MergeOperator) Opt {
+	return func(db *DB) {
+		db.mergeOperator = op
+	}
+}
+
+// size in bytes of the cache of decompressed blocks shared by every
+// cursor. saves decompressing hot index and data blocks on each visit.
+// 0 disables the cache.
+// default is 0
+func WithBlockCache(size int) Opt {
+	return func(db *DB) {
+		if size < 0 {
+			size = 0
+		}
+		db.cacheSize = size
+	}
+}
+
+// number of sequences overwritten versions are kept for after a newer
+// write so CursorAt can read them. every Put, Delete and Writer batch
+// takes one sequence.
+// default is 0, only snapshots keep older versions
+func WithRetention(seqs uint64) Opt {
+	return func(db *DB) {
+		db.retention = seqs
+	}
+}
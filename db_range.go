@@ -0,0 +1,49 @@
+package teepeedb
+
+type RangeOpt func(o *rangeOpts)
+
+type rangeOpts struct {
+	inclusive bool
+}
+
+// include upper itself in Range
+func UpperInclusive() RangeOpt {
+	return func(o *rangeOpts) {
+		o.inclusive = true
+	}
+}
+
+// cursor over keys >= lower and < upper. nil lower or upper is unbounded.
+// First and Last go to the first and last key inside the range, Next and
+// Previous return false at a bound and Find never returns a key outside.
+// files and blocks outside the range are skipped without being read
+func (db *DB) Range(lower, upper []byte, opts ...RangeOpt) Cursor {
+	return bounded(db.Cursor(), lower, upper, opts)
+}
+
+func bounded(c Cursor, lower, upper []byte, opts []RangeOpt) Cursor {
+	o := rangeOpts{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	c.m.SetBounds(lower, upper, o.inclusive)
+	return c
+}
+
+// cursor over keys starting with prefix
+func (db *DB) Prefix(prefix []byte) Cursor {
+	return db.Range(prefix, prefixEnd(prefix))
+}
+
+// first key after every key starting with prefix.
+// nil if there is none such as for 0xff 0xff
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := append([]byte{}, prefix[:i+1]...)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
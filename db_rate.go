@@ -0,0 +1,58 @@
+package teepeedb
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/stangelandcl/teepeedb/internal/ratelimit"
+)
+
+// merge I/O rate
+type rate struct {
+	// shared by every merge. Writer commits and flushes aren't limited
+	limiter *ratelimit.Limiter
+	lock    sync.Mutex
+	// bytes per second. 0 is unlimited. max above base rises with
+	// level 0 toward its soft limit
+	base, max int64
+}
+
+// bytes per second merges read and write. 0 is unlimited. see
+// WithCompactionRate
+func (db *DB) SetCompactionRate(bytesPerSec int64) {
+	db.rate.lock.Lock()
+	db.rate.base = bytesPerSec
+	db.rate.lock.Unlock()
+	db.adaptRate()
+}
+
+// bytes per second merges read and write right now
+func (db *DB) CompactionRate() int64 {
+	return db.rate.limiter.Rate()
+}
+
+// set the limiter from the rates and level 0 size
+func (db *DB) adaptRate() {
+	r := &db.rate
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rate := r.base
+	if rate > 0 && r.max > rate {
+		// linear from base with level 0 empty to max at the soft
+		// limit so merges catch up before writes slow down
+		s := &db.stall
+		files, bytes := atomic.LoadInt64(&s.files), atomic.LoadInt64(&s.bytes)
+		var f float64
+		if s.softFiles > 0 {
+			f = float64(files) / float64(s.softFiles)
+		}
+		if s.softBytes > 0 && float64(bytes)/float64(s.softBytes) > f {
+			f = float64(bytes) / float64(s.softBytes)
+		}
+		if f > 1 {
+			f = 1
+		}
+		rate += int64(f * float64(r.max-rate))
+	}
+	r.limiter.SetRate(rate)
+}
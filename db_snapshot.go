@@ -0,0 +1,162 @@
+package teepeedb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/stangelandcl/teepeedb/internal/memtable"
+	"github.com/stangelandcl/teepeedb/internal/merge"
+)
+
+// frozen view of the database. any number of cursors can be opened
+// on it from any goroutine and all see the data as of db.Snapshot()
+// until Release. files it reads stay on disk while it is live even
+// if a merge replaces them
+type Snapshot struct {
+	db     *DB
+	reader *merge.Reader
+	mem    []memSnapshot
+	values *valueLogs
+	// names keeping files merged away since the snapshot was
+	// taken. guarded by db.mergeLock
+	links    []*snapshotLink
+	released bool
+	// merges keep versions CursorAt(seq) needs while the snapshot is live
+	seq uint64
+}
+
+type memSnapshot struct {
+	t   *memtable.Table
+	seq uint64
+}
+
+// hard link to a file a merge removed or renamed over.
+// removed once no snapshot reads the file
+type snapshotLink struct {
+	filename string
+	refs     int
+}
+
+// pin the current files and memtables until Release
+func (db *DB) Snapshot() *Snapshot {
+	// mergeLock so a merge can't remove files between reading
+	// db.reader and registering the snapshot
+	db.mergeLock.Lock()
+	defer db.mergeLock.Unlock()
+	db.readLock.Lock()
+	defer db.readLock.Unlock()
+
+	s := &Snapshot{
+		db:     db,
+		reader: db.reader,
+		values: db.values.acquire(),
+		seq:    db.Sequence(),
+	}
+	db.reader.Retain()
+	s.mem = append(s.mem, memSnapshot{t: db.mem, seq: db.mem.Sequence()})
+	for _, f := range db.imm {
+		s.mem = append(s.mem, memSnapshot{t: f.t, seq: f.t.Sequence()})
+	}
+	db.snapshots[s] = true
+	return s
+}
+
+// sequence of the last write the snapshot sees
+func (s *Snapshot) Sequence() uint64 {
+	return s.seq
+}
+
+// cursor over the snapshot. it stays valid until closed even after
+// Release but must be opened before Release. one opened after has
+// no keys and Err set
+func (s *Snapshot) Cursor() Cursor {
+	c := Cursor{}
+	// mergeLock so Release can't drop the files while they are retained
+	s.db.mergeLock.Lock()
+	if s.released {
+		s.db.mergeLock.Unlock()
+		c.m = s.reader.Cursor()
+		c.err = fmt.Errorf("teepeedb: snapshot released")
+		return c
+	}
+	sources := make([]merge.Source, 0, len(s.mem))
+	for _, m := range s.mem {
+		sources = append(sources, m.t.CursorAt(m.seq))
+	}
+	c.m = s.reader.Cursor(sources...)
+	c.values = s.values.acquire()
+	s.db.mergeLock.Unlock()
+	s.db.setMergeOperator(c.m, c.values)
+	return c
+}
+
+// see DB.Range
+func (s *Snapshot) Range(lower, upper []byte, opts ...RangeOpt) Cursor {
+	return bounded(s.Cursor(), lower, upper, opts)
+}
+
+// see DB.Prefix
+func (s *Snapshot) Prefix(prefix []byte) Cursor {
+	return s.Range(prefix, prefixEnd(prefix))
+}
+
+// unpin the snapshot's files. safe to call more than once
+func (s *Snapshot) Release() {
+	db := s.db
+	db.mergeLock.Lock()
+	if s.released {
+		db.mergeLock.Unlock()
+		return
+	}
+	s.released = true
+	delete(db.snapshots, s)
+	for _, l := range s.links {
+		l.refs--
+		if l.refs == 0 {
+			os.Remove(l.filename)
+		}
+	}
+	s.links = nil
+	db.mergeLock.Unlock()
+
+	s.reader.Close()
+	s.values.release()
+}
+
+// hard link each of files still read by a snapshot so a merge can
+// remove it. caller must hold mergeLock
+func (db *DB) preserve(files []string) error {
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			// merge destination that doesn't exist yet
+			continue
+		}
+		var link *snapshotLink
+		for s := range db.snapshots {
+			if !s.reader.Has(fi) {
+				continue
+			}
+			if link == nil {
+				db.linkCounter++
+				link = &snapshotLink{filename: fmt.Sprintf("%v.%d.snap", f, db.linkCounter)}
+				err = os.Link(f, link.filename)
+				if err != nil {
+					return err
+				}
+			}
+			link.refs++
+			s.links = append(s.links, link)
+		}
+	}
+	return nil
+}
+
+// snapshots don't outlive the process
+func (db *DB) removeSnapshotLinks() {
+	files, _ := filepath.Glob(fmt.Sprintf("%v/*.snap", db.directory))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
@@ -0,0 +1,139 @@
+package teepeedb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// level 0 size and limits for write stalls
+type stall struct {
+	// set by reloadReader
+	files, bytes int64
+	// 0 is no limit
+	softFiles, hardFiles int64
+	softBytes, hardBytes int64
+	// closed and replaced when level 0 shrinks or merging stops.
+	// guarded by lock
+	lock sync.Mutex
+	wake chan struct{}
+	// the merge goroutine has work. writers only wait while it does
+	merging bool
+	// for Stats
+	slowdowns, stops, nanos int64
+}
+
+// set level 0 size after a reader reload
+func (db *DB) setLevel0(files int, bytes int64) {
+	atomic.StoreInt64(&db.stall.files, int64(files))
+	atomic.StoreInt64(&db.stall.bytes, bytes)
+	db.wakeWriters()
+	db.adaptRate()
+}
+
+// called by the merge goroutine whenever its work changes
+func (db *DB) setMerging(merging bool) {
+	s := &db.stall
+	s.lock.Lock()
+	changed := s.merging != merging
+	s.merging = merging
+	s.lock.Unlock()
+	if changed && !merging {
+		db.wakeWriters()
+	}
+}
+
+func (db *DB) wakeWriters() {
+	s := &db.stall
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.wake != nil {
+		close(s.wake)
+		s.wake = nil
+	}
+}
+
+// files past the soft limit, at least 1 if only bytes are past it, and
+// true if at the hard limit
+func (db *DB) level0Over() (soft int64, hard bool) {
+	s := &db.stall
+	files := atomic.LoadInt64(&s.files)
+	bytes := atomic.LoadInt64(&s.bytes)
+	if s.softFiles > 0 && files >= s.softFiles {
+		soft = files - s.softFiles + 1
+	} else if s.softBytes > 0 && bytes >= s.softBytes {
+		soft = 1
+	}
+	if s.hardFiles > 0 && files >= s.hardFiles || s.hardBytes > 0 && bytes >= s.hardBytes {
+		hard = true
+	}
+	return
+}
+
+// channel closed once level 0 or merging changes. nil if the merge
+// goroutine is idle so waiting would never end
+func (db *DB) stallWait() chan struct{} {
+	s := &db.stall
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.merging {
+		return nil
+	}
+	if s.wake == nil {
+		s.wake = make(chan struct{})
+	}
+	return s.wake
+}
+
+// block while level 0 is at the hard limit and, if slow, sleep about
+// a millisecond per file past the soft limit. writes aren't held up by
+// a policy that leaves level 0 alone or a merger that failed
+func (db *DB) stallWrite(ctx context.Context, slow bool) error {
+	s := &db.stall
+	if _, hard := db.level0Over(); hard {
+		start := time.Now()
+		waited, err := db.stop(ctx)
+		if waited {
+			atomic.AddInt64(&s.stops, 1)
+			atomic.AddInt64(&s.nanos, int64(time.Since(start)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	soft, _ := db.level0Over()
+	if !slow || soft == 0 || db.stallWait() == nil {
+		return nil
+	}
+	atomic.AddInt64(&s.slowdowns, 1)
+	delay := time.Duration(soft) * time.Millisecond
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	atomic.AddInt64(&s.nanos, int64(delay))
+	return nil
+}
+
+// wait until level 0 is under the hard limit or the merger is idle.
+// true if it waited
+func (db *DB) stop(ctx context.Context) (bool, error) {
+	for waited := false; ; waited = true {
+		// taken before checking so a change in between isn't missed
+		wait := db.stallWait()
+		_, hard := db.level0Over()
+		if !hard || wait == nil {
+			return waited, nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+	}
+}
@@ -1,13 +1,22 @@
 package teepeedb
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/stangelandcl/teepeedb/internal/ratelimit"
+	"github.com/stangelandcl/teepeedb/internal/shared"
+	"github.com/stangelandcl/teepeedb/internal/writer"
 )
 
 func TestExample(t *testing.T) {
@@ -217,3 +226,1666 @@ func TestDB(t *testing.T) {
 		}
 	}
 }
+
+func TestPut(t *testing.T) {
+	os.RemoveAll("test.db")
+	db := E(Open("test.db", WithMemtableSize(64*1024)))
+
+	count := 100_000
+	ids := rand.Perm(count)
+	for _, id := range ids {
+		k := binary.BigEndian.AppendUint32(nil, uint32(id))
+		err := db.Put(k, k)
+		if err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < count; i += 10 {
+		k := binary.BigEndian.AppendUint32(nil, uint32(i))
+		err := db.Delete(k)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	check := func(db *DB) {
+		c := db.Cursor()
+		defer c.Close()
+		i := 0
+		more := c.First()
+		for more {
+			if i%10 == 0 {
+				i++
+			}
+			k := binary.BigEndian.Uint32(c.Key())
+			v := binary.BigEndian.Uint32(c.Value())
+			if int(k) != i || int(v) != i {
+				log.Panicln("i", i, "k", k, "v", v)
+			}
+			more = c.Next()
+			i++
+		}
+		if i != count {
+			log.Panicln("count", i)
+		}
+	}
+	check(db)
+	db.Close()
+
+	// memtable is flushed on close
+	db = E(Open("test.db"))
+	defer db.Close()
+	check(db)
+}
+
+func TestLogReplay(t *testing.T) {
+	os.RemoveAll("test.db")
+	os.RemoveAll("test2.db")
+	defer os.RemoveAll("test2.db")
+	db := E(Open("test.db", WithSyncMode(SyncGroup)))
+	defer db.Close()
+
+	count := 10_000
+	for _, id := range rand.Perm(count) {
+		k := binary.BigEndian.AppendUint32(nil, uint32(id))
+		err := db.Put(k, k)
+		if err != nil {
+			panic(err)
+		}
+	}
+	k := binary.BigEndian.AppendUint32(nil, 0)
+	err := db.Delete(k, WriteSync(SyncAlways))
+	if err != nil {
+		panic(err)
+	}
+
+	// copy log as if the process crashed before the memtable was flushed
+	os.MkdirAll("test2.db", 0755)
+	files := E(filepath.Glob("test.db/wal.*.log"))
+	for _, f := range files {
+		os.WriteFile("test2.db/"+filepath.Base(f), E(os.ReadFile(f)), 0644)
+	}
+
+	db2 := E(Open("test2.db"))
+	defer db2.Close()
+	c := db2.Cursor()
+	defer c.Close()
+	i := 1
+	for more := c.First(); more; more = c.Next() {
+		k := binary.BigEndian.Uint32(c.Key())
+		if int(k) != i {
+			log.Panicln("i", i, "k", k)
+		}
+		i++
+	}
+	if i != count {
+		log.Panicln("count", i)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	os.RemoveAll("test3.db")
+	defer os.RemoveAll("test3.db")
+	db := E(Open("test3.db"))
+	w := E(db.Write())
+	count := 100_000
+	for i := 0; i < count; i++ {
+		k := binary.BigEndian.AppendUint32(nil, uint32(i))
+		err := w.Add(k, k)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := w.Commit()
+	if err != nil {
+		panic(err)
+	}
+	w.Close()
+	db.Close()
+
+	// flip a bit in a data block
+	files := E(filepath.Glob("test3.db/*.lsm"))
+	if len(files) != 1 {
+		log.Panicln("files", files)
+	}
+	buf := E(os.ReadFile(files[0]))
+	buf[len(buf)/4] ^= 0x04
+	os.WriteFile(files[0], buf, 0644)
+
+	db = E(Open("test3.db"))
+	defer db.Close()
+	c := db.Cursor()
+	defer c.Close()
+	i := 0
+	for more := c.First(); more; more = c.Next() {
+		i++
+	}
+	var corrupt *ErrCorrupt
+	if i >= count || !errors.As(c.Err(), &corrupt) || corrupt.File != files[0] {
+		log.Panicln("read", i, "err", c.Err())
+	}
+	fmt.Println(c.Err())
+}
+
+func TestLargeValue(t *testing.T) {
+	os.RemoveAll("test4.db")
+	defer os.RemoveAll("test4.db")
+	db := E(Open("test4.db"))
+
+	// every 10th value is larger than 16 bit offsets can address
+	value := func(i int) []byte {
+		n := 100
+		if i%10 == 0 {
+			n = 100_000 + i
+		}
+		v := make([]byte, n)
+		binary.BigEndian.PutUint32(v, uint32(i))
+		return v
+	}
+	count := 1000
+	w := E(db.Write())
+	for i := 0; i < count; i += 2 {
+		err := w.Add(binary.BigEndian.AppendUint32(nil, uint32(i)), value(i))
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := w.Commit()
+	if err != nil {
+		panic(err)
+	}
+	w.Close()
+	for i := 1; i < count; i += 2 {
+		err = db.Put(binary.BigEndian.AppendUint32(nil, uint32(i)), value(i))
+		if err != nil {
+			panic(err)
+		}
+	}
+	db.Close()
+
+	db = E(Open("test4.db"))
+	defer db.Close()
+	c := db.Cursor()
+	defer c.Close()
+	i := 0
+	for more := c.First(); more; more = c.Next() {
+		k := binary.BigEndian.Uint32(c.Key())
+		if int(k) != i || !bytes.Equal(c.Value(), value(i)) {
+			log.Panicln("i", i, "k", k, "len", len(c.Value()))
+		}
+		i++
+	}
+	if i != count || c.Err() != nil {
+		log.Panicln("count", i, c.Err())
+	}
+}
+
+func TestValueLog(t *testing.T) {
+	os.RemoveAll("test5.db")
+	defer os.RemoveAll("test5.db")
+	// no merges so overwritten versions stay in level 0
+	db := E(Open("test5.db", WithValueLog(1024), WithMemtableSize(64*1024), WithCompactionPolicy(FIFOPolicy(0, 0))))
+
+	value := func(i, version int) []byte {
+		v := make([]byte, 100+i%3*1000)
+		binary.BigEndian.PutUint32(v, uint32(i))
+		binary.BigEndian.PutUint32(v[4:], uint32(version))
+		return v
+	}
+	count := 2000
+	for _, i := range rand.Perm(count) {
+		err := db.Put(binary.BigEndian.AppendUint32(nil, uint32(i)), value(i, 0))
+		if err != nil {
+			panic(err)
+		}
+	}
+	// overwrite most values so the first value log is mostly garbage
+	w := E(db.Write())
+	for i := 0; i < count; i++ {
+		if i%4 == 0 {
+			continue
+		}
+		err := w.Add(binary.BigEndian.AppendUint32(nil, uint32(i)), value(i, 1))
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := w.Commit()
+	if err != nil {
+		panic(err)
+	}
+	w.Close()
+
+	check := func(c *Cursor) {
+		defer c.Close()
+		i := 0
+		for more := c.First(); more; more = c.Next() {
+			version := 1
+			if i%4 == 0 {
+				version = 0
+			}
+			if !bytes.Equal(c.Value(), value(i, version)) {
+				log.Panicln("i", i, "len", len(c.Value()))
+			}
+			i++
+		}
+		if i != count || c.Err() != nil {
+			log.Panicln("count", i, c.Err())
+		}
+	}
+	c := db.Cursor()
+	check(&c)
+	db.Close()
+
+	// reopen so the value log is no longer the active one. versions
+	// overwritten since the last merge don't keep it from being collected
+	db = E(Open("test5.db", WithValueLog(1024), WithCompactionPolicy(FIFOPolicy(0, 0))))
+	defer db.Close()
+	// open cursor keeps the collected file readable
+	old := db.Cursor()
+	before := E(filepath.Glob("test5.db/vlog.*.vlog"))
+	n, err := db.GCValueLog(0.25)
+	if err != nil || n != len(before) {
+		log.Panicln("collected", n, "of", before, err)
+	}
+	check(&old)
+	c = db.Cursor()
+	check(&c)
+	after := E(filepath.Glob("test5.db/vlog.*.vlog"))
+	for _, f := range after {
+		for _, g := range before {
+			if f == g {
+				log.Panicln("not removed", f)
+			}
+		}
+	}
+	db.Close()
+
+	// a value that can't be read stops the cursor
+	for _, f := range after {
+		os.Remove(f)
+	}
+	db = E(Open("test5.db", WithValueLog(1024), WithCompactionPolicy(FIFOPolicy(0, 0))))
+	defer db.Close()
+	c = db.Cursor()
+	defer c.Close()
+	if c.Find(binary.BigEndian.AppendUint32(nil, 1)) != Found || c.Value() != nil || c.Err() == nil {
+		log.Panicln("missing value log", c.Err())
+	}
+	if c.Next() || c.Previous() || c.First() || c.Last() || c.Find(nil) != NotFound || c.Err() == nil {
+		log.Panicln("moved after error")
+	}
+}
+
+func TestRange(t *testing.T) {
+	os.RemoveAll("test6.db")
+	defer os.RemoveAll("test6.db")
+	db := E(Open("test6.db"))
+	defer db.Close()
+
+	// keys are a one byte prefix followed by a big-endian number
+	key := func(p byte, i int) []byte {
+		return binary.BigEndian.AppendUint32([]byte{p}, uint32(i))
+	}
+	count := 1000
+	w := E(db.Write())
+	for p := byte(0); p < 4; p++ {
+		for i := 0; i < count; i++ {
+			err := w.Add(key(p, i), nil)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+	err := w.Commit()
+	if err != nil {
+		panic(err)
+	}
+	w.Close()
+	// deletes at the edges of prefix 2 are in the memtable
+	for i := 0; i < 10; i++ {
+		db.Delete(key(2, i))
+		db.Delete(key(2, count-1-i))
+	}
+
+	c := db.Prefix([]byte{2})
+	defer c.Close()
+	i := 10
+	for more := c.First(); more; more = c.Next() {
+		if !bytes.Equal(c.Key(), key(2, i)) {
+			log.Panicln("prefix", i, c.Key())
+		}
+		i++
+	}
+	if i != count-10 {
+		log.Panicln("prefix end", i)
+	}
+	i = count - 11
+	for more := c.Last(); more; more = c.Previous() {
+		if !bytes.Equal(c.Key(), key(2, i)) {
+			log.Panicln("prefix reverse", i, c.Key())
+		}
+		i--
+	}
+	if i != 9 {
+		log.Panicln("prefix reverse end", i)
+	}
+
+	r := db.Range(key(1, 500), key(3, 0), UpperInclusive())
+	defer r.Close()
+	n := 0
+	for more := r.First(); more; more = r.Next() {
+		n++
+	}
+	if n != 500+count-20+1 {
+		log.Panicln("range", n)
+	}
+	if r.Find(key(0, 7)).Empty() || !bytes.Equal(r.Key(), key(1, 500)) {
+		log.Panicln("find below range", r.Key())
+	}
+	if !r.Find(key(3, 1)).Empty() {
+		log.Panicln("find above range", r.Key())
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	os.RemoveAll("test8.db")
+	defer os.RemoveAll("test8.db")
+	db := E(Open("test8.db", WithBlockCache(1024*1024)))
+	defer db.Close()
+
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	write := func(start, count int) {
+		w := E(db.Write())
+		defer w.Close()
+		for i := start; i < start+count; i++ {
+			err := w.Add(key(i), key(i))
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}
+	find := func(count int) {
+		c := db.Cursor()
+		defer c.Close()
+		for _, i := range rand.Perm(count) {
+			if c.Find(key(i)) != Found || !bytes.Equal(c.Value(), key(i)) {
+				log.Panicln("find", i)
+			}
+		}
+	}
+	write(0, 10000)
+	// repeated passes decompress each block once
+	for j := 0; j < 3; j++ {
+		find(10000)
+	}
+	st := db.Stats()
+	if st.CacheMisses == 0 || st.CacheHits < 2*st.CacheMisses {
+		log.Panicln("cache", st.CacheHits, st.CacheMisses)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	os.RemoveAll("test9.db")
+	defer os.RemoveAll("test9.db")
+	db := E(Open("test9.db"))
+	defer db.Close()
+
+	count := 1000
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	write := func(version int) {
+		w := E(db.Write())
+		defer w.Close()
+		for i := 0; i < count; i++ {
+			err := w.Add(key(i), key(version))
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}
+	write(0)
+	db.Put(key(count), key(0))
+
+	s := db.Snapshot()
+	defer s.Release()
+
+	// changes after the snapshot including merges of its files
+	write(1)
+	db.Put(key(count), key(1))
+	db.Delete(key(0))
+	snaps := func() []string {
+		return E(filepath.Glob("test9.db/*.snap"))
+	}
+	for start := time.Now(); len(snaps()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			log.Panicln("merge didn't keep snapshot files")
+		}
+	}
+
+	// parallel scans of the same snapshot
+	done := make(chan int)
+	for g := 0; g < 4; g++ {
+		go func() {
+			c := s.Cursor()
+			defer c.Close()
+			i := 0
+			for more := c.First(); more; more = c.Next() {
+				if !bytes.Equal(c.Key(), key(i)) || !bytes.Equal(c.Value(), key(0)) {
+					log.Panicln("snapshot", i, c.Key(), c.Value())
+				}
+				i++
+			}
+			done <- i
+		}()
+	}
+	for g := 0; g < 4; g++ {
+		if n := <-done; n != count+1 {
+			log.Panicln("snapshot count", n)
+		}
+	}
+
+	c := db.Cursor()
+	if c.Find(key(0)) != FoundGreater || !bytes.Equal(c.Value(), key(1)) {
+		log.Panicln("db sees snapshot")
+	}
+	c.Close()
+
+	s.Release()
+	if len(snaps()) != 0 {
+		log.Panicln("release kept files", snaps())
+	}
+	c = s.Cursor()
+	if c.First() || c.Err() == nil {
+		log.Panicln("cursor after release")
+	}
+	c.Close()
+}
+
+func TestCursorAt(t *testing.T) {
+	os.RemoveAll("test10.db")
+	defer os.RemoveAll("test10.db")
+	db := E(Open("test10.db", WithRetention(1000)))
+
+	count := 1000
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	// version v sets every key to v and deletes key v
+	seqs := []uint64{}
+	for v := 0; v < 3; v++ {
+		w := E(db.Write())
+		for i := 0; i < count; i++ {
+			var err error
+			if i == v {
+				err = w.Delete(key(i))
+			} else {
+				err = w.Add(key(i), key(v))
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+		seqs = append(seqs, w.Sequence())
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+	db.Put(key(count), key(3))
+	seqs = append(seqs, db.Sequence())
+
+	check := func() {
+		for v, seq := range seqs {
+			// version 3 is the Put on top of version 2
+			batch := v
+			if v == 3 {
+				batch = 2
+			}
+			c := db.CursorAt(seq)
+			n := 0
+			for more := c.First(); more; more = c.Next() {
+				k := int(binary.BigEndian.Uint32(c.Key()))
+				want := key(batch)
+				if k == count {
+					want = key(3)
+				}
+				if k == batch || k == count && v < 3 || !bytes.Equal(c.Value(), want) {
+					log.Panicln("version", v, "key", k, c.Value())
+				}
+				n++
+			}
+			want := count - 1
+			if v == 3 {
+				want++
+			}
+			if c.Err() != nil || n != want {
+				log.Panicln("version", v, "count", n, c.Err())
+			}
+			c.Close()
+		}
+	}
+	check()
+	seq := db.Sequence()
+	db.Close()
+
+	// reopened and merged files keep their versions
+	db = E(Open("test10.db", WithRetention(1000)))
+	defer db.Close()
+	if db.Sequence() != seq {
+		log.Panicln("sequence", db.Sequence(), "want", seq)
+	}
+	check()
+}
+
+func TestCommitAll(t *testing.T) {
+	dirs := []string{"test11a.db", "test11b.db"}
+	for _, d := range dirs {
+		os.RemoveAll(d)
+		defer os.RemoveAll(d)
+	}
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	open := func() []*DB {
+		return []*DB{E(Open(dirs[0])), E(Open(dirs[1]))}
+	}
+	// batch v writes key v to every database
+	write := func(dbs []*DB, v int) []*Writer {
+		writers := []*Writer{}
+		for _, db := range dbs {
+			w := E(db.Write())
+			err := w.Add(key(v), key(v))
+			if err != nil {
+				panic(err)
+			}
+			writers = append(writers, &w)
+		}
+		return writers
+	}
+	check := func(dbs []*DB, want ...int) {
+		for _, db := range dbs {
+			c := db.Cursor()
+			i := 0
+			for more := c.First(); more; more = c.Next() {
+				if i >= len(want) || !bytes.Equal(c.Key(), key(want[i])) {
+					log.Panicln(db.directory, "key", c.Key(), "want", want)
+				}
+				i++
+			}
+			c.Close()
+			if i != len(want) {
+				log.Panicln(db.directory, "count", i, "want", want)
+			}
+		}
+	}
+	// leave staged files as a crash would. Close removes temp files
+	crash := func(dbs []*DB, writers []*Writer) {
+		for _, w := range writers {
+			os.Rename(w.filename+".tmp", w.filename+".saved")
+			w.Close()
+		}
+		for _, db := range dbs {
+			db.Close()
+		}
+		for _, w := range writers {
+			os.Rename(w.filename+".saved", w.filename+".tmp")
+		}
+	}
+
+	dbs := open()
+	writers := write(dbs, 0)
+	err := CommitAll(writers...)
+	if err != nil {
+		panic(err)
+	}
+	for _, w := range writers {
+		w.Close()
+	}
+	check(dbs, 0)
+
+	// crash after every database prepared but before the decision
+	writers = write(dbs, 1)
+	tx := E(stageAll(writers))
+	crash(dbs, writers)
+	dbs = open()
+	check(dbs, 0)
+
+	// crash after the decision but before the renames
+	writers = write(dbs, 2)
+	tx = E(stageAll(writers))
+	err = tx.decide()
+	if err != nil {
+		panic(err)
+	}
+	crash(dbs, writers)
+	dbs = open()
+	check(dbs, 0, 2)
+	for _, d := range dirs {
+		if files := E(filepath.Glob(d + "/txn.*")); len(files) != 0 {
+			log.Panicln("commit files left", files)
+		}
+	}
+	for _, db := range dbs {
+		db.Close()
+	}
+}
+
+func TestManifest(t *testing.T) {
+	os.RemoveAll("test12.db")
+	defer os.RemoveAll("test12.db")
+	os.MkdirAll("test12.db", 0755)
+
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	// files named the way they were before manifests. l00 files with
+	// lower counters are newer
+	legacy := map[string]int{
+		"test12.db/l00.000000000000005.lsm": 2,
+		"test12.db/l00.000000000000006.lsm": 1,
+		"test12.db/l01.lsm":                 0,
+	}
+	for name, version := range legacy {
+		w := E(writer.NewFile(name, 4096, 10))
+		for i := 0; i < 100; i++ {
+			err := w.Add(&shared.KV{Key: key(i), Value: key(version)})
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+	// not part of the tree. only names the database writes are removed
+	os.WriteFile("test12.db/notes.lsm", nil, 0644)
+	os.WriteFile("test12.db/000099.lsm", nil, 0644)
+
+	db := E(Open("test12.db"))
+	c := db.Cursor()
+	for i := 0; i < 100; i++ {
+		if c.Find(key(i)) != Found || !bytes.Equal(c.Value(), key(2)) {
+			log.Panicln("legacy", i, c.Value())
+		}
+	}
+	c.Close()
+	if _, err := os.Stat("test12.db/CURRENT"); err != nil {
+		panic(err)
+	}
+	if _, err := os.Stat("test12.db/notes.lsm"); err != nil {
+		panic(err)
+	}
+	if _, err := os.Stat("test12.db/000099.lsm"); err == nil {
+		log.Panicln("orphan kept")
+	}
+
+	// merges empty level 0 but new names keep counting up
+	last := ""
+	for v := 3; v < 6; v++ {
+		w := E(db.Write())
+		if w.filename <= last {
+			log.Panicln("name", w.filename, "after", last)
+		}
+		last = w.filename
+		for i := 0; i < 100; i++ {
+			err := w.Add(key(i), key(v))
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+		for len(db.manifest.Level(0)) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	db.Close()
+
+	db = E(Open("test12.db"))
+	c = db.Cursor()
+	n := 0
+	for more := c.First(); more; more = c.Next() {
+		if !bytes.Equal(c.Value(), key(5)) {
+			log.Panicln("reopen", c.Key(), c.Value())
+		}
+		n++
+	}
+	if n != 100 || len(db.manifest.Files()) != 1 {
+		log.Panicln("count", n, "files", db.manifest.Files())
+	}
+	for name := range legacy {
+		if _, err := os.Stat(name); err == nil {
+			log.Panicln("merged file kept", name)
+		}
+	}
+	c.Close()
+	db.Close()
+
+	// no merges so each batch appends one edit after the rewritten tree
+	db = E(Open("test12.db", WithCompactionPolicy(FIFOPolicy(0, 0))))
+	for v := 6; v < 8; v++ {
+		w := E(db.Write())
+		for i := 0; i < 100; i++ {
+			err := w.Add(key(i), key(v))
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+	db.Close()
+	// a bad edit before the last fails open instead of dropping the
+	// files after it
+	files := E(filepath.Glob("test12.db/*.lsm"))
+	current := E(os.ReadFile("test12.db/CURRENT"))
+	manifest := "test12.db/" + strings.TrimSpace(string(current))
+	buf := E(os.ReadFile(manifest))
+	size, i := binary.Uvarint(buf)
+	second := i + 4 + int(size)
+	size, i = binary.Uvarint(buf[second:])
+	buf[second+i+4+int(size)-1] ^= 1
+	os.WriteFile(manifest, buf, 0644)
+	var corrupt *ErrCorrupt
+	if _, err := Open("test12.db"); !errors.As(err, &corrupt) {
+		log.Panicln("corrupt manifest opened", err)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			log.Panicln("removed", f)
+		}
+	}
+}
+
+func TestPartitioned(t *testing.T) {
+	os.RemoveAll("test13.db")
+	defer os.RemoveAll("test13.db")
+	db := E(Open("test13.db", WithFileSize(16*1024), WithBaseSize(64*1024), WithMultiplier(4)))
+	defer db.Close()
+
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	write := func(start, end, version int) {
+		w := E(db.Write())
+		defer w.Close()
+		for i := start; i < end; i++ {
+			err := w.Add(key(i), binary.BigEndian.AppendUint32(key(i), uint32(version)))
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}
+	settle := func() {
+		for len(db.manifest.Level(0)) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	count := 40_000
+	for v := 0; v < 4; v++ {
+		write(v*count/4, (v+1)*count/4, 0)
+		settle()
+	}
+
+	// levels below 0 are disjoint files in key order
+	files := 0
+	for i := 1; i < db.manifest.Levels(); i++ {
+		level := db.manifest.Level(i)
+		files += len(level)
+		for j := 1; j < len(level); j++ {
+			if bytes.Compare(level[j-1].Largest, level[j].Smallest) >= 0 {
+				log.Panicln("level", i, "overlaps", level[j-1], level[j])
+			}
+		}
+	}
+	if files < 4 {
+		log.Panicln("files", files)
+	}
+
+	// a small write only rewrites the files it overlaps
+	before := map[string]bool{}
+	for _, f := range db.manifest.Files() {
+		before[f.Name] = true
+	}
+	write(100, 200, 1)
+	settle()
+	kept := 0
+	for _, f := range db.manifest.Files() {
+		if before[f.Name] {
+			kept++
+		}
+	}
+	if kept == 0 {
+		log.Panicln("every file rewritten")
+	}
+
+	c := db.Cursor()
+	defer c.Close()
+	i := 0
+	for more := c.First(); more; more = c.Next() {
+		version := 0
+		if i >= 100 && i < 200 {
+			version = 1
+		}
+		if !bytes.Equal(c.Key(), key(i)) || !bytes.Equal(c.Value(), binary.BigEndian.AppendUint32(key(i), uint32(version))) {
+			log.Panicln("key", i, c.Key(), c.Value())
+		}
+		i++
+	}
+	if c.Err() != nil || i != count {
+		log.Panicln("count", i, c.Err())
+	}
+}
+
+func TestCompactionPolicy(t *testing.T) {
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	write := func(db *DB, start, end, version int) {
+		w := E(db.Write())
+		defer w.Close()
+		for i := start; i < end; i++ {
+			err := w.Add(key(i), binary.BigEndian.AppendUint32(key(i), uint32(version)))
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// every batch rewrites the same keys so runs are merged as they
+	// reach a similar size
+	os.RemoveAll("test14.db")
+	defer os.RemoveAll("test14.db")
+	db := E(Open("test14.db", WithCompactionPolicy(TieredPolicy(2, 2))))
+	count := 1000
+	for v := 0; v < 8; v++ {
+		write(db, 0, count, v)
+		for len(db.manifest.Level(0)) >= 2 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 1; i < db.manifest.Levels(); i++ {
+		level := db.manifest.Level(i)
+		for j := 1; j < len(level); j++ {
+			if bytes.Compare(level[j-1].Largest, level[j].Smallest) >= 0 {
+				log.Panicln("level", i, "overlaps", level[j-1], level[j])
+			}
+		}
+	}
+	c := db.Cursor()
+	i := 0
+	for more := c.First(); more; more = c.Next() {
+		if !bytes.Equal(c.Key(), key(i)) || !bytes.Equal(c.Value(), binary.BigEndian.AppendUint32(key(i), 7)) {
+			log.Panicln("key", i, c.Key(), c.Value())
+		}
+		i++
+	}
+	if c.Err() != nil || i != count {
+		log.Panicln("count", i, c.Err())
+	}
+	c.Close()
+	db.Close()
+
+	// the oldest batches are dropped once the total is over the limit
+	os.RemoveAll("test15.db")
+	defer os.RemoveAll("test15.db")
+	db = E(Open("test15.db", WithCompactionPolicy(FIFOPolicy(0, 0))))
+	for v := 0; v < 4; v++ {
+		write(db, v*count, (v+1)*count, v)
+	}
+	files := db.manifest.Files()
+	db.Close()
+	if len(files) != 4 {
+		log.Panicln("files", files)
+	}
+	max := files[0].Size + files[1].Size + files[2].Size/2
+	db = E(Open("test15.db", WithCompactionPolicy(FIFOPolicy(max, 0))))
+	defer db.Close()
+	for len(db.manifest.Files()) > 2 {
+		time.Sleep(time.Millisecond)
+	}
+	c = db.Cursor()
+	defer c.Close()
+	if !c.First() || !bytes.Equal(c.Key(), key(2*count)) {
+		log.Panicln("first", c.Key())
+	}
+}
+
+func TestCompactRange(t *testing.T) {
+	os.RemoveAll("test16.db")
+	defer os.RemoveAll("test16.db")
+	// files stay in level 0 unless compacted by hand
+	db := E(Open("test16.db", WithCompactionPolicy(FIFOPolicy(0, 0))))
+	defer db.Close()
+
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	count := 1000
+	for v := 0; v < 2; v++ {
+		for i := 0; i < count; i++ {
+			db.Put(key(i), key(v))
+		}
+		err := db.Flush()
+		if err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < count; i += 2 {
+		db.Delete(key(i))
+	}
+	err := db.Flush()
+	if err != nil {
+		panic(err)
+	}
+	for i := 5000; i < 5100; i++ {
+		db.Put(key(i), key(2))
+	}
+
+	// the separate keys aren't merged
+	err = db.CompactRange(context.Background(), key(0), key(10))
+	if err != nil {
+		panic(err)
+	}
+	if len(db.manifest.Level(0)) != 1 || len(db.manifest.Level(1)) == 0 {
+		log.Panicln("levels", db.manifest.Files())
+	}
+	if st := db.Stats(); st.Deletes != 0 || st.Inserts != count/2+100 {
+		log.Panicln("stats", st)
+	}
+
+	err = db.CompactAll(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	for _, f := range db.manifest.Files() {
+		if f.Level != 1 {
+			log.Panicln("files", db.manifest.Files())
+		}
+	}
+	c := db.Cursor()
+	defer c.Close()
+	n := 0
+	for more := c.First(); more; more = c.Next() {
+		k := binary.BigEndian.Uint32(c.Key())
+		if k < 5000 && (k%2 == 0 || !bytes.Equal(c.Value(), key(1))) {
+			log.Panicln("key", k, c.Value())
+		}
+		n++
+	}
+	if n != count/2+100 {
+		log.Panicln("count", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if db.CompactAll(ctx) != context.Canceled {
+		log.Panicln("not canceled")
+	}
+}
+
+func TestParallelCompaction(t *testing.T) {
+	r := func(lo, hi int, smallest, largest byte) *running {
+		return &running{lo: lo, hi: hi, smallest: []byte{smallest}, largest: []byte{largest}}
+	}
+	l0 := r(0, 1, 0, 200)
+	// a merge lower in the tree doesn't hold up level 0
+	deep := r(3, 4, 0, 200)
+	if l0.conflicts(deep) || !l0.conflicts(r(1, 2, 50, 60)) || r(2, 3, 0, 10).conflicts(r(2, 3, 11, 20)) {
+		log.Panicln("conflicts")
+	}
+	db := &DB{workers: 2}
+	jobs := map[*running]bool{deep: true}
+	if db.runnable(r(5, 6, 0, 10), jobs, nil) || !db.runnable(l0, jobs, nil) {
+		log.Panicln("level 0 worker")
+	}
+
+	os.RemoveAll("test17.db")
+	defer os.RemoveAll("test17.db")
+	db = E(Open("test17.db", WithFileSize(8*1024), WithBaseSize(32*1024), WithMultiplier(2), WithCompactionWorkers(4)))
+	defer db.Close()
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	count := 20_000
+	for v := 0; v < 10; v++ {
+		w := E(db.Write())
+		for i := v; i < count; i += 10 {
+			err := w.Add(key(i), key(i))
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+	err := db.CompactAll(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	for i := 1; i < db.manifest.Levels(); i++ {
+		level := db.manifest.Level(i)
+		for j := 1; j < len(level); j++ {
+			if bytes.Compare(level[j-1].Largest, level[j].Smallest) >= 0 {
+				log.Panicln("level", i, "overlaps", level[j-1], level[j])
+			}
+		}
+	}
+	c := db.Cursor()
+	defer c.Close()
+	i := 0
+	for more := c.First(); more; more = c.Next() {
+		if !bytes.Equal(c.Key(), key(i)) || !bytes.Equal(c.Value(), key(i)) {
+			log.Panicln("key", i, c.Key())
+		}
+		i++
+	}
+	if c.Err() != nil || i != count {
+		log.Panicln("count", i, c.Err())
+	}
+}
+
+func TestWriteStall(t *testing.T) {
+	db := &DB{stall: stall{softFiles: 2, hardFiles: 4}, rate: rate{limiter: ratelimit.New(0)}}
+	ctx := context.Background()
+	db.setLevel0(1, 0)
+	db.setMerging(true)
+	if db.stallWrite(ctx, true) != nil || db.stall.slowdowns != 0 {
+		log.Panicln("stalled under soft limit")
+	}
+	db.setLevel0(3, 0)
+	if db.stallWrite(ctx, true) != nil || db.stall.slowdowns != 1 || db.stall.stops != 0 {
+		log.Panicln("not slowed", &db.stall)
+	}
+
+	db.setLevel0(4, 0)
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if db.stallWrite(timeout, false) != context.DeadlineExceeded || db.stall.stops != 1 {
+		log.Panicln("not stopped", &db.stall)
+	}
+	// merges catching up let writers go
+	done := make(chan error)
+	go func() {
+		done <- db.stallWrite(ctx, false)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	db.setLevel0(1, 0)
+	if <-done != nil || db.stall.stops != 2 {
+		log.Panicln("not woken", &db.stall)
+	}
+	// as does the merger having nothing to do
+	db.setLevel0(10, 0)
+	go func() {
+		done <- db.stallWrite(ctx, false)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	db.setMerging(false)
+	if <-done != nil {
+		log.Panicln("not woken")
+	}
+	// bytes
+	db.stall = stall{softBytes: 100, hardBytes: 200}
+	db.setLevel0(1, 150)
+	if soft, hard := db.level0Over(); soft != 1 || hard {
+		log.Panicln("bytes", soft, hard)
+	}
+
+	os.RemoveAll("test18.db")
+	defer os.RemoveAll("test18.db")
+	// level 0 is never merged so writes go on past the limits
+	db = E(Open("test18.db", WithCompactionPolicy(FIFOPolicy(0, 0)), WithLevel0Limits(1, 2)))
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		w := E(db.Write())
+		err := w.Add([]byte{byte(i)}, nil)
+		if err == nil {
+			err = w.Commit()
+		}
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+	if st := db.Stats(); st.Level0Files != 3 || st.Level0Bytes == 0 || st.Stops != 0 {
+		log.Panicln("stats", st)
+	}
+}
+
+func TestCompactionRate(t *testing.T) {
+	os.RemoveAll("test19.db")
+	defer os.RemoveAll("test19.db")
+	// level 0 is never merged so its size is fixed between writes
+	db := E(Open("test19.db", WithCompactionPolicy(FIFOPolicy(0, 0)), WithLevel0Limits(4, 0),
+		WithCompactionRate(1<<20), WithAdaptiveCompactionRate(5<<20)))
+	defer db.Close()
+	if r := db.CompactionRate(); r != 1<<20 {
+		log.Panicln("rate", r)
+	}
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	count := 10_000
+	for v := 0; v < 2; v++ {
+		w := E(db.Write())
+		for i := v; i < count; i += 2 {
+			// random so the written files are as big as the reads
+			value := make([]byte, 100)
+			rand.Read(value)
+			err := w.Add(key(i), value)
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+	// half way to the soft limit
+	if r := db.CompactionRate(); r != 3<<20 {
+		log.Panicln("rate", r)
+	}
+
+	// about 1 MB read and 1 MB written
+	db.SetCompactionRate(4 << 20)
+	db.rate.lock.Lock()
+	db.rate.max = 0
+	db.rate.lock.Unlock()
+	db.adaptRate()
+	start := time.Now()
+	err := db.CompactAll(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		log.Panicln("compacted in", d)
+	}
+
+	db.SetCompactionRate(0)
+	if r := db.CompactionRate(); r != 0 {
+		log.Panicln("rate", r)
+	}
+}
+
+func TestCloseMerge(t *testing.T) {
+	os.RemoveAll("test20.db")
+	defer os.RemoveAll("test20.db")
+	// slow enough that compacting takes several seconds
+	db := E(Open("test20.db", WithCompactionPolicy(FIFOPolicy(0, 0)), WithCompactionRate(256<<10)))
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	count := 10_000
+	for v := 0; v < 2; v++ {
+		w := E(db.Write())
+		for i := v; i < count; i += 2 {
+			value := make([]byte, 100)
+			rand.Read(value)
+			err := w.Add(key(i), value)
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+
+	compacted := make(chan error, 1)
+	go func() {
+		compacted <- db.CompactAll(context.Background())
+	}()
+	time.Sleep(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := db.CloseContext(ctx)
+	if err != nil {
+		panic(err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		log.Panicln("closed in", d)
+	}
+	if err := <-compacted; err == nil {
+		log.Panicln("compaction not canceled")
+	}
+	if tmp := E(filepath.Glob("test20.db/*.tmp")); len(tmp) > 0 {
+		log.Panicln("tmp files", tmp)
+	}
+
+	db = E(Open("test20.db", WithCompactionPolicy(FIFOPolicy(0, 0))))
+	defer db.Close()
+	c := db.Cursor()
+	defer c.Close()
+	i := 0
+	for more := c.First(); more; more = c.Next() {
+		if !bytes.Equal(c.Key(), key(i)) {
+			log.Panicln("key", i, c.Key())
+		}
+		i++
+	}
+	if i != count || c.Err() != nil {
+		log.Panicln("count", i, c.Err())
+	}
+}
+
+func TestCloseLargeMerge(t *testing.T) {
+	os.RemoveAll("test24.db")
+	defer os.RemoveAll("test24.db")
+	// one value takes about 16 seconds to read at this rate
+	db := E(Open("test24.db", WithCompactionPolicy(FIFOPolicy(0, 0)), WithCompactionRate(256<<10)))
+	value := make([]byte, 4<<20)
+	for v := 0; v < 2; v++ {
+		value[0] = byte(v)
+		err := db.Put([]byte("key"), value)
+		if err == nil {
+			err = db.Flush()
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	compacted := make(chan error, 1)
+	go func() {
+		compacted <- db.CompactAll(context.Background())
+	}()
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	db.Close()
+	if d := time.Since(start); d > 2*time.Second {
+		log.Panicln("closed in", d)
+	}
+	if err := <-compacted; err == nil {
+		log.Panicln("compaction not canceled")
+	}
+
+	db = E(Open("test24.db", WithCompactionPolicy(FIFOPolicy(0, 0))))
+	defer db.Close()
+	c := db.Cursor()
+	defer c.Close()
+	if c.Find([]byte("key")) != Found || !bytes.Equal(c.Value(), value) {
+		log.Panicln("value", len(c.Value()), c.Err())
+	}
+}
+
+// adds big-endian uint64 operands to a big-endian uint64
+type counter struct{}
+
+func (counter) Merge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var n uint64
+	if existing != nil {
+		n = binary.BigEndian.Uint64(existing)
+	}
+	for _, op := range operands {
+		if len(op) != 8 {
+			return nil, fmt.Errorf("bad operand %v", op)
+		}
+		n += binary.BigEndian.Uint64(op)
+	}
+	return binary.BigEndian.AppendUint64(nil, n), nil
+}
+
+func TestMergeOperator(t *testing.T) {
+	os.RemoveAll("test21.db")
+	defer os.RemoveAll("test21.db")
+	db := E(Open("test21.db", WithMergeOperator(counter{}), WithRetention(1000)))
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	number := func(n int) []byte {
+		return binary.BigEndian.AppendUint64(nil, uint64(n))
+	}
+
+	// keys 0-99 start at i. keys from 100 have no value
+	w := E(db.Write())
+	for i := 0; i < 100; i++ {
+		err := w.Add(key(i), number(i))
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := w.Commit()
+	if err != nil {
+		panic(err)
+	}
+	w.Close()
+	start := db.Sequence()
+	// add 1 to every even key three times and delete key 0 after the first
+	for round := 0; round < 3; round++ {
+		w := E(db.Write())
+		for i := 0; i < 110; i += 2 {
+			var err error
+			if i == 0 && round == 1 {
+				err = w.Delete(key(i))
+			} else {
+				err = w.Merge(key(i), number(1))
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+
+	want := func(i int) int {
+		switch {
+		case i == 0:
+			return 1
+		case i%2 == 1:
+			return i
+		case i >= 100:
+			return 3
+		}
+		return i + 3
+	}
+	// 0-99 and the even keys from 100
+	check := func(c Cursor, want func(int) int) {
+		defer c.Close()
+		n := 0
+		for more := c.First(); more; more = c.Next() {
+			i := int(binary.BigEndian.Uint32(c.Key()))
+			if !bytes.Equal(c.Value(), number(want(i))) {
+				log.Panicln("key", i, c.Value(), c.Err())
+			}
+			n++
+		}
+		if n != 105 || c.Err() != nil {
+			log.Panicln("count", n, c.Err())
+		}
+	}
+	check(db.Cursor(), want)
+	// as of before the merges keys from 100 have no value yet
+	c := db.CursorAt(start)
+	for more := c.First(); more; more = c.Next() {
+		if !bytes.Equal(c.Value(), number(int(binary.BigEndian.Uint32(c.Key())))) {
+			log.Panicln("as of", c.Key(), c.Value(), c.Err())
+		}
+	}
+	if c.Err() != nil {
+		panic(c.Err())
+	}
+	c.Close()
+
+	err = db.CompactAll(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	check(db.Cursor(), want)
+	db.Close()
+
+	// without retention compaction folds every operand so no operator
+	// is needed to read
+	db = E(Open("test21.db", WithMergeOperator(counter{})))
+	err = db.CompactAll(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	db.Close()
+	db = E(Open("test21.db"))
+	defer db.Close()
+	check(db.Cursor(), want)
+	w = E(db.Write())
+	defer w.Close()
+	if w.Merge(key(0), number(1)) == nil {
+		log.Panicln("merge without operator")
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	os.RemoveAll("test22.db")
+	defer os.RemoveAll("test22.db")
+	db := E(Open("test22.db", WithRetention(1000)))
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+
+	// keys 0-999 in the bottom level
+	w := E(db.Write())
+	for i := 0; i < 1000; i++ {
+		err := w.Add(key(i), key(i))
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := w.Commit()
+	if err != nil {
+		panic(err)
+	}
+	w.Close()
+	err = db.CompactAll(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	before := db.Sequence()
+
+	// delete 100-599 except 300 which the batch writes, then 400 again
+	w = E(db.Write())
+	if w.DeleteRange(key(5), key(5)) == nil {
+		log.Panicln("empty range")
+	}
+	err = w.Add(key(300), []byte("batch"))
+	if err == nil {
+		err = w.DeleteRange(key(100), key(600))
+	}
+	if err == nil {
+		err = w.Commit()
+	}
+	if err != nil {
+		panic(err)
+	}
+	w.Close()
+	err = db.Put(key(400), []byte("put"))
+	if err != nil {
+		panic(err)
+	}
+
+	check := func(c Cursor, deleted bool) {
+		defer c.Close()
+		n := 0
+		for more := c.First(); more; more = c.Next() {
+			i := int(binary.BigEndian.Uint32(c.Key()))
+			if deleted && i >= 100 && i < 600 && i != 300 && i != 400 {
+				log.Panicln("deleted key", i)
+			}
+			n++
+		}
+		want := 1000
+		if deleted {
+			want = 502
+		}
+		if n != want || c.Err() != nil {
+			log.Panicln("count", n, want, c.Err())
+		}
+	}
+	check(db.Cursor(), true)
+	check(db.CursorAt(before), false)
+	c := db.Cursor()
+	if c.Find(key(100)) != FoundGreater || !bytes.Equal(c.Key(), key(300)) || string(c.Value()) != "batch" {
+		log.Panicln("find", c.Key())
+	}
+	if !c.Previous() || !bytes.Equal(c.Key(), key(99)) {
+		log.Panicln("previous", c.Key())
+	}
+	c.Close()
+	c = db.Range(key(150), key(250))
+	if c.First() || c.Last() || c.Err() != nil {
+		log.Panicln("range", c.Key())
+	}
+	c.Close()
+
+	err = db.CompactAll(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	check(db.Cursor(), true)
+	check(db.CursorAt(before), false)
+	db.Close()
+
+	// without retention the bottom level drops the tombstone and
+	// the keys under it
+	db = E(Open("test22.db"))
+	defer db.Close()
+	err = db.CompactAll(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	check(db.Cursor(), true)
+	if st := db.Stats(); st.TombstoneBytes != 0 || st.Deletes != 0 || st.Inserts != 502 {
+		log.Panicln("stats", st.TombstoneBytes, st.Deletes, st.Inserts)
+	}
+	db.Close()
+
+	// a batch of only a range tombstone writes a level 0 file with no
+	// entries. no merges so reads go through it
+	db = E(Open("test22.db", WithCompactionPolicy(FIFOPolicy(0, 0))))
+	defer db.Close()
+	w = E(db.Write())
+	err = w.DeleteRange(key(700), key(800))
+	if err == nil {
+		err = w.Commit()
+	}
+	if err != nil {
+		panic(err)
+	}
+	w.Close()
+	c = db.Cursor()
+	if c.Find(key(750)) != FoundGreater || !bytes.Equal(c.Key(), key(800)) {
+		log.Panicln("find", c.Key(), c.Err())
+	}
+	c.Close()
+	c = db.Range(key(650), key(750))
+	if !c.First() || !bytes.Equal(c.Key(), key(650)) || !c.Last() || !bytes.Equal(c.Key(), key(699)) {
+		log.Panicln("range", c.Key(), c.Err())
+	}
+	c.Close()
+}
+
+func TestExpire(t *testing.T) {
+	os.RemoveAll("test23.db")
+	defer os.RemoveAll("test23.db")
+	// never merges so only expired files are dropped
+	db := E(Open("test23.db", WithCompactionPolicy(FIFOPolicy(0, 0)), WithMergeFrequency(10*time.Millisecond)))
+	defer db.Close()
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	expires := time.Now().Add(500 * time.Millisecond)
+	// even keys of 0-99, all of 1000-1099 then all of 0-9 expire
+	write := func(from, to int, all bool) {
+		w := E(db.Write())
+		defer w.Close()
+		for i := from; i < to; i++ {
+			var err error
+			if all || i%2 == 0 {
+				err = w.Add(key(i), key(i), ExpireAt(expires))
+			} else {
+				// the zero time never expires
+				err = w.Add(key(i), key(i), ExpireAt(time.Time{}))
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}
+	write(0, 100, false)
+	write(1000, 1100, true)
+	write(0, 10, true)
+
+	count := func() int {
+		c := db.Cursor()
+		defer c.Close()
+		n := 0
+		for more := c.First(); more; more = c.Next() {
+			n++
+		}
+		if c.Err() != nil {
+			panic(c.Err())
+		}
+		return n
+	}
+	if n := count(); n != 200 {
+		log.Panicln("before expiry", n)
+	}
+	time.Sleep(time.Until(expires))
+	// 0-9 hide the older odd keys under them
+	if n := count(); n != 45 {
+		log.Panicln("after expiry", n)
+	}
+	c := db.Cursor()
+	if c.Find(key(0)) != FoundGreater || !bytes.Equal(c.Key(), key(11)) {
+		log.Panicln("find", c.Key())
+	}
+	c.Close()
+
+	// 1000-1099 is dropped whole. 0-9 is kept since it hides keys
+	// in an older file
+	for i := 0; ; i++ {
+		st := db.Stats()
+		if st.Level0Files == 2 && st.Inserts == 110 {
+			break
+		}
+		if i == 500 {
+			log.Panicln("expired file not dropped", st.Level0Files, st.Inserts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := count(); n != 45 {
+		log.Panicln("after drop", n)
+	}
+
+	err := db.CompactAll(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	if st := db.Stats(); st.Inserts != 45 || st.Deletes != 0 {
+		log.Panicln("compacted", st.Inserts, st.Deletes)
+	}
+	if n := count(); n != 45 {
+		log.Panicln("after compaction", n)
+	}
+}
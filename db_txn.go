@@ -0,0 +1,234 @@
+package teepeedb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/stangelandcl/teepeedb/internal/manifest"
+)
+
+// names commits started in the same nanosecond
+var commitCounter int64
+
+// writers staged by CommitAll. each database with changes gets a
+// prepare file naming its staged files and the decision file. the
+// decision file, in the first database, is written once every prepare
+// file is and is the commit point. it is removed after every prepare
+// file so a prepare file without one means the commit never happened
+type commitIntent struct {
+	writers  []*Writer
+	staged   []*Writer
+	prepares []string
+	decision string
+}
+
+// commit writers from different databases together so after a crash
+// either every batch or none of them is visible. each writer must be
+// from a different database and still be closed by the caller.
+// databases with a prepared commit finish or undo it in Open
+func CommitAll(writers ...*Writer) error {
+	t, err := stageAll(writers)
+	if err != nil {
+		return err
+	}
+	if len(t.staged) > 1 {
+		err = t.decide()
+		if err != nil {
+			t.abort()
+			return err
+		}
+	}
+	return t.publish()
+}
+
+func stageAll(writers []*Writer) (*commitIntent, error) {
+	t := &commitIntent{writers: writers}
+	for _, w := range writers {
+		err := w.stage()
+		if err != nil {
+			return nil, err
+		}
+		if !w.empty() {
+			t.staged = append(t.staged, w)
+		}
+	}
+	// renaming one file is already atomic
+	if len(t.staged) <= 1 {
+		return t, nil
+	}
+
+	id := fmt.Sprintf("%d.%d", time.Now().UnixNano(), atomic.AddInt64(&commitCounter, 1))
+	var err error
+	t.decision, err = filepath.Abs(fmt.Sprintf("%v/txn.%v.commit", t.staged[0].db.directory, id))
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range t.staged {
+		prepare, err := filepath.Abs(fmt.Sprintf("%v/txn.%v.prepare", w.db.directory, id))
+		if err == nil {
+			err = writeCommitFile(prepare, t.decision, filepath.Base(w.filename))
+		}
+		if err != nil {
+			t.abort()
+			return nil, err
+		}
+		t.prepares = append(t.prepares, prepare)
+		w.prepare = prepare
+	}
+	return t, nil
+}
+
+// write the decision file. the commit is durable once this returns
+func (t *commitIntent) decide() error {
+	return writeCommitFile(t.decision, t.prepares...)
+}
+
+// undo a commit whose decision file wasn't written. the caller
+// closes the writers which removes their staged files
+func (t *commitIntent) abort() {
+	for _, p := range t.prepares {
+		os.Remove(p)
+	}
+	os.Remove(t.decision)
+}
+
+// add staged files to each tree. each writer removes its prepare file
+// with the manifest edit so a merge can't remove the file from the tree
+// while recovery could still add it. if this fails part way the
+// remaining prepare files stay and Open finishes them
+func (t *commitIntent) publish() error {
+	for _, w := range t.writers {
+		err := w.publish()
+		if err != nil {
+			return err
+		}
+	}
+	if len(t.prepares) == 0 {
+		return nil
+	}
+	for _, w := range t.staged {
+		syncDir(w.db.directory)
+	}
+	os.Remove(t.decision)
+	return nil
+}
+
+// finish prepared commits whose decision file exists and undo the
+// rest. runs in Open after the manifest is read
+func (db *DB) recoverCommits() error {
+	files, err := filepath.Glob(fmt.Sprintf("%v/txn.*.prepare", db.directory))
+	if err != nil {
+		return err
+	}
+	for _, prepare := range files {
+		lines, err := readCommitFile(prepare)
+		if err != nil {
+			return err
+		}
+		if len(lines) < 1 {
+			return fmt.Errorf("teepeedb: empty commit file %v", prepare)
+		}
+		decision := lines[0]
+		_, err = os.Stat(decision)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			// can't tell if it committed. the other database may
+			// be on a missing mount
+			return err
+		}
+		committed := err == nil
+		for _, name := range lines[1:] {
+			filename := filepath.Join(db.directory, name)
+			if !committed {
+				os.Remove(filename + ".tmp")
+				continue
+			}
+			// missing if renamed before the crash
+			err = os.Rename(filename+".tmp", filename)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			// renamed but not yet in the manifest. merges only remove
+			// it from the tree after the prepare file is gone
+			_, err = os.Stat(filename)
+			if err != nil || db.manifest.Has(name) {
+				continue
+			}
+			syncDir(db.directory)
+			f, err := describe(filename, 0)
+			if err == nil {
+				err = db.manifest.Apply(manifest.Edit{Add: []manifest.File{f}})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		syncDir(db.directory)
+		os.Remove(prepare)
+		syncDir(db.directory)
+		removeDecision(decision)
+	}
+
+	// decisions left by a crash after every database recovered
+	files, err = filepath.Glob(fmt.Sprintf("%v/txn.*.commit", db.directory))
+	if err != nil {
+		return err
+	}
+	for _, decision := range files {
+		removeDecision(decision)
+	}
+	return nil
+}
+
+// remove a decision file once no database has a prepare file for it
+func removeDecision(decision string) {
+	prepares, err := readCommitFile(decision)
+	if err != nil {
+		return
+	}
+	for _, p := range prepares {
+		_, err = os.Stat(p)
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+	}
+	os.Remove(decision)
+}
+
+// one line per filename. written to a temp file and renamed so it
+// either exists whole or not at all
+func writeCommitFile(filename string, lines ...string) error {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+	if err != nil {
+		os.Remove(filename + ".tmp")
+		return err
+	}
+	syncDir(filepath.Dir(filename))
+	return nil
+}
+
+func readCommitFile(filename string) ([]string, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n"), nil
+}
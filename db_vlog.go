@@ -0,0 +1,363 @@
+package teepeedb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/stangelandcl/teepeedb/internal/reader"
+	"github.com/stangelandcl/teepeedb/internal/shared"
+	"github.com/stangelandcl/teepeedb/internal/vlog"
+)
+
+// value log files are started over once they reach this size so
+// garbage collection can rewrite and drop them one at a time
+const valueLogSize = 64 * 1024 * 1024
+
+type valueFile struct {
+	f        *os.File
+	filename string
+	number   int64
+	// number of valueLogs holding this file
+	refs int64
+}
+
+// value log files readable by cursors opened at the same time.
+// a file removed by garbage collection stays open until every
+// cursor that could still point into it is closed
+type valueLogs struct {
+	files    map[int64]*valueFile
+	refcount int64
+}
+
+func newValueLogs(files map[int64]*valueFile) *valueLogs {
+	v := &valueLogs{files: files, refcount: 1}
+	for _, f := range files {
+		atomic.AddInt64(&f.refs, 1)
+	}
+	return v
+}
+
+func (v *valueLogs) acquire() *valueLogs {
+	atomic.AddInt64(&v.refcount, 1)
+	return v
+}
+
+func (v *valueLogs) release() {
+	if atomic.AddInt64(&v.refcount, -1) != 0 {
+		return
+	}
+	for _, f := range v.files {
+		if atomic.AddInt64(&f.refs, -1) == 0 {
+			f.f.Close()
+		}
+	}
+}
+
+// copy of files with add added and remove removed. either can be nil
+func (v *valueLogs) with(add, remove *valueFile) map[int64]*valueFile {
+	files := map[int64]*valueFile{}
+	for n, f := range v.files {
+		if f != remove {
+			files[n] = f
+		}
+	}
+	if add != nil {
+		files[add.number] = add
+	}
+	return files
+}
+
+// value pointer points to read into buf
+func (v *valueLogs) read(pointer, buf []byte) ([]byte, []byte, error) {
+	p, err := vlog.DecodePointer(pointer)
+	if err != nil {
+		return nil, buf, err
+	}
+	f := v.files[p.File]
+	if f == nil {
+		return nil, buf, fmt.Errorf("teepeedb: missing value log %v", p.File)
+	}
+	val, buf, err := vlog.Read(f.f, p, buf)
+	if err != nil {
+		return nil, buf, &shared.ErrCorrupt{File: f.filename, Offset: int(p.Offset), Err: err}
+	}
+	return val, buf, nil
+}
+
+// read into a new buffer for merge.Resolver
+func (v *valueLogs) resolve(pointer []byte) ([]byte, error) {
+	val, _, err := v.read(pointer, nil)
+	return val, err
+}
+
+func valueLogNumber(filename string) (int64, error) {
+	var n int64
+	_, err := fmt.Sscanf(filepath.Base(filename), "vlog.%d.vlog", &n)
+	return n, err
+}
+
+// replace the value logs visible to new cursors. caller must hold writeLock
+func (db *DB) setValueLogs(files map[int64]*valueFile) {
+	v := newValueLogs(files)
+	db.readLock.Lock()
+	old := db.values
+	db.values = v
+	db.readLock.Unlock()
+	if old != nil {
+		old.release()
+	}
+}
+
+// open existing value logs for reading. they are read whether or not
+// WithValueLog is set so pointers written before stay readable
+func (db *DB) openValueLogs() error {
+	matches, err := filepath.Glob(fmt.Sprintf("%v/vlog.*.vlog", db.directory))
+	if err != nil {
+		return err
+	}
+	files := map[int64]*valueFile{}
+	for _, filename := range matches {
+		n, err := valueLogNumber(filename)
+		if err != nil {
+			continue
+		}
+		if n >= db.vlogCounter {
+			db.vlogCounter = n + 1
+		}
+		if st, err := os.Stat(filename); err == nil && st.Size() == 0 {
+			os.Remove(filename)
+			continue
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			for _, f := range files {
+				f.f.Close()
+			}
+			return err
+		}
+		files[n] = &valueFile{f: f, filename: filename, number: n}
+	}
+	db.values = newValueLogs(files)
+	return nil
+}
+
+// start a new value log file. caller must hold writeLock
+func (db *DB) rotateValueLog() error {
+	filename := fmt.Sprintf("%v/vlog.%015d.vlog", db.directory, db.vlogCounter)
+	w, err := vlog.Create(filename, db.vlogCounter)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		w.Close()
+		os.Remove(filename)
+		return err
+	}
+	vf := &valueFile{f: f, filename: filename, number: db.vlogCounter}
+	db.vlogCounter++
+	if db.vlog != nil {
+		err = db.vlog.Close()
+		if err != nil {
+			f.Close()
+			w.Close()
+			os.Remove(filename)
+			return err
+		}
+	}
+	db.vlog = w
+	db.setValueLogs(db.values.with(vf, nil))
+	return nil
+}
+
+// move a large value to the value log and point to it instead.
+// caller must hold writeLock
+func (db *DB) separate(kv *shared.KV) error {
+	// merge operands stay inline so folding them doesn't read the log
+	if db.vlogThreshold <= 0 || kv.Delete || kv.Pointer || kv.Merge || len(kv.Value) < db.vlogThreshold {
+		return nil
+	}
+	if db.vlog == nil || db.vlog.Size() >= valueLogSize {
+		err := db.rotateValueLog()
+		if err != nil {
+			return err
+		}
+	}
+	p, err := db.vlog.Append(kv.Key, kv.Value)
+	if err != nil {
+		return err
+	}
+	db.pointer = p.Append(db.pointer[:0])
+	kv.Value = db.pointer
+	kv.Pointer = true
+	return nil
+}
+
+// separate for an older version written with key. caller must hold writeLock
+func (db *DB) separateVersion(key []byte, v *shared.Version) error {
+	kv := shared.KV{Key: key, Value: v.Value, Delete: v.Delete, Pointer: v.Pointer}
+	err := db.separate(&kv)
+	if err == nil && kv.Pointer && !v.Pointer {
+		// separate reuses its buffer for every call
+		v.Value = append([]byte(nil), kv.Value...)
+		v.Pointer = true
+	}
+	return err
+}
+
+// values must be on disk before the file pointing to them is renamed
+// into place. caller must hold writeLock
+func (db *DB) syncValueLog() error {
+	if db.vlog == nil {
+		return nil
+	}
+	return db.vlog.Sync()
+}
+
+// rewrite value log files where at least discardRatio of the bytes
+// belong to overwritten or deleted keys. live values are appended to
+// the current value log, pointed to by a new level 0 file and the old
+// value log is removed. the active value log is never collected.
+// returns the number of files removed
+func (db *DB) GCValueLog(discardRatio float64) (int, error) {
+	db.writeLock.Lock()
+	var numbers []int64
+	for n := range db.values.files {
+		if db.vlog == nil || n != db.vlog.Number {
+			numbers = append(numbers, n)
+		}
+	}
+	db.writeLock.Unlock()
+	sort.Slice(numbers, func(i, j int) bool {
+		return numbers[i] < numbers[j]
+	})
+
+	removed := 0
+	for _, n := range numbers {
+		ok, err := db.collect(n, discardRatio)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+type liveValue struct {
+	key     []byte
+	p       vlog.Pointer
+	seq     uint64
+	expires int64
+}
+
+// rewrite live values of one value log. true if the file was removed
+func (db *DB) collect(number int64, discardRatio float64) (bool, error) {
+	// holding the writer keeps other writes from landing between
+	// checking which values are live and committing their new pointers.
+	// puts after this are in newer memtables and override the rewrite
+	w, err := db.Write()
+	if err != nil {
+		return false, err
+	}
+	defer w.Close()
+
+	vf := db.values.files[number]
+	if vf == nil {
+		return false, nil
+	}
+
+	c := db.Cursor()
+	defer c.Close()
+	var live []liveValue
+	var total, liveBytes int64
+	var versions []shared.Version
+	now := time.Now().UnixNano()
+	// older versions past what reads from horizon on see are garbage.
+	// the rest pin their values since only the newest is rewritten
+	horizon := db.horizon()
+	pinned := false
+	err = vlog.Scan(vf.filename, number, func(p vlog.Pointer, key []byte) error {
+		total += int64(p.Size)
+		if c.m.Find(key) != reader.Found {
+			return c.m.Err()
+		}
+		versions = c.m.Versions(versions[:0])
+		if c.m.Err() != nil {
+			return c.m.Err()
+		}
+		versions = versions[:shared.Readable(versions, horizon)]
+		for i, v := range versions {
+			if !v.Pointer {
+				continue
+			}
+			cur, err := vlog.DecodePointer(v.Value)
+			if err != nil || cur != p || v.Expired(now) {
+				continue
+			}
+			liveBytes += int64(p.Size)
+			if i > 0 {
+				pinned = true
+				continue
+			}
+			live = append(live, liveValue{key: append([]byte(nil), key...), p: p, seq: v.Seq, expires: v.Expires})
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if total > 0 && float64(total-liveBytes) < discardRatio*float64(total) {
+		return false, nil
+	}
+	if pinned {
+		// removing the file would lose values older versions still
+		// read. it is collected once the horizon passes them
+		return false, nil
+	}
+
+	sort.Slice(live, func(i, j int) bool {
+		return bytes.Compare(live[i].key, live[j].key) < 0
+	})
+	var buf []byte
+	for _, v := range live {
+		var val []byte
+		val, buf, err = vlog.Read(vf.f, v.p, buf)
+		if err != nil {
+			return false, &shared.ErrCorrupt{File: vf.filename, Offset: int(v.p.Offset), Err: err}
+		}
+		// force the rewrite into the value log whatever the threshold
+		if db.vlog == nil || db.vlog.Size() >= valueLogSize {
+			err = db.rotateValueLog()
+			if err != nil {
+				return false, err
+			}
+		}
+		p, err := db.vlog.Append(v.key, val)
+		if err != nil {
+			return false, err
+		}
+		// same sequence as the version it replaces so as of reads
+		// before it still see older versions
+		err = w.add(&shared.KV{Key: v.key, Value: p.Append(nil), Pointer: true, Seq: v.seq, Expires: v.expires})
+		if err != nil {
+			return false, err
+		}
+	}
+	err = w.Commit()
+	if err != nil {
+		return false, err
+	}
+
+	// new pointers must be durable before the old values are gone
+	syncDir(db.directory)
+	db.setValueLogs(db.values.with(nil, vf))
+	os.Remove(vf.filename)
+	return true, nil
+}
@@ -0,0 +1,108 @@
+package teepeedb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/stangelandcl/teepeedb/internal/memtable"
+	"github.com/stangelandcl/teepeedb/internal/wal"
+)
+
+// how Put and Delete wait for the write-ahead log
+type SyncMode = wal.SyncMode
+
+const (
+	// write to the OS but don't fsync. survives a process crash
+	// but not power loss
+	SyncNone = wal.SyncNone
+	// fsync before every write returns
+	SyncAlways = wal.SyncAlways
+	// concurrent writes wait for and share one fsync
+	SyncGroup = wal.SyncGroup
+)
+
+type WriteOpt func(o *writeOpts)
+
+type writeOpts struct {
+	sync SyncMode
+	ctx  context.Context
+}
+
+// override the database sync mode for one write. see WithSyncMode
+func WriteSync(mode SyncMode) WriteOpt {
+	return func(o *writeOpts) {
+		o.sync = mode
+	}
+}
+
+// give up on a write with ctx's error if it is done while level 0 is
+// over its limits. see WithLevel0Limits
+func WriteContext(ctx context.Context) WriteOpt {
+	return func(o *writeOpts) {
+		o.ctx = ctx
+	}
+}
+
+func (db *DB) logFilename() string {
+	filename := fmt.Sprintf("%v/wal.%015d.log", db.directory, db.logCounter)
+	db.logCounter++
+	return filename
+}
+
+// replay logs left from a crash into frozen memtables before the reader
+// is opened. they are flushed to level 0 files in the background like
+// any other memtable and each log is removed once its file is committed
+func (db *DB) openLogs() error {
+	files, err := filepath.Glob(fmt.Sprintf("%v/wal.*.log", db.directory))
+	if err != nil {
+		return err
+	}
+	// oldest first
+	sort.Strings(files)
+
+	for _, file := range files {
+		var n int64
+		_, err = fmt.Sscanf(filepath.Base(file), "wal.%d.log", &n)
+		if err != nil {
+			continue
+		}
+		if n >= db.logCounter {
+			db.logCounter = n + 1
+		}
+
+		t := memtable.New()
+		_, err = wal.Replay(file, func(kind wal.Kind, key, val []byte, seq uint64) {
+			if seq <= db.sequence {
+				// log written before sequences
+				seq = db.sequence + 1
+			}
+			db.sequence = seq
+			t.PutSeq(key, val, kind == wal.Delete, seq)
+		})
+		if err != nil {
+			return err
+		}
+		if t.Len() == 0 {
+			os.Remove(file)
+			continue
+		}
+		db.imm = append([]*frozen{{t: t, wal: file}}, db.imm...)
+	}
+
+	db.wal, err = wal.Create(db.logFilename())
+	return err
+}
+
+// best effort sync of directory so renames are durable before
+// removing the log that could replay them
+func syncDir(directory string) {
+	f, err := os.Open(directory)
+	if err != nil {
+		return
+	}
+	f.Sync()
+	f.Close()
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/stangelandcl/teepeedb/internal/shared"
 	"github.com/stangelandcl/teepeedb/internal/writer"
@@ -15,32 +16,95 @@ type Writer struct {
 	w                 *writer.File
 	last              []byte
 	closed, committed bool
+	// sequence of every write in the batch
+	seq uint64
+	// CommitAll prepare file removed once the batch is in the tree
+	prepare string
+	// a range tombstone was added
+	ranges bool
+}
+
+// option for Writer.Add
+type AddOpt func(kv *shared.KV)
+
+// the entry expires at t. cursors stop returning it once t has passed
+// and merges drop it. the zero time never expires
+func ExpireAt(t time.Time) AddOpt {
+	return func(kv *shared.KV) {
+		if t.IsZero() {
+			kv.Expires = 0
+			return
+		}
+		kv.Expires = t.UnixNano()
+	}
 }
 
 // inserts and deletes must happen in sorted order within a transaction
 // fails if bytes.Compare(k, lastKey) <= 0
-func (w *Writer) Add(key, val []byte) error {
-	if bytes.Compare(w.last, key) >= 0 {
-		return fmt.Errorf("teepeedb: adding keys out of order. last: %v current: %v", w.last, key)
-	}
-	w.last = append(w.last[:0], key...)
+func (w *Writer) Add(key, val []byte, opts ...AddOpt) error {
 	kv := shared.KV{}
 	kv.Key = key
 	kv.Value = val
-	return w.w.Add(&kv)
+	kv.Seq = w.seq
+	for _, opt := range opts {
+		opt(&kv)
+	}
+	return w.add(&kv)
 }
 
 // inserts and deletes must happen in sorted order within a transaction
 // fails if bytes.Compare(k, lastKey) <= 0
 func (w *Writer) Delete(key []byte) error {
-	if bytes.Compare(w.last, key) >= 0 {
-		return fmt.Errorf("teepeedb: adding keys out of order. last: %v current: %v", w.last, key)
-	}
-	w.last = append(w.last[:0], key...)
 	kv := shared.KV{}
 	kv.Key = key
 	kv.Delete = true
-	return w.w.Add(&kv)
+	kv.Seq = w.seq
+	return w.add(&kv)
+}
+
+// write operand to be combined with the value of key by the merge
+// operator. fails without one. see WithMergeOperator.
+// inserts, deletes and merges must happen in sorted order within a transaction
+func (w *Writer) Merge(key, operand []byte) error {
+	if w.db.mergeOperator == nil {
+		return fmt.Errorf("teepeedb: no merge operator. see WithMergeOperator")
+	}
+	kv := shared.KV{}
+	kv.Key = key
+	kv.Value = operand
+	kv.Merge = true
+	kv.Seq = w.seq
+	return w.add(&kv)
+}
+
+// delete every key >= start and < end written before this batch with
+// a single range tombstone. keys the batch adds are kept. unlike other
+// writes it can be called in any order
+func (w *Writer) DeleteRange(start, end []byte) error {
+	if bytes.Compare(start, end) >= 0 {
+		return fmt.Errorf("teepeedb: empty delete range. start: %v end: %v", start, end)
+	}
+	err := w.w.AddTombstone(shared.Tombstone{Start: start, End: end, Seq: w.seq})
+	if err != nil {
+		return err
+	}
+	w.ranges = true
+	return nil
+}
+
+func (w *Writer) add(kv *shared.KV) error {
+	if bytes.Compare(w.last, kv.Key) >= 0 {
+		return fmt.Errorf("teepeedb: adding keys out of order. last: %v current: %v", w.last, kv.Key)
+	}
+	if len(kv.Value) > shared.MaxValueSize {
+		return shared.ErrValueTooBig
+	}
+	err := w.db.separate(kv)
+	if err != nil {
+		return err
+	}
+	w.last = append(w.last[:0], kv.Key...)
+	return w.w.Add(kv)
 }
 
 // commit transaction to disk.
@@ -49,20 +113,42 @@ func (w *Writer) Delete(key []byte) error {
 // re-opens readers so next Cursor() call sees new data and triggers
 // background merger to wakeup and merge this level 0 file into level 1
 func (w *Writer) Commit() error {
-	err := w.w.Commit()
+	err := w.stage()
 	if err != nil {
 		return err
 	}
+	return w.publish()
+}
 
+// sync the temp file and the values it points to
+func (w *Writer) stage() error {
+	err := w.db.syncValueLog()
+	if err != nil {
+		return err
+	}
+	return w.w.Commit()
+}
+
+func (w *Writer) empty() bool {
+	return len(w.last) == 0 && !w.ranges
+}
+
+// rename the staged file into the LSM tree
+func (w *Writer) publish() error {
 	// no writes to this file. we're done
-	if len(w.last) == 0 {
+	if w.empty() {
 		os.Remove(w.filename + ".tmp")
 		w.committed = true
 		return nil
 	}
 
 	// commit
-	err = os.Rename(w.filename+".tmp", w.filename)
+	err := w.db.addLevel0(w.filename, func() {
+		// the file is in the tree so recovery has nothing to do
+		if w.prepare != "" {
+			os.Remove(w.prepare)
+		}
+	})
 	if err == nil {
 		w.committed = true
 		// so next open cursor sees changes
@@ -75,6 +161,12 @@ func (w *Writer) Commit() error {
 	return err
 }
 
+// sequence of the batch. greater than the sequence of every batch and
+// Put before it. see DB.CursorAt
+func (w *Writer) Sequence() uint64 {
+	return w.seq
+}
+
 func (w *Writer) Close() {
 	if w.closed {
 		return
@@ -2,22 +2,58 @@ package block
 
 import (
 	"encoding/binary"
-	"log"
+	"errors"
+	"hash/crc32"
+	"math"
 	"sync"
+	"sync/atomic"
 
 	"github.com/stangelandcl/teepeedb/internal/lz4"
 )
 
+const (
+	// original format. no checksums
+	Format1 = 1
+	// Format1 followed by a little-endian uint32 crc32c of the block
+	Format2 = 2
+	// Format2 with 32 bit key and value offsets so blocks can hold
+	// values over 64 KiB. key offsets keep flags in the low 4 bits
+	Format3 = 3
+	// Format3 with FlagPointer. each format from here on adds a flag
+	// older readers would misread so they reject the file instead
+	Format4 = 4
+	// Format4 with FlagVersion
+	Format5 = 5
+	// Format5 with FlagMerge
+	Format6 = 6
+	// Format6 with FlagExpire and flags in the low 5 bits of key offsets
+	Format7 = 7
+)
+
+var (
+	ErrChecksum = errors.New("block checksum mismatch")
+	ErrInvalid  = errors.New("block lengths or offsets out of range")
+)
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
 type ReadBlock struct {
-	KeyOffsets, ValOffsets []uint16
+	// key offsets are offset << 5 | flags in every format
+	KeyOffsets, ValOffsets []uint32
 	Keys                   []byte
 	Vals                   []byte
 	Count                  int
+	// bytes per serialized offset. 2 before Format3
+	width int
 
 	// remaining compressed value bytes
 	// directly references mmapped file
 	vbuf   []byte
 	nvcomp int
+	// set if lazily decompressing values failed
+	err error
+	// owners of this block. Close returns it to the pool at zero
+	refs int32
 
 	// uncompressed buffers
 	// for reusing slice memory so each decompression
@@ -28,31 +64,146 @@ type ReadBlock struct {
 
 var pool = sync.Pool{New: func() any { return &ReadBlock{} }}
 
-func Read(buf []byte) *ReadBlock {
+// read block at start of buf. lengths are checked against buf and
+// Format2 blocks are checked against their checksum so a corrupt file
+// returns an error instead of panicking
+func Read(buf []byte, format int) (*ReadBlock, error) {
+	start := buf
 	ncomp, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, ErrInvalid
+	}
 	buf = buf[n:]
 	nuncomp, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, ErrInvalid
+	}
 	buf = buf[n:]
 	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, ErrInvalid
+	}
 	buf = buf[n:]
+	width := 4
+	if format < Format3 {
+		width = 2
+	}
+	if ncomp > uint64(len(buf)) || !validSize(ncomp, nuncomp, count, width) {
+		return nil, ErrInvalid
+	}
 
 	comp := buf[:ncomp]
 	buf = buf[ncomp:]
 
+	nvcomp, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, ErrInvalid
+	}
+	vbuf := buf[n:]
+	end := len(start) - len(vbuf)
+	if nvcomp > 0 {
+		nvuncomp, n := binary.Uvarint(vbuf)
+		if n <= 0 || nvcomp > uint64(len(vbuf)-n) || !validSize(nvcomp, nvuncomp, count, width) {
+			return nil, ErrInvalid
+		}
+		end += n + int(nvcomp)
+	}
+	if format >= Format2 {
+		if len(start) < end+4 {
+			return nil, ErrInvalid
+		}
+		if crc32.Checksum(start[:end], table) != binary.LittleEndian.Uint32(start[end:]) {
+			return nil, ErrChecksum
+		}
+	}
+
 	r := pool.Get().(*ReadBlock)
-	r.kuncomp = r.uncompress(r.kuncomp[:0], comp, int(nuncomp))
+	r.refs = 1
+	var err error
+	r.kuncomp, err = r.uncompress(r.kuncomp[:0], comp, int(nuncomp))
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
 	r.Count = int(count)
-	r.KeyOffsets = offsets(r.KeyOffsets[:0], r.kuncomp, r.Count)
-	r.Keys = r.kuncomp[r.Count*2:]
-	ncomp, n = binary.Uvarint(buf)
-	r.nvcomp = int(ncomp)
-	r.vbuf = buf[n:]
+	r.width = width
+	r.KeyOffsets = offsets(r.KeyOffsets[:0], r.kuncomp, r.Count, width)
+	switch {
+	case width == 2:
+		// older formats keep the delete flag in the low bit
+		for i, x := range r.KeyOffsets {
+			r.KeyOffsets[i] = x>>1<<flagBits | x&FlagDelete
+		}
+	case format < Format7:
+		for i, x := range r.KeyOffsets {
+			if x>>4 > math.MaxUint32>>flagBits {
+				r.Close()
+				return nil, ErrInvalid
+			}
+			r.KeyOffsets[i] = x>>4<<flagBits | x&(1<<4-1)
+		}
+	}
+	r.Keys = r.kuncomp[r.Count*width:]
+	if !validOffsets(r.KeyOffsets, flagBits, len(r.Keys)) {
+		r.Close()
+		return nil, ErrInvalid
+	}
+	r.nvcomp = int(nvcomp)
+	r.vbuf = vbuf
 	r.Vals = r.Vals[:0]
 	r.ValOffsets = r.ValOffsets[:0]
-	return r
+	return r, nil
+}
+
+// blocks always have a key. lz4 can't expand more than 255 times
+// so a larger uncompressed size is corrupt and would over allocate
+func validSize(ncomp, nuncomp, count uint64, width int) bool {
+	return count > 0 &&
+		count*uint64(width) <= nuncomp &&
+		nuncomp <= ncomp*255+16
 }
 
+// offsets must be in order and inside data. shift removes flag bits
+func validOffsets(offsets []uint32, shift int, n int) bool {
+	last := 0
+	for _, o := range offsets {
+		x := int(o) >> shift
+		if x < last {
+			return false
+		}
+		last = x
+	}
+	return last <= n
+}
+
+// add an owner. each owner calls Close once. blocks with more than
+// one owner are shared between goroutines and must be read only, see
+// Decompress
+func (b *ReadBlock) Retain() {
+	atomic.AddInt32(&b.refs, 1)
+}
+
+// decompress values now instead of on the first Value call so
+// Value no longer modifies the block
+func (b *ReadBlock) Decompress() error {
+	b.Value(0)
+	if b.err == nil {
+		// values no longer reference the file
+		b.vbuf = nil
+	}
+	return b.err
+}
+
+// uncompressed bytes held by the block
+func (b *ReadBlock) Size() int {
+	return cap(b.kuncomp) + cap(b.vuncomp) + 4*(cap(b.KeyOffsets)+cap(b.ValOffsets))
+}
+
+// drop an owner and return the block to the pool after the last one
 func (b *ReadBlock) Close() {
+	if atomic.AddInt32(&b.refs, -1) != 0 {
+		return
+	}
 	b.KeyOffsets = b.KeyOffsets[:0]
 	b.ValOffsets = b.ValOffsets[:0]
 	b.Keys = b.Keys[:0]
@@ -62,24 +213,36 @@ func (b *ReadBlock) Close() {
 	b.vuncomp = b.vuncomp[:0]
 	b.nvcomp = 0
 	b.Count = 0
+	b.width = 0
+	b.err = nil
 	pool.Put(b)
 }
 
+// error from decompressing values in Value()
+func (b *ReadBlock) Err() error {
+	return b.err
+}
+
 func (b *ReadBlock) KeyOffset(idx int) (offset int, delete bool) {
-	x := int(b.KeyOffsets[idx])
-	offset = x >> 1
-	delete = x&1 != 0
+	x := b.KeyOffsets[idx]
+	offset = int(x >> flagBits)
+	delete = x&FlagDelete != 0
 	return
 }
 
+// FlagDelete etc
+func (b *ReadBlock) Flags(idx int) uint32 {
+	return b.KeyOffsets[idx] & (1<<flagBits - 1)
+}
+
 func (b *ReadBlock) Key(idx int) ([]byte, bool) {
-	x := int(b.KeyOffsets[idx])
-	start := x >> 1
-	delete := x&1 != 0
+	x := b.KeyOffsets[idx]
+	start := int(x >> flagBits)
+	delete := x&FlagDelete != 0
 	idx++
 	end := len(b.Keys)
 	if idx != int(b.Count) {
-		end = int(b.KeyOffsets[idx]) >> 1
+		end = int(b.KeyOffsets[idx] >> flagBits)
 	}
 	return b.Keys[start:end], delete
 }
@@ -92,13 +255,17 @@ const (
 	Both = Key | Val
 )
 
+// returns nil and sets Err() if values are corrupt
 func (b *ReadBlock) Value(idx int) []byte {
 	if len(b.ValOffsets) == 0 {
 		// no values check
-		if b.nvcomp == 0 {
+		if b.nvcomp == 0 || b.err != nil {
+			return nil
+		}
+		b.err = b.value()
+		if b.err != nil {
 			return nil
 		}
-		b.value()
 	}
 
 	var start, end int
@@ -112,35 +279,55 @@ func (b *ReadBlock) Value(idx int) []byte {
 	return b.Vals[start:end]
 }
 
-func offsets(dst []uint16, src []byte, n int) []uint16 {
-	x := binary.LittleEndian.Uint16(src)
+func offsets(dst []uint32, src []byte, n int, width int) []uint32 {
+	if width == 2 {
+		x := binary.LittleEndian.Uint16(src)
+		dst = append(dst, uint32(x))
+		// deserialize remaining differences into offsets
+		for i := 1; i < n; i++ {
+			x += binary.LittleEndian.Uint16(src[i*2:])
+			dst = append(dst, uint32(x))
+		}
+		return dst
+	}
+	x := binary.LittleEndian.Uint32(src)
 	dst = append(dst, x)
-	// deserialize remaining differences into offsets
 	for i := 1; i < n; i++ {
-		y := binary.LittleEndian.Uint16(src[i*2:])
-		x += y
+		x += binary.LittleEndian.Uint32(src[i*4:])
 		dst = append(dst, x)
 	}
 	return dst
 }
 
-func (r *ReadBlock) uncompress(dst, comp []byte, nuncomp int) []byte {
+func (r *ReadBlock) uncompress(dst, comp []byte, nuncomp int) ([]byte, error) {
 	dst = append(dst, make([]byte, nuncomp)...)
-	n := lz4.UncompressBlock(comp, dst)
+	n, err := lz4.UncompressBlock(comp, dst)
+	if err != nil {
+		return dst, err
+	}
 	if n != nuncomp {
-		log.Panicln("lz4 uncompressed to wrong size:", n)
+		return dst, ErrInvalid
 	}
-	return dst
+	return dst, nil
 }
 
 // decompress value
-func (r *ReadBlock) value() {
+func (r *ReadBlock) value() error {
 	buf := r.vbuf
 	nuncomp, n := binary.Uvarint(buf)
 	buf = buf[n:]
 	comp := buf[:r.nvcomp]
 
-	r.vuncomp = r.uncompress(r.vuncomp[:0], comp, int(nuncomp))
-	r.ValOffsets = offsets(r.ValOffsets[:0], r.vuncomp, r.Count)
-	r.Vals = r.vuncomp[r.Count*2:]
+	var err error
+	r.vuncomp, err = r.uncompress(r.vuncomp[:0], comp, int(nuncomp))
+	if err != nil {
+		return err
+	}
+	r.ValOffsets = offsets(r.ValOffsets[:0], r.vuncomp, r.Count, r.width)
+	r.Vals = r.vuncomp[r.Count*r.width:]
+	if !validOffsets(r.ValOffsets, 0, len(r.Vals)) {
+		r.ValOffsets = r.ValOffsets[:0]
+		return ErrInvalid
+	}
+	return nil
 }
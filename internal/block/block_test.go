@@ -3,8 +3,11 @@ package block
 import (
 	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"log"
 	"testing"
+
+	"github.com/stangelandcl/teepeedb/internal/lz4"
 )
 
 func TestBlock(t *testing.T) {
@@ -18,7 +21,10 @@ func TestBlock(t *testing.T) {
 	wr := Writer{}
 	wr.Write(&buf, &w)
 
-	r := Read(buf.Bytes())
+	r, err := Read(buf.Bytes(), Format7)
+	if err != nil {
+		panic(err)
+	}
 	defer r.Close()
 
 	for i := 0; i < 200; i++ {
@@ -36,3 +42,147 @@ func TestBlock(t *testing.T) {
 		}
 	}
 }
+
+func TestCorrupt(t *testing.T) {
+	w := WriteBlock{}
+	for i := 0; i < 200; i++ {
+		k := binary.BigEndian.AppendUint32(nil, uint32(i))
+		w.Put(k, k, false)
+	}
+	buf := bytes.Buffer{}
+	wr := Writer{}
+	wr.Write(&buf, &w)
+	good := buf.Bytes()
+
+	// every single bit flip is caught by either length checks or checksum
+	for i := 0; i < len(good)*8; i++ {
+		bad := append([]byte(nil), good...)
+		bad[i/8] ^= 1 << (i % 8)
+		r, err := Read(bad, Format7)
+		if err == nil {
+			r.Close()
+			log.Panicln("corruption not detected at bit", i)
+		}
+	}
+
+	// truncated blocks never panic
+	for i := 0; i < len(good); i++ {
+		r, err := Read(good[:i], Format7)
+		if err == nil {
+			r.Close()
+			log.Panicln("truncation not detected at", i)
+		}
+		r, err = Read(good[:i], Format1)
+		if err == nil {
+			r.Value(0)
+			r.Close()
+		}
+	}
+}
+
+func TestLargeValue(t *testing.T) {
+	w := WriteBlock{}
+	big := bytes.Repeat([]byte("0123456789"), 20_000)
+	w.Put([]byte("a"), []byte("x"), false)
+	w.Put([]byte("b"), big, false)
+	w.Put([]byte("c"), big[:70_000], true)
+
+	buf := bytes.Buffer{}
+	wr := Writer{}
+	wr.Write(&buf, &w)
+	r, err := Read(buf.Bytes(), Format7)
+	if err != nil {
+		panic(err)
+	}
+	defer r.Close()
+	k, del := r.Key(2)
+	if string(k) != "c" || !del || !bytes.Equal(r.Value(1), big) || len(r.Value(2)) != 70_000 {
+		log.Panicln("bad large value", string(k), del, len(r.Value(1)), len(r.Value(2)))
+	}
+}
+
+// Format2 blocks written before 32 bit offsets are still readable
+func TestFormat2(t *testing.T) {
+	keys := []byte("abbccc")
+	// 16 bit offsets: key offset << 1 | delete
+	kofs := []uint16{0, 1<<1 | 1, 3 << 1}
+	vals := []byte("xyyzzz")
+	vofs := []uint16{0, 1, 3}
+
+	// offsets as differences followed by data, lz4 compressed
+	compress := func(ofs []uint16, data []byte) ([]byte, int) {
+		uncomp := binary.LittleEndian.AppendUint16(nil, ofs[0])
+		for i := 1; i < len(ofs); i++ {
+			uncomp = binary.LittleEndian.AppendUint16(uncomp, ofs[i]-ofs[i-1])
+		}
+		uncomp = append(uncomp, data...)
+		comp := make([]byte, lz4.CompressBlockBound(len(uncomp)))
+		return comp[:lz4.CompressBlock(uncomp, comp)], len(uncomp)
+	}
+	kcomp, knuncomp := compress(kofs, keys)
+	vcomp, vnuncomp := compress(vofs, vals)
+	buf := binary.AppendUvarint(nil, uint64(len(kcomp)))
+	buf = binary.AppendUvarint(buf, uint64(knuncomp))
+	buf = binary.AppendUvarint(buf, uint64(len(kofs)))
+	buf = append(buf, kcomp...)
+	buf = binary.AppendUvarint(buf, uint64(len(vcomp)))
+	buf = binary.AppendUvarint(buf, uint64(vnuncomp))
+	buf = append(buf, vcomp...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, table))
+
+	r, err := Read(buf, Format2)
+	if err != nil {
+		panic(err)
+	}
+	defer r.Close()
+	want := []string{"a", "bb", "ccc"}
+	for i := range want {
+		k, del := r.Key(i)
+		v := r.Value(i)
+		if string(k) != want[i] || del != (i == 1) || len(v) != len(want[i]) {
+			log.Panicln("format2", i, string(k), del, string(v))
+		}
+	}
+}
+
+// Format3 to Format6 blocks keep 4 flag bits and are still readable
+func TestFormat3(t *testing.T) {
+	w := WriteBlock{}
+	w.PutFlags([]byte("a"), []byte("x"), FlagMerge)
+	w.PutFlags([]byte("bb"), []byte("yy"), FlagDelete|FlagExpire)
+	w.PutFlags([]byte("ccc"), []byte("zzz"), FlagPointer)
+	buf := bytes.Buffer{}
+	wr := Writer{}
+	wr.Write(&buf, &w)
+	r, err := Read(buf.Bytes(), Format7)
+	if err != nil {
+		panic(err)
+	}
+	if k, _ := r.Key(1); string(k) != "bb" || r.Flags(1) != FlagDelete|FlagExpire {
+		log.Panicln("format7", string(k), r.Flags(1))
+	}
+	r.Close()
+
+	// key offset << 4 | flags
+	w.KeyOffsets = []uint32{0<<4 | FlagMerge, 1<<4 | FlagDelete, 3<<4 | FlagPointer}
+	w.Keys = []byte("abbccc")
+	w.ValOffsets = []uint32{0, 1, 3}
+	w.Vals = []byte("xyyzzz")
+	buf.Reset()
+	wr.Write(&buf, &w)
+	for format := Format3; format < Format7; format++ {
+		r, err = Read(buf.Bytes(), format)
+		if err != nil {
+			panic(err)
+		}
+		want := []string{"a", "bb", "ccc"}
+		flags := []uint32{FlagMerge, FlagDelete, FlagPointer}
+		for i := range want {
+			k, del := r.Key(i)
+			if string(k) != want[i] || del != (i == 1) || r.Flags(i) != flags[i] || len(r.Value(i)) != len(want[i]) {
+				log.Panicln("format", format, i, string(k), del, r.Flags(i))
+			}
+		}
+		r.Close()
+	}
+}
@@ -7,9 +7,27 @@ import (
 	"github.com/stangelandcl/teepeedb/internal/varint"
 )
 
+const (
+	// low bits of a key offset that hold flags for the entry
+	flagBits = 5
+	// entry is a delete
+	FlagDelete = 1 << 0
+	// value is a pointer into a value log
+	FlagPointer = 1 << 1
+	// value starts with the entry's sequence and older versions.
+	// see shared.AppendVersions
+	FlagVersion = 1 << 2
+	// value is a merge operand combined with the older value of the key
+	FlagMerge = 1 << 3
+	// value starts with the unsigned varint unix nanosecond time the
+	// entry expires at. see shared.AppendExpiry
+	FlagExpire = 1 << 4
+)
+
 type WriteBlock struct {
-	KeyOffsets []uint16
-	ValOffsets []uint16
+	// offset << flagBits | flags
+	KeyOffsets []uint32
+	ValOffsets []uint32
 	Keys       []byte
 	Vals       []byte
 }
@@ -24,35 +42,40 @@ func (b *WriteBlock) KeyAt(i int) []byte {
 	n := len(b.Keys)
 	end := n
 	if i+1 < len(b.KeyOffsets) {
-		end = int(b.KeyOffsets[i+1]) >> 1
+		end = int(b.KeyOffsets[i+1] >> flagBits)
 	}
-	return b.Keys[b.KeyOffsets[i]>>1 : end]
+	return b.Keys[b.KeyOffsets[i]>>flagBits : end]
 }
 
 func (b *WriteBlock) Put(key, val []byte, delete bool) {
-	if len(b.Keys) > math.MaxInt16 || len(b.Vals) > math.MaxUint16 {
-		// key < int16 because 1 bit is used for delete flag
-		// values < uint16 because all bits are used for size
-		log.Panicln("block size out of range. offset > 32767")
-	}
-	n := len(b.Keys) << 1
+	var flags uint32
 	if delete {
-		n |= 1
+		flags = FlagDelete
+	}
+	b.PutFlags(key, val, flags)
+}
+
+// flags is a combination of FlagDelete etc
+func (b *WriteBlock) PutFlags(key, val []byte, flags uint32) {
+	if uint64(len(b.Keys)+len(key)) > math.MaxUint32>>flagBits || uint64(len(b.Vals)+len(val)) > math.MaxUint32 {
+		// HasSpace and shared.MaxValueSize keep blocks far smaller
+		log.Panicln("block size out of range")
 	}
-	b.KeyOffsets = append(b.KeyOffsets, uint16(n))
+	n := uint32(len(b.Keys))<<flagBits | flags&(1<<flagBits-1)
+	b.KeyOffsets = append(b.KeyOffsets, n)
 	b.Keys = append(b.Keys, key...)
 
-	b.ValOffsets = append(b.ValOffsets, uint16(len(b.Vals)))
+	b.ValOffsets = append(b.ValOffsets, uint32(len(b.Vals)))
 	b.Vals = append(b.Vals, val...)
 }
 
 func (b *WriteBlock) Size() int {
-	n := len(b.KeyOffsets) + len(b.Keys)
+	n := len(b.KeyOffsets)*4 + len(b.Keys)
 	sz := varint.Len(n) * 2             // *2 to estimate compressed length
 	sz += varint.Len(len(b.KeyOffsets)) // count
 	sz += n                             // body
 
-	n = len(b.ValOffsets) + len(b.Vals)
+	n = len(b.ValOffsets)*4 + len(b.Vals)
 	sz += varint.Len(n) * 2 // compressed and uncompressed body length
 	sz += n                 // body
 	return sz
@@ -70,12 +93,12 @@ func (b *WriteBlock) HasSpace(k, v, blockSize int, index int) bool {
 	if len(b.KeyOffsets) <= index {
 		return true
 	}
-	n := (len(b.KeyOffsets)+1)*2 + len(b.Keys) + k
+	n := (len(b.KeyOffsets)+1)*4 + len(b.Keys) + k
 	sz := varint.Len(n) * 2                 // *2 to estimate compressed length
 	sz += varint.Len(len(b.KeyOffsets) + 1) // count
 	sz += n                                 // body
 
-	n = (len(b.ValOffsets)+1)*2 + len(b.Vals)
+	n = (len(b.ValOffsets)+1)*4 + len(b.Vals) + v
 	sz += varint.Len(n) * 2 // compressed and uncompressed body length
 	sz += n                 // body
 	return sz <= blockSize
@@ -3,6 +3,7 @@ package block
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 
 	"github.com/stangelandcl/teepeedb/internal/lz4"
@@ -11,6 +12,7 @@ import (
 type file struct {
 	w   io.Writer
 	err error
+	crc uint32
 }
 
 func (w file) Error() error {
@@ -20,6 +22,7 @@ func (w file) Error() error {
 func (w *file) Write(buf []byte) {
 	if w.err == nil {
 		_, w.err = w.w.Write(buf)
+		w.crc = crc32.Update(w.crc, table, buf)
 	}
 }
 
@@ -28,13 +31,13 @@ type Writer struct {
 	comp   []byte
 }
 
-func differences(dst []byte, src []uint16) []byte {
-	dst = append(dst, make([]byte, len(src)*2)...)
+func differences(dst []byte, src []uint32) []byte {
+	dst = append(dst, make([]byte, len(src)*4)...)
 	x := src[0]
-	binary.LittleEndian.PutUint16(dst, x)
+	binary.LittleEndian.PutUint32(dst, x)
 	for i := 1; i < len(src); i++ {
 		y := src[i]
-		binary.LittleEndian.PutUint16(dst[i*2:], y-x)
+		binary.LittleEndian.PutUint32(dst[i*4:], y-x)
 		x = y
 	}
 	return dst
@@ -49,6 +52,7 @@ func (w *Writer) compress() {
 
 var ErrEmpty = fmt.Errorf("teepeedb: tried to write empty block")
 
+// writes Format7
 func (w *Writer) Write(f io.Writer, b *WriteBlock) (Stats, error) {
 	s := Stats{}
 	if len(b.KeyOffsets) == 0 {
@@ -56,7 +60,7 @@ func (w *Writer) Write(f io.Writer, b *WriteBlock) (Stats, error) {
 	}
 
 	for _, o := range b.KeyOffsets {
-		if o&1 == 0 {
+		if o&FlagDelete == 0 {
 			s.Upserts++
 		} else {
 			s.Deletes++
@@ -105,5 +109,9 @@ func (w *Writer) Write(f io.Writer, b *WriteBlock) (Stats, error) {
 	b.ValOffsets = b.ValOffsets[:0]
 	b.Vals = b.Vals[:0]
 
+	// checksum of everything above
+	binary.LittleEndian.PutUint32(tmp[:], ew.crc)
+	ew.Write(tmp[:4])
+
 	return s, ew.Error()
 }
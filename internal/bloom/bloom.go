@@ -0,0 +1,107 @@
+package bloom
+
+import (
+	"encoding/binary"
+)
+
+// builds a bloom filter over all keys in a file
+// filter format is the bit array followed by one byte for the number of probes
+type Builder struct {
+	hashes []uint32
+}
+
+func (b *Builder) Add(key []byte) {
+	b.hashes = append(b.hashes, hash(key))
+}
+
+func (b *Builder) Len() int {
+	return len(b.hashes)
+}
+
+func (b *Builder) Reset() {
+	b.hashes = b.hashes[:0]
+}
+
+// ~1% false positives at 10 bits per key
+func (b *Builder) Build(bitsPerKey int) []byte {
+	// k = ln(2) * bits per key minimizes false positives
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+
+	bits := len(b.hashes) * bitsPerKey
+	// small filters have high false positive rates
+	if bits < 64 {
+		bits = 64
+	}
+	n := (bits + 7) / 8
+	bits = n * 8
+
+	filter := make([]byte, n+1)
+	filter[n] = byte(k)
+	for _, h := range b.hashes {
+		delta := h>>17 | h<<15
+		for j := 0; j < k; j++ {
+			pos := h % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return filter
+}
+
+// false means key is definitely not in the filter
+func MayContain(filter, key []byte) bool {
+	if len(filter) < 2 {
+		return true
+	}
+	n := len(filter) - 1
+	bits := uint32(n * 8)
+	k := int(filter[n])
+	if k > 30 {
+		// reserved for other encodings. match everything
+		return true
+	}
+
+	h := hash(key)
+	delta := h>>17 | h<<15
+	for j := 0; j < k; j++ {
+		pos := h % bits
+		if filter[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// murmur-like hash used by leveldb bloom filters
+func hash(data []byte) uint32 {
+	const (
+		seed = 0xbc9f1d34
+		m    = 0xc6a4a793
+		r    = 24
+	)
+	h := uint32(seed) ^ uint32(len(data))*m
+	for ; len(data) >= 4; data = data[4:] {
+		h += binary.LittleEndian.Uint32(data)
+		h *= m
+		h ^= h >> 16
+	}
+	switch len(data) {
+	case 3:
+		h += uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(data[0])
+		h *= m
+		h ^= h >> r
+	}
+	return h
+}
@@ -0,0 +1,40 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"testing"
+)
+
+func TestBloom(t *testing.T) {
+	b := Builder{}
+	count := 100_000
+	for i := 0; i < count; i++ {
+		b.Add(binary.BigEndian.AppendUint32(nil, uint32(i)))
+	}
+	filter := b.Build(10)
+
+	for i := 0; i < count; i++ {
+		if !MayContain(filter, binary.BigEndian.AppendUint32(nil, uint32(i))) {
+			log.Panicln("false negative", i)
+		}
+	}
+
+	fp := 0
+	for i := count; i < count*2; i++ {
+		if MayContain(filter, binary.BigEndian.AppendUint32(nil, uint32(i))) {
+			fp++
+		}
+	}
+	rate := float64(fp) / float64(count)
+	fmt.Println("false positive rate", rate)
+	if rate > 0.02 {
+		log.Panicln("false positive rate too high", rate)
+	}
+
+	empty := Builder{}
+	if MayContain(empty.Build(10), []byte("x")) {
+		log.Panicln("empty filter matched")
+	}
+}
@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/stangelandcl/teepeedb/internal/block"
+)
+
+const shards = 16
+
+type key struct {
+	file uint64
+	pos  int
+}
+
+type entry struct {
+	key  key
+	rb   *block.ReadBlock
+	size int
+}
+
+type shard struct {
+	lock    sync.Mutex
+	entries map[key]*list.Element
+	// front is most recently used
+	lru      list.List
+	size     int
+	capacity int
+}
+
+// size bounded LRU cache of decompressed blocks shared by every cursor.
+// split into shards with their own lock so concurrent cursors rarely
+// wait on each other. the cache owns one reference to each block it
+// holds and releases it on eviction
+type Cache struct {
+	shards [shards]shard
+	hits   int64
+	misses int64
+}
+
+// capacity in bytes of uncompressed keys and values
+func New(capacity int) *Cache {
+	c := &Cache{}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.entries = map[key]*list.Element{}
+		s.capacity = capacity / shards
+	}
+	return c
+}
+
+func (c *Cache) shard(k key) *shard {
+	// fibonacci hash spreads sequential positions across shards
+	h := (k.file*31 + uint64(k.pos)) * 0x9E3779B97F4A7C15
+	return &c.shards[h>>60]
+}
+
+// block at pos in file or nil. caller owns a reference and must Close it
+func (c *Cache) Get(file uint64, pos int) *block.ReadBlock {
+	k := key{file: file, pos: pos}
+	s := c.shard(k)
+	s.lock.Lock()
+	e, ok := s.entries[k]
+	if !ok {
+		s.lock.Unlock()
+		atomic.AddInt64(&c.misses, 1)
+		return nil
+	}
+	s.lru.MoveToFront(e)
+	rb := e.Value.(*entry).rb
+	rb.Retain()
+	s.lock.Unlock()
+	atomic.AddInt64(&c.hits, 1)
+	return rb
+}
+
+// add block read from pos in file. rb must be read only, see
+// block.ReadBlock.Decompress. the caller keeps its reference
+func (c *Cache) Put(file uint64, pos int, rb *block.ReadBlock) {
+	k := key{file: file, pos: pos}
+	s := c.shard(k)
+	size := rb.Size()
+	if size > s.capacity {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.entries[k]; ok {
+		// another cursor read the same block at the same time
+		return
+	}
+	rb.Retain()
+	s.entries[k] = s.lru.PushFront(&entry{key: k, rb: rb, size: size})
+	s.size += size
+	for s.size > s.capacity {
+		e := s.lru.Back()
+		old := e.Value.(*entry)
+		s.lru.Remove(e)
+		delete(s.entries, old.key)
+		s.size -= old.size
+		old.rb.Close()
+	}
+}
+
+func (c *Cache) Hits() int {
+	return int(atomic.LoadInt64(&c.hits))
+}
+
+func (c *Cache) Misses() int {
+	return int(atomic.LoadInt64(&c.misses))
+}
+
+// release every block
+func (c *Cache) Close() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.lock.Lock()
+		for e := s.lru.Front(); e != nil; e = e.Next() {
+			e.Value.(*entry).rb.Close()
+		}
+		s.lru.Init()
+		s.entries = map[key]*list.Element{}
+		s.size = 0
+		s.lock.Unlock()
+	}
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/stangelandcl/teepeedb/internal/block"
+)
+
+func read(i int) *block.ReadBlock {
+	w := block.WriteBlock{}
+	for j := 0; j < 100; j++ {
+		k := binary.BigEndian.AppendUint32(nil, uint32(i*100+j))
+		w.Put(k, k, false)
+	}
+	buf := bytes.Buffer{}
+	wr := block.Writer{}
+	wr.Write(&buf, &w)
+	rb, err := block.Read(buf.Bytes(), block.Format7)
+	if err != nil {
+		panic(err)
+	}
+	err = rb.Decompress()
+	if err != nil {
+		panic(err)
+	}
+	return rb
+}
+
+func check(rb *block.ReadBlock, i int) {
+	for j := 0; j < rb.Count; j++ {
+		k, _ := rb.Key(j)
+		v := rb.Value(j)
+		if int(binary.BigEndian.Uint32(k)) != i*100+j || !bytes.Equal(k, v) {
+			log.Panicln("bad block", i, j, k, v)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	size := read(0).Size()
+	// room for about 4 blocks per shard
+	c := New(size * 4 * shards)
+	defer c.Close()
+
+	held := read(0)
+	c.Put(1, 0, held)
+	for i := 1; i < 1000; i++ {
+		rb := read(i)
+		c.Put(1, i*4096, rb)
+		rb.Close()
+	}
+	// evicted but still referenced by the caller
+	check(held, 0)
+	held.Close()
+
+	if c.Get(1, 0) != nil {
+		log.Panicln("oldest block not evicted")
+	}
+	rb := c.Get(1, 999*4096)
+	if rb == nil {
+		log.Panicln("newest block evicted")
+	}
+	check(rb, 999)
+	rb.Close()
+	if c.Get(2, 999*4096) != nil {
+		log.Panicln("found block from another file")
+	}
+	if c.Hits() != 1 || c.Misses() != 2 {
+		log.Panicln("hits", c.Hits(), "misses", c.Misses())
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	size := read(0).Size()
+	c := New(size * 2 * shards)
+	defer c.Close()
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 2000; n++ {
+				i := (n*7 + g) % 64
+				rb := c.Get(1, i)
+				if rb == nil {
+					rb = read(i)
+					c.Put(1, i, rb)
+				}
+				check(rb, i)
+				rb.Close()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if c.Hits()+c.Misses() != 8*2000 {
+		log.Panicln("hits", c.Hits(), "misses", c.Misses())
+	}
+}
@@ -29,7 +29,7 @@ func TestFile(t *testing.T) {
 }
 
 func novalues() {
-	w, err := writer.NewFile("test.db", 4096)
+	w, err := writer.NewFile("test.db", 4096, 10)
 	if err != nil {
 		panic(err)
 	}
@@ -90,7 +90,7 @@ func novalues() {
 }
 
 func run() {
-	w, err := writer.NewFile("test.db", 4096)
+	w, err := writer.NewFile("test.db", 4096, 10)
 	if err != nil {
 		panic(err)
 	}
@@ -1,7 +1,8 @@
 package lz4
 
 /*
-Copied from https://github.com/pierrec/lz4 with errors replaced with panics
+Copied from https://github.com/pierrec/lz4 with compression errors replaced with panics.
+Callers size dst with CompressBlockBound so they can't happen. Decompression returns errors
 
 Copyright (c) 2015, Pierre Curto
 All rights reserved.
@@ -34,6 +35,7 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 import (
 	"encoding/binary"
+	"errors"
 	"log"
 	"math/bits"
 	"sync"
@@ -66,15 +68,16 @@ func CompressBlockBound(n int) int {
 	return n + n/255 + 16
 }
 
-func UncompressBlock(src, dst []byte) int {
+var ErrInvalidSource = errors.New("lz4: invalid source or destination buffer too short")
+
+func UncompressBlock(src, dst []byte) (int, error) {
 	if len(src) == 0 {
-		return 0
+		return 0, nil
 	}
 	if di := decodeBlock(dst, src); di >= 0 {
-		return di
+		return di, nil
 	}
-	log.Panicln("lz4: short src buffer")
-	return 0
+	return 0, ErrInvalidSource
 }
 
 type Compressor struct {
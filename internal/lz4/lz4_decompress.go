@@ -34,7 +34,6 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 import (
 	"encoding/binary"
-	"log"
 )
 
 func decodeBlock(dst, src []byte) (ret int) {
@@ -138,8 +137,9 @@ func decodeBlock(dst, src []byte) (ret int) {
 		// Copy the match.
 		if di < offset {
 			// The match is beyond our block, meaning the first part
-			// is in the dictionary.
-			log.Panicln("lz4: out of bounds")
+			// is in the dictionary. there is no dictionary so the
+			// source is corrupt
+			return hasError
 			/*
 				fromDict := dict[uint(len(dict))+di-offset:]
 				n := uint(copy(dst[di:di+mLen], fromDict))
@@ -0,0 +1,414 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/stangelandcl/teepeedb/internal/shared"
+)
+
+const (
+	// names the manifest in use
+	Current = "CURRENT"
+	// start a new manifest holding just the tree once the log passes this
+	maxSize = 4 * 1024 * 1024
+)
+
+var (
+	table      = crc32.MakeTable(crc32.Castagnoli)
+	errCurrent = errors.New("invalid CURRENT file")
+	errRecord  = errors.New("manifest record checksum or length mismatch")
+)
+
+// versioned log of edits to the files in each level of one database.
+// records are framed like the write-ahead log:
+// 1. unsigned varint length of payload
+// 2. little-endian uint32 crc32c of payload
+// 3. payload: one Edit
+//
+// Open replays the log named by CURRENT and starts a new one holding
+// a single edit with the whole tree
+type Manifest struct {
+	directory string
+	lock      sync.Mutex
+	f         *os.File
+	// of MANIFEST-%06d
+	number int64
+	size   int64
+	// level 0 is newest first. other levels are in key order
+	levels [][]File
+	// number of the next new file
+	next int64
+	buf  []byte
+	// a failed append may have left a partial record. replay stops
+	// at it so nothing after can be appended
+	err error
+}
+
+// name of table file n
+func Name(n int64) string {
+	return fmt.Sprintf("%06d.lsm", n)
+}
+
+// number of a file named by Name. false for other names
+func Number(name string) (int64, bool) {
+	var n int64
+	_, err := fmt.Sscanf(name, "%d.lsm", &n)
+	return n, err == nil && Name(n) == name
+}
+
+func Exists(directory string) bool {
+	_, err := os.Stat(filepath.Join(directory, Current))
+	return err == nil
+}
+
+// new manifest with files in read order, level 0 newest first.
+// replaces any existing manifest
+func Create(directory string, files []File) (*Manifest, error) {
+	m := &Manifest{directory: directory, next: 1}
+	// added to the front of level 0 so oldest first
+	for i := len(files) - 1; i >= 0; i-- {
+		if files[i].Level == 0 {
+			m.apply(&Edit{Add: files[i : i+1]})
+		}
+	}
+	for _, f := range files {
+		if f.Level != 0 {
+			m.apply(&Edit{Add: []File{f}})
+		}
+	}
+	err := m.rewrite(1)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// replay the manifest named by CURRENT
+func Open(directory string) (*Manifest, error) {
+	buf, err := os.ReadFile(filepath.Join(directory, Current))
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(string(buf), "\n")
+	var n int64
+	_, err = fmt.Sscanf(name, "MANIFEST-%d", &n)
+	if err != nil || filepath.Base(name) != name {
+		return nil, errCurrent
+	}
+	buf, err = os.ReadFile(filepath.Join(directory, name))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{directory: directory, next: 1}
+	end := len(buf)
+	for len(buf) > 0 {
+		// a torn final record was never acknowledged so replay stops
+		// at it. a bad record with more after it would lose edits that
+		// were, so fail without rewriting anything
+		size, i := binary.Uvarint(buf)
+		if i == 0 || (i > 0 && len(buf) < i+4) {
+			break
+		}
+		corrupt := &shared.ErrCorrupt{File: filepath.Join(directory, name), Offset: end - len(buf), Err: errRecord}
+		if i < 0 {
+			return nil, corrupt
+		}
+		crc := binary.LittleEndian.Uint32(buf[i:])
+		buf = buf[i+4:]
+		if size > uint64(len(buf)) {
+			if hasRecord(buf) {
+				return nil, corrupt
+			}
+			break
+		}
+		payload := buf[:size]
+		buf = buf[size:]
+		if crc32.Checksum(payload, table) != crc {
+			if len(buf) > 0 {
+				return nil, corrupt
+			}
+			break
+		}
+		e := Edit{}
+		err = e.parse(payload)
+		if err != nil {
+			return nil, fmt.Errorf("teepeedb: manifest %v: %w", name, err)
+		}
+		m.apply(&e)
+	}
+
+	err = m.rewrite(n + 1)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// true if a whole record with a matching checksum starts anywhere in
+// buf. a record length too long for the file is only a torn tail if not
+func hasRecord(buf []byte) bool {
+	for j := range buf {
+		size, i := binary.Uvarint(buf[j:])
+		if i <= 0 || size == 0 || uint64(len(buf)-j-i) < 4+size {
+			continue
+		}
+		crc := binary.LittleEndian.Uint32(buf[j+i:])
+		if crc32.Checksum(buf[j+i+4:j+i+4+int(size)], table) == crc {
+			return true
+		}
+	}
+	return false
+}
+
+// write the whole tree to manifest number n, point CURRENT at it
+// and remove older manifests
+func (m *Manifest) rewrite(n int64) error {
+	name := fmt.Sprintf("MANIFEST-%06d", n)
+	filename := filepath.Join(m.directory, name)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// level 0 oldest first since adds go to its front
+	e := Edit{NextFile: m.next}
+	for i, level := range m.levels {
+		if i == 0 {
+			for j := len(level) - 1; j >= 0; j-- {
+				e.Add = append(e.Add, level[j])
+			}
+			continue
+		}
+		e.Add = append(e.Add, level...)
+	}
+	size, err := m.write(f, &e)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = writeCurrent(m.directory, name)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(filename)
+		return err
+	}
+
+	if m.f != nil {
+		m.f.Close()
+	}
+	m.f = f
+	m.number = n
+	m.size = size
+	m.err = nil
+
+	old, _ := filepath.Glob(filepath.Join(m.directory, "MANIFEST-*"))
+	for _, o := range old {
+		if o != filename {
+			os.Remove(o)
+		}
+	}
+	return nil
+}
+
+// replace CURRENT with a temp file and rename so it is always whole
+func writeCurrent(directory, name string) error {
+	tmp := filepath.Join(directory, Current+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(name + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(directory, Current))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(directory)
+	return nil
+}
+
+// best effort sync of directory so renames are durable
+func syncDir(directory string) {
+	f, err := os.Open(directory)
+	if err != nil {
+		return
+	}
+	f.Sync()
+	f.Close()
+}
+
+// append one record. returns bytes written
+func (m *Manifest) write(f *os.File, e *Edit) (int64, error) {
+	m.buf = e.append(m.buf[:0])
+	payload := len(m.buf)
+	header := binary.AppendUvarint(nil, uint64(payload))
+	header = binary.LittleEndian.AppendUint32(header, crc32.Checksum(m.buf, table))
+	m.buf = append(header, m.buf...)
+	_, err := f.Write(m.buf)
+	return int64(len(m.buf)), err
+}
+
+// append e to the log and sync it, then change the tree. the tree
+// is unchanged if it fails
+func (m *Manifest) Apply(e Edit) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if e.NextFile < m.next {
+		e.NextFile = m.next
+	}
+	size, err := m.write(m.f, &e)
+	if err == nil {
+		err = m.f.Sync()
+	}
+	if err != nil {
+		m.err = fmt.Errorf("teepeedb: manifest append failed: %w", err)
+		return err
+	}
+	m.size += size
+	m.apply(&e)
+	if m.size > maxSize {
+		// the old manifest is still whole if this fails
+		m.rewrite(m.number + 1)
+	}
+	return nil
+}
+
+func (m *Manifest) apply(e *Edit) {
+	if e.NextFile > m.next {
+		m.next = e.NextFile
+	}
+	for _, name := range e.Remove {
+		for i, level := range m.levels {
+			for j, f := range level {
+				if f.Name == name {
+					m.levels[i] = append(level[:j:j], level[j+1:]...)
+					break
+				}
+			}
+		}
+	}
+	for _, f := range e.Add {
+		for len(m.levels) <= f.Level {
+			m.levels = append(m.levels, nil)
+		}
+		level := m.levels[f.Level]
+		if f.Level == 0 {
+			m.levels[0] = append([]File{f}, level...)
+		} else {
+			// key order. files in a level don't overlap
+			i := sort.Search(len(level), func(i int) bool {
+				return bytes.Compare(level[i].Smallest, f.Smallest) > 0
+			})
+			level = append(level[:i:i], append([]File{f}, level[i:]...)...)
+			m.levels[f.Level] = level
+		}
+		// files renamed into the tree after the counter was last saved
+		if n, ok := Number(f.Name); ok && n >= m.next {
+			m.next = n + 1
+		}
+	}
+}
+
+// name of a new file not used by any other
+func (m *Manifest) NewName() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n := m.next
+	m.next++
+	return Name(n)
+}
+
+// every file in read order. level 0 newest first then level 1 etc
+func (m *Manifest) Files() []File {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var files []File
+	for _, level := range m.levels {
+		files = append(files, level...)
+	}
+	return files
+}
+
+// files in level. level 0 is newest first
+func (m *Manifest) Level(level int) []File {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if level >= len(m.levels) {
+		return nil
+	}
+	return append([]File(nil), m.levels[level]...)
+}
+
+// files in level with a key from smallest to largest. nil smallest or
+// largest is unbounded
+func (m *Manifest) Overlapping(level int, smallest, largest []byte) []File {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if level >= len(m.levels) {
+		return nil
+	}
+	var files []File
+	for _, f := range m.levels[level] {
+		if f.Overlaps(smallest, largest) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// number of levels including empty ones below the deepest file
+func (m *Manifest) Levels() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.levels)
+}
+
+// true if a file named name is in any level
+func (m *Manifest) Has(name string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, level := range m.levels {
+		for _, f := range level {
+			if f.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *Manifest) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.f == nil {
+		return nil
+	}
+	err := m.f.Close()
+	m.f = nil
+	if m.err == nil {
+		m.err = errors.New("teepeedb: manifest closed")
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errEdit = errors.New("invalid manifest edit")
+
+// field tags in an edit record
+const (
+	tagNextFile = 1
+	tagAdd      = 2
+	tagRemove   = 3
+)
+
+// file in the tree
+type File struct {
+	// base name in the database directory
+	Name  string
+	Level int
+	Size  int64
+	// first and last key. nil if the file is empty
+	Smallest, Largest []byte
+}
+
+// true if f has a key from smallest to largest. nil smallest or largest
+// is unbounded. empty files overlap nothing
+func (f *File) Overlaps(smallest, largest []byte) bool {
+	if f.Smallest == nil {
+		return false
+	}
+	return (largest == nil || bytes.Compare(f.Smallest, largest) <= 0) &&
+		(smallest == nil || bytes.Compare(f.Largest, smallest) >= 0)
+}
+
+// one atomic change to the tree. removes are applied before adds so
+// moving a file to another level is a remove and an add of the same name
+type Edit struct {
+	// files added to level 0 are newer than every file already in it
+	// and later ones in Add are newer than earlier ones
+	Add    []File
+	Remove []string
+	// 0 leaves the file number counter unchanged
+	NextFile int64
+}
+
+// each field is an unsigned varint tag followed by:
+// next file: unsigned varint
+// add: unsigned varint level, name, unsigned varint size, smallest, largest
+// remove: name
+// where names and keys are an unsigned varint length and bytes
+func (e *Edit) append(buf []byte) []byte {
+	if e.NextFile > 0 {
+		buf = binary.AppendUvarint(buf, tagNextFile)
+		buf = binary.AppendUvarint(buf, uint64(e.NextFile))
+	}
+	for _, name := range e.Remove {
+		buf = binary.AppendUvarint(buf, tagRemove)
+		buf = appendBytes(buf, []byte(name))
+	}
+	for _, f := range e.Add {
+		buf = binary.AppendUvarint(buf, tagAdd)
+		buf = binary.AppendUvarint(buf, uint64(f.Level))
+		buf = appendBytes(buf, []byte(f.Name))
+		buf = binary.AppendUvarint(buf, uint64(f.Size))
+		buf = appendBytes(buf, f.Smallest)
+		buf = appendBytes(buf, f.Largest)
+	}
+	return buf
+}
+
+func (e *Edit) parse(buf []byte) error {
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errEdit
+		}
+		buf = buf[n:]
+		switch tag {
+		case tagNextFile:
+			x, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return errEdit
+			}
+			buf = buf[n:]
+			e.NextFile = int64(x)
+		case tagRemove:
+			var name []byte
+			name, buf = parseBytes(buf)
+			if buf == nil {
+				return errEdit
+			}
+			e.Remove = append(e.Remove, string(name))
+		case tagAdd:
+			f := File{}
+			level, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return errEdit
+			}
+			buf = buf[n:]
+			f.Level = int(level)
+			var name []byte
+			name, buf = parseBytes(buf)
+			if buf == nil {
+				return errEdit
+			}
+			f.Name = string(name)
+			size, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return errEdit
+			}
+			buf = buf[n:]
+			f.Size = int64(size)
+			f.Smallest, buf = parseBytes(buf)
+			if buf == nil {
+				return errEdit
+			}
+			f.Largest, buf = parseBytes(buf)
+			if buf == nil {
+				return errEdit
+			}
+			e.Add = append(e.Add, f)
+		default:
+			return errEdit
+		}
+	}
+	return nil
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// bytes and the rest of buf. nil rest if buf is too short. bytes are
+// copied so they outlive buf
+func parseBytes(buf []byte) ([]byte, []byte) {
+	x, n := binary.Uvarint(buf)
+	if n <= 0 || x > uint64(len(buf)-n) {
+		return nil, nil
+	}
+	buf = buf[n:]
+	var b []byte
+	if x > 0 {
+		b = append([]byte(nil), buf[:x]...)
+	}
+	return b, buf[x:]
+}
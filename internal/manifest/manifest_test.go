@@ -0,0 +1,168 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stangelandcl/teepeedb/internal/shared"
+)
+
+func E[T any](t T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func names(files []File) []string {
+	var n []string
+	for _, f := range files {
+		n = append(n, f.Name)
+	}
+	return n
+}
+
+func TestManifest(t *testing.T) {
+	dir := "test.manifest"
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+
+	if Exists(dir) {
+		log.Panicln("manifest exists")
+	}
+	// files from before manifests keep their names
+	m := E(Create(dir, []File{
+		{Name: "l00.000000000000002.lsm"},
+		{Name: "l00.000000000000003.lsm"},
+		{Name: "l01.lsm", Level: 1, Smallest: []byte{1}, Largest: []byte{9}, Size: 100},
+	}))
+	a := m.NewName()
+	b := m.NewName()
+	if a != "000001.lsm" || b != "000002.lsm" {
+		log.Panicln("names", a, b)
+	}
+	err := m.Apply(Edit{Add: []File{{Name: a}}})
+	if err != nil {
+		panic(err)
+	}
+	// merge level 0 and level 1 into a new level 1 file
+	err = m.Apply(Edit{
+		Remove: []string{"l00.000000000000002.lsm", "l00.000000000000003.lsm", "l01.lsm"},
+		Add:    []File{{Name: b, Level: 1}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = m.Apply(Edit{Add: []File{{Name: "000007.lsm"}}})
+	if err != nil {
+		panic(err)
+	}
+	want := []string{"000007.lsm", a, b}
+	check := func(m *Manifest) {
+		got := names(m.Files())
+		if len(got) != len(want) {
+			log.Panicln("files", got, "want", want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				log.Panicln("files", got, "want", want)
+			}
+		}
+		if !m.Has(b) || m.Has("l01.lsm") || m.Levels() != 2 || len(m.Level(0)) != 2 {
+			log.Panicln("levels", m.levels)
+		}
+	}
+	check(m)
+	m.Close()
+
+	// a torn record at the end was never acknowledged
+	old := E(filepath.Glob(dir + "/MANIFEST-*"))
+	f := E(os.OpenFile(old[0], os.O_APPEND|os.O_WRONLY, 0644))
+	f.Write([]byte{20, 1, 2, 3})
+	f.Close()
+
+	m = E(Open(dir))
+	check(m)
+	// counter continues past files added after it was saved
+	if n := m.NewName(); n != "000008.lsm" {
+		log.Panicln("next", n)
+	}
+	if files := E(filepath.Glob(dir + "/MANIFEST-*")); len(files) != 1 || files[0] == old[0] {
+		log.Panicln("manifests", files, old)
+	}
+	m.Close()
+
+	m = E(Open(dir))
+	check(m)
+	l1 := m.Level(1)
+	if !bytes.Equal(l1[0].Smallest, nil) || l1[0].Size != 0 {
+		log.Panicln("level 1", l1)
+	}
+	for _, name := range []string{"000009.lsm", "000010.lsm"} {
+		err = m.Apply(Edit{Add: []File{{Name: name}}})
+		if err != nil {
+			panic(err)
+		}
+	}
+	m.Close()
+
+	// a bad record before the last one lost acknowledged edits
+	current := E(os.ReadFile(dir + "/" + Current))
+	filename := dir + "/" + strings.TrimSpace(string(current))
+	good := E(os.ReadFile(filename))
+	size, n := binary.Uvarint(good)
+	second := n + 4 + int(size)
+	size, n = binary.Uvarint(good[second:])
+	for _, at := range []int{second + n + 4 + int(size) - 1, second} {
+		bad := append([]byte(nil), good...)
+		if at == second {
+			// length past the end of the file
+			bad[at] = 0x7f
+		} else {
+			bad[at] ^= 1
+		}
+		os.WriteFile(filename, bad, 0644)
+		var corrupt *shared.ErrCorrupt
+		if _, err := Open(dir); !errors.As(err, &corrupt) {
+			log.Panicln("corrupt manifest opened", at, err)
+		}
+		if after := E(os.ReadFile(dir + "/" + Current)); !bytes.Equal(after, current) {
+			log.Panicln("rewritten", string(after))
+		}
+	}
+}
+
+func TestEdit(t *testing.T) {
+	e := Edit{
+		Add: []File{
+			{Name: "a", Level: 3, Size: 1 << 40, Smallest: []byte{1, 2}, Largest: []byte{3}},
+			{Name: "b"},
+		},
+		Remove:   []string{"c", "d"},
+		NextFile: 12,
+	}
+	buf := e.append(nil)
+	x := Edit{}
+	err := x.parse(buf)
+	if err != nil {
+		panic(err)
+	}
+	if x.NextFile != 12 || len(x.Add) != 2 || len(x.Remove) != 2 || x.Remove[1] != "d" ||
+		x.Add[0].Name != "a" || x.Add[0].Level != 3 || x.Add[0].Size != 1<<40 ||
+		!bytes.Equal(x.Add[0].Smallest, []byte{1, 2}) || !bytes.Equal(x.Add[0].Largest, []byte{3}) ||
+		x.Add[1].Name != "b" || x.Add[1].Smallest != nil {
+		log.Panicln("edit", x)
+	}
+	// truncated edits fail instead of panicking
+	for i := 0; i < len(buf); i++ {
+		x = Edit{}
+		x.parse(buf[:i])
+	}
+}
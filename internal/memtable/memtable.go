@@ -0,0 +1,199 @@
+package memtable
+
+import (
+	"bytes"
+	"math/rand"
+	"sync/atomic"
+)
+
+const maxHeight = 12
+
+// per entry overhead used to estimate memory size
+const nodeOverhead = 64
+
+type node struct {
+	key    []byte
+	value  []byte
+	delete bool
+	seq    uint64
+	next   []atomic.Pointer[node]
+}
+
+// sorted in memory table of unsorted writes.
+// skiplist ordered by key ascending then sequence descending so the newest
+// version of a key comes first.
+// single writer, multi-reader. writers must be serialized by the caller.
+// readers never lock and only see entries added before their cursor was opened
+type Table struct {
+	head   *node
+	height atomic.Int32
+	seq    atomic.Uint64
+	size   atomic.Int64
+	count  atomic.Int64
+	rnd    *rand.Rand
+}
+
+func New() *Table {
+	t := &Table{
+		head: &node{next: make([]atomic.Pointer[node], maxHeight)},
+		rnd:  rand.New(rand.NewSource(rand.Int63())),
+	}
+	t.height.Store(1)
+	return t
+}
+
+// approximate memory used by keys, values and list nodes
+func (t *Table) Size() int {
+	return int(t.size.Load())
+}
+
+// number of entries including old versions of a key
+func (t *Table) Len() int {
+	return int(t.count.Load())
+}
+
+// sequence of the last write
+func (t *Table) Sequence() uint64 {
+	return t.seq.Load()
+}
+
+func (t *Table) randomHeight() int {
+	h := 1
+	for h < maxHeight && t.rnd.Intn(4) == 0 {
+		h++
+	}
+	return h
+}
+
+// compare by key then newest sequence first
+func compare(n *node, key []byte, seq uint64) int {
+	c := bytes.Compare(n.key, key)
+	if c != 0 {
+		return c
+	}
+	if n.seq > seq {
+		return -1
+	} else if n.seq < seq {
+		return 1
+	}
+	return 0
+}
+
+// key and value are copied. not safe to call concurrently with other writes
+func (t *Table) Put(key, val []byte, delete bool) {
+	t.PutSeq(key, val, delete, t.seq.Load()+1)
+}
+
+// Put with the write's sequence. seq must be greater than Sequence()
+func (t *Table) PutSeq(key, val []byte, delete bool, seq uint64) {
+	var prev [maxHeight]*node
+	x := t.head
+	for i := int(t.height.Load()) - 1; i >= 0; i-- {
+		for {
+			next := x.next[i].Load()
+			if next == nil || compare(next, key, seq) >= 0 {
+				break
+			}
+			x = next
+		}
+		prev[i] = x
+	}
+
+	h := t.randomHeight()
+	if h > int(t.height.Load()) {
+		for i := int(t.height.Load()); i < h; i++ {
+			prev[i] = t.head
+		}
+		t.height.Store(int32(h))
+	}
+
+	n := &node{
+		key:    append([]byte(nil), key...),
+		delete: delete,
+		seq:    seq,
+		next:   make([]atomic.Pointer[node], h),
+	}
+	if !delete {
+		n.value = append([]byte(nil), val...)
+	}
+	// link bottom up so readers never see a node that isn't
+	// reachable from level 0
+	for i := 0; i < h; i++ {
+		n.next[i].Store(prev[i].next[i].Load())
+		prev[i].next[i].Store(n)
+	}
+
+	t.size.Add(int64(len(key) + len(val) + nodeOverhead))
+	t.count.Add(1)
+	// publish last so cursors opened after this see the entry
+	t.seq.Store(seq)
+}
+
+// first node >= key at version seq
+func (t *Table) seek(key []byte, seq uint64) *node {
+	x := t.head
+	for i := int(t.height.Load()) - 1; i >= 0; i-- {
+		for {
+			next := x.next[i].Load()
+			if next == nil || compare(next, key, seq) >= 0 {
+				break
+			}
+			x = next
+		}
+	}
+	return x.next[0].Load()
+}
+
+// last node with a key < key. nil if none
+func (t *Table) lessThan(key []byte) *node {
+	x := t.head
+	for i := int(t.height.Load()) - 1; i >= 0; i-- {
+		for {
+			next := x.next[i].Load()
+			if next == nil || bytes.Compare(next.key, key) >= 0 {
+				break
+			}
+			x = next
+		}
+	}
+	if x == t.head {
+		return nil
+	}
+	return x
+}
+
+// last node in list. nil if empty
+func (t *Table) last() *node {
+	x := t.head
+	for i := int(t.height.Load()) - 1; i >= 0; i-- {
+		for {
+			next := x.next[i].Load()
+			if next == nil {
+				break
+			}
+			x = next
+		}
+	}
+	if x == t.head {
+		return nil
+	}
+	return x
+}
+
+// cursor sees all writes made before it was opened and none after
+func (t *Table) Cursor() *Cursor {
+	return t.CursorAt(t.seq.Load())
+}
+
+// cursor that sees writes up to and including sequence seq
+func (t *Table) CursorAt(seq uint64) *Cursor {
+	// later writes with a lower sequence can't exist but
+	// ones above seq could arrive while the cursor is open
+	if last := t.seq.Load(); seq > last {
+		seq = last
+	}
+	return &Cursor{
+		t:   t,
+		seq: seq,
+	}
+}
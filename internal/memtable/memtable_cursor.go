@@ -0,0 +1,116 @@
+package memtable
+
+import (
+	"bytes"
+
+	"github.com/stangelandcl/teepeedb/internal/reader"
+	"github.com/stangelandcl/teepeedb/internal/shared"
+)
+
+// cursor over the newest version of each key as of when it was opened.
+// same interface as reader.Cursor so both can be merged
+type Cursor struct {
+	t   *Table
+	n   *node
+	seq uint64
+}
+
+func (c *Cursor) Key() ([]byte, bool) {
+	return c.n.key, c.n.delete
+}
+
+func (c *Cursor) Value() []byte {
+	return c.n.value
+}
+
+// sequence of the version Key and Value return
+func (c *Cursor) Sequence() uint64 {
+	return c.n.seq
+}
+
+// every version of the current key visible to the cursor newest
+// first. appended to dst
+func (c *Cursor) Versions(dst []shared.Version) []shared.Version {
+	for n := c.n; n != nil && bytes.Equal(n.key, c.n.key); n = n.next[0].Load() {
+		dst = append(dst, shared.Version{Seq: n.seq, Value: n.value, Delete: n.delete})
+	}
+	return dst
+}
+
+// memtables are in memory and can't fail
+func (c *Cursor) Err() error {
+	return nil
+}
+
+// skip versions newer than cursor. first version found in forward order
+// is the newest visible version of that key
+func (c *Cursor) settle(n *node) bool {
+	for n != nil && n.seq > c.seq {
+		n = n.next[0].Load()
+	}
+	if n == nil {
+		return false
+	}
+	c.n = n
+	return true
+}
+
+func (c *Cursor) First() bool {
+	return c.settle(c.t.head.next[0].Load())
+}
+
+func (c *Cursor) Last() bool {
+	n := c.t.last()
+	if n == nil {
+		return false
+	}
+	return c.before(n.key, true)
+}
+
+func (c *Cursor) Next() bool {
+	key := c.n.key
+	n := c.n.next[0].Load()
+	for n != nil && bytes.Equal(n.key, key) {
+		n = n.next[0].Load()
+	}
+	return c.settle(n)
+}
+
+func (c *Cursor) Previous() bool {
+	return c.before(c.n.key, false)
+}
+
+// move to newest visible version of the greatest key < key
+// or <= key if inclusive
+func (c *Cursor) before(key []byte, inclusive bool) bool {
+	if !inclusive {
+		n := c.t.lessThan(key)
+		if n == nil {
+			return false
+		}
+		key = n.key
+	}
+	for {
+		n := c.t.seek(key, c.seq)
+		if n != nil && bytes.Equal(n.key, key) {
+			c.n = n
+			return true
+		}
+		// every version of key is newer than cursor
+		n = c.t.lessThan(key)
+		if n == nil {
+			return false
+		}
+		key = n.key
+	}
+}
+
+func (c *Cursor) Find(key []byte) reader.FindResult {
+	if !c.settle(c.t.seek(key, c.seq)) {
+		return reader.NotFound
+	}
+	if bytes.Equal(c.n.key, key) {
+		return reader.Found
+	}
+	return reader.FoundGreater
+}
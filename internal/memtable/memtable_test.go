@@ -0,0 +1,89 @@
+package memtable
+
+import (
+	"encoding/binary"
+	"log"
+	"math/rand"
+	"testing"
+
+	"github.com/stangelandcl/teepeedb/internal/reader"
+)
+
+func TestTable(t *testing.T) {
+	tbl := New()
+	count := 100_000
+	ids := rand.Perm(count)
+	for _, id := range ids {
+		k := binary.BigEndian.AppendUint32(nil, uint32(id))
+		tbl.Put(k, k, false)
+	}
+	c := tbl.Cursor()
+
+	// overwrite and delete after cursor opened. cursor must not see these
+	for i := 0; i < count; i += 3 {
+		k := binary.BigEndian.AppendUint32(nil, uint32(i))
+		if i%2 == 0 {
+			tbl.Put(k, nil, true)
+		} else {
+			tbl.Put(k, []byte{1}, false)
+		}
+	}
+
+	i := 0
+	for more := c.First(); more; more = c.Next() {
+		key, delete := c.Key()
+		k := binary.BigEndian.Uint32(key)
+		v := binary.BigEndian.Uint32(c.Value())
+		if int(k) != i || int(v) != i || delete {
+			log.Panicln("forward", i, k, v, delete)
+		}
+		i++
+	}
+	if i != count {
+		log.Panicln("count", i)
+	}
+
+	for more := c.Last(); more; more = c.Previous() {
+		i--
+		key, _ := c.Key()
+		k := binary.BigEndian.Uint32(key)
+		if int(k) != i {
+			log.Panicln("backward", i, k)
+		}
+	}
+	if i != 0 {
+		log.Panicln("backward count", i)
+	}
+
+	c = tbl.Cursor()
+	for i := 0; i < count; i++ {
+		k := binary.BigEndian.AppendUint32(nil, uint32(i))
+		if c.Find(k) != reader.Found {
+			log.Panicln("find", i)
+		}
+		_, delete := c.Key()
+		v := c.Value()
+		switch {
+		case i%3 != 0:
+			if delete || int(binary.BigEndian.Uint32(v)) != i {
+				log.Panicln("find value", i)
+			}
+		case i%2 == 0:
+			if !delete {
+				log.Panicln("find delete", i)
+			}
+		default:
+			if delete || len(v) != 1 {
+				log.Panicln("find update", i)
+			}
+		}
+	}
+
+	k := binary.BigEndian.AppendUint32(nil, uint32(count))
+	if c.Find(k) != reader.NotFound {
+		log.Panicln("find past end")
+	}
+	if c.Find([]byte{0, 0, 0}) != reader.FoundGreater {
+		log.Panicln("find greater")
+	}
+}
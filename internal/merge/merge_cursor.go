@@ -2,18 +2,173 @@ package merge
 
 import (
 	"bytes"
+	"sort"
 
 	"github.com/stangelandcl/teepeedb/internal/reader"
+	"github.com/stangelandcl/teepeedb/internal/shared"
 )
 
+// sorted key-value source that can be merged with others.
+// implemented by reader.Cursor and memtable.Cursor
+type Source interface {
+	First() bool
+	Last() bool
+	Next() bool
+	Previous() bool
+	Find(key []byte) reader.FindResult
+	Key() ([]byte, bool)
+	Value() []byte
+	// error that stopped the source. moves return false once set
+	Err() error
+}
+
+// source that can rule out a key without reading any blocks
+type filter interface {
+	MayContain(key []byte) bool
+}
+
+// source that can skip files and blocks outside of bounds.
+// returns false if no key in the source can be inside bounds
+type bounded interface {
+	SetBounds(lower, upper []byte, inclusive bool) bool
+}
+
+// source whose values can be value log pointers
+type pointer interface {
+	Pointer() bool
+}
+
+// source that can skip versions newer than a sequence.
+// returns false if every version in the source is newer
+type versioned interface {
+	SetAsOf(seq uint64) bool
+}
+
+// source that keeps older versions of a key
+type history interface {
+	Versions(dst []shared.Version) []shared.Version
+}
+
+// source whose values can be merge operands
+type operand interface {
+	Merge() bool
+}
+
+// source whose entries can expire. unix nanosecond time the current
+// version expires at, 0 if never
+type expiring interface {
+	Expires() int64
+}
+
+// source with range tombstones that hide keys in older sources
+type ranged interface {
+	Tombstones() []shared.Tombstone
+}
+
 type Cursor struct {
 	reader  *Reader
-	cursors []*reader.Cursor
+	cursors []Source
 	heap    heap
 	closed  bool
 	last    []byte
 	Key     []byte
 	Delete  bool
+	// cursors Find skipped because their filter ruled out the key.
+	// positioned on the next move
+	skipped []int
+	// first error from a source. cursor stops once set
+	err error
+	// keys outside of bounds are never returned. nil is unbounded
+	lower, upper []byte
+	inclusive    bool
+	// heap entries on Key sorted newest first for Versions
+	same []int
+	// folds merge operands in Value. versions newer than asOf aren't
+	// folded
+	op      Operator
+	resolve Resolver
+	asOf    uint64
+	// unix nanosecond time entries expired by are read as deleted
+	now      int64
+	versions []shared.Version
+	operands [][]byte
+	// range tombstones of every source. loaded on first use once
+	// sources can no longer be dropped
+	tombstones []tombstone
+	loaded     bool
+}
+
+// fold merge operands with op in Value. resolve reads values under
+// them that are value log pointers. call before any other cursor function
+func (c *Cursor) SetMergeOperator(op Operator, resolve Resolver) {
+	c.op = op
+	c.resolve = resolve
+}
+
+// read entries expired by unix nanosecond time now as deleted. Reader
+// sets it to the time the cursor was opened. call before any move
+func (c *Cursor) SetNow(now int64) {
+	c.now = now
+}
+
+// limit cursor to keys >= lower and < upper or <= upper if inclusive.
+// nil lower or upper is unbounded. sources entirely outside of bounds
+// are dropped. call before any other cursor function
+func (c *Cursor) SetBounds(lower, upper []byte, inclusive bool) {
+	if lower != nil {
+		c.lower = append([]byte{}, lower...)
+	}
+	if upper != nil {
+		c.upper = append([]byte{}, upper...)
+	}
+	c.inclusive = inclusive
+	cursors := c.cursors[:0]
+	for _, cur := range c.cursors {
+		// range tombstones outside of bounds can still hide keys inside
+		if b, ok := cur.(bounded); ok && !b.SetBounds(c.lower, c.upper, inclusive) && !hasTombstones(cur) {
+			continue
+		}
+		cursors = append(cursors, cur)
+	}
+	c.cursors = cursors
+}
+
+// read versions as of sequence seq. sources with only newer versions
+// are dropped. call before any other cursor function
+func (c *Cursor) SetAsOf(seq uint64) {
+	c.asOf = seq
+	cursors := c.cursors[:0]
+	for _, cur := range c.cursors {
+		if v, ok := cur.(versioned); ok && !v.SetAsOf(seq) && !hasTombstones(cur) {
+			continue
+		}
+		cursors = append(cursors, cur)
+	}
+	c.cursors = cursors
+}
+
+func (c *Cursor) inBounds(key []byte) bool {
+	if c.lower != nil && bytes.Compare(key, c.lower) < 0 {
+		return false
+	}
+	if c.upper != nil {
+		cmp := bytes.Compare(key, c.upper)
+		return cmp < 0 || cmp == 0 && c.inclusive
+	}
+	return true
+}
+
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// record source error. true if cur failed
+func (c *Cursor) failed(cur Source) bool {
+	err := cur.Err()
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return err != nil
 }
 
 func (c *Cursor) Close() {
@@ -33,7 +188,17 @@ func (c *Cursor) Last() bool {
 }
 
 func (c *Cursor) end(order int) (more bool) {
+	if c.err != nil {
+		return false
+	}
+	if order == 1 && c.lower != nil {
+		return c.Find(c.lower) != reader.NotFound
+	}
+	if order == -1 && c.upper != nil {
+		return c.seekLast()
+	}
 	c.heap.Values = c.heap.Values[:0]
+	c.skipped = c.skipped[:0]
 	for i, cur := range c.cursors {
 		key := Position{
 			Cursor: cur,
@@ -49,15 +214,47 @@ func (c *Cursor) end(order int) (more bool) {
 		if found {
 			key.Key, key.Delete = key.Cursor.Key()
 			c.heap.Values = append(c.heap.Values, key)
+		} else if c.failed(cur) {
+			return false
 		}
 	}
 	if len(c.heap.Values) == 0 {
 		return false
 	}
 	c.heap.Init(order)
+	c.set(&c.heap.Values[0])
+	return true
+}
+
+// position every cursor on its last key inside upper
+func (c *Cursor) seekLast() bool {
+	c.heap.Values = c.heap.Values[:0]
+	c.skipped = c.skipped[:0]
+	for i, cur := range c.cursors {
+		var found bool
+		switch cur.Find(c.upper) {
+		case reader.NotFound:
+			found = cur.Err() == nil && cur.Last()
+		case reader.Found:
+			found = c.inclusive || cur.Previous()
+		default:
+			found = cur.Previous()
+		}
+		if found {
+			c.push(i)
+		} else if c.failed(cur) {
+			return false
+		}
+	}
+	if len(c.heap.Values) == 0 {
+		return false
+	}
+	c.heap.Init(-1)
 	key := &c.heap.Values[0]
-	c.Key = key.Key
-	c.Delete = key.Delete
+	if !c.inBounds(key.Key) {
+		return false
+	}
+	c.set(key)
 	return true
 }
 
@@ -70,6 +267,17 @@ func (c *Cursor) Previous() bool {
 }
 
 func (c *Cursor) move(order int) (more bool) {
+	if c.err != nil || len(c.heap.Values) == 0 {
+		return false
+	}
+	if order != c.heap.Order {
+		c.reposition(order)
+	} else if len(c.skipped) > 0 {
+		c.unskip()
+	}
+	if c.err != nil {
+		return false
+	}
 	next := order == 1
 	c.last = append(c.last[:0], c.heap.Values[0].Key...)
 	key := &c.heap.Values[0]
@@ -91,6 +299,9 @@ func (c *Cursor) move(order int) (more bool) {
 				break
 			}
 		} else {
+			if c.failed(key.Cursor) {
+				return false
+			}
 			// this cursor is at its iteration endpoint
 			c.heap.Pop()
 			if len(c.heap.Values) == 0 {
@@ -103,44 +314,234 @@ func (c *Cursor) move(order int) (more bool) {
 		}
 	}
 
-	c.Key = key.Key
-	c.Delete = key.Delete
+	// stop at bound without reading further
+	if !c.inBounds(key.Key) {
+		return false
+	}
+	c.set(key)
 	return true
 }
 
 // returns Found for exact match
 // Partial for found a value greater than key.
 // NotFound for no values >= key
+// cursors whose filter rules out key are not positioned unless
+// no exact match is found
 func (c *Cursor) Find(find []byte) reader.FindResult {
 	c.heap.Values = c.heap.Values[:0]
+	c.skipped = c.skipped[:0]
+	if c.err != nil {
+		return reader.NotFound
+	}
+	key := find
+	if c.lower != nil && bytes.Compare(find, c.lower) < 0 {
+		find = c.lower
+	}
 	for i, cur := range c.cursors {
-		key := Position{
-			Cursor: cur,
-			Index:  i,
+		if f, ok := cur.(filter); ok && !f.MayContain(find) {
+			c.skipped = append(c.skipped, i)
+			continue
 		}
-		found := key.Cursor.Find(find)
-		if found > 0 {
-			key.Key, key.Delete = key.Cursor.Key()
-			c.heap.Values = append(c.heap.Values, key)
+		if cur.Find(find) != reader.NotFound {
+			c.push(i)
+		} else if c.failed(cur) {
+			c.heap.Values = c.heap.Values[:0]
+			return reader.NotFound
 		}
 	}
 
 	c.heap.Init(1)
+	if len(c.skipped) > 0 &&
+		(len(c.heap.Values) == 0 || !bytes.Equal(c.heap.Values[0].Key, find)) {
+		// the next greater key could be in any file
+		for _, i := range c.skipped {
+			if c.cursors[i].Find(find) != reader.NotFound {
+				c.push(i)
+			} else if c.failed(c.cursors[i]) {
+				c.heap.Values = c.heap.Values[:0]
+				return reader.NotFound
+			}
+		}
+		c.skipped = c.skipped[:0]
+		c.heap.Init(1)
+	}
 	if len(c.heap.Values) == 0 {
 		return reader.NotFound
 	}
 
 	v := &c.heap.Values[0]
-	found := bytes.Equal(v.Key, find)
+	if !c.inBounds(v.Key) {
+		return reader.NotFound
+	}
+	found := bytes.Equal(v.Key, key)
 	rs := reader.FoundGreater
 	if found {
 		rs = reader.Found
 	}
-	c.Key = v.Key
-	c.Delete = v.Delete
+	c.set(v)
 	return rs
 }
 
+// position p is the current key. deleted if it expired or a range
+// tombstone as of asOf in a newer source covers it
+func (c *Cursor) set(p *Position) {
+	c.Key = p.Key
+	c.Delete = p.Delete || c.expired(p) || c.covered(p.Key, p.Index)
+}
+
+// append positioned cursor i to heap without fixing heap order
+func (c *Cursor) push(i int) {
+	cur := c.cursors[i]
+	key := Position{
+		Cursor: cur,
+		Index:  i,
+	}
+	key.Key, key.Delete = cur.Key()
+	c.heap.Values = append(c.heap.Values, key)
+}
+
+// position cursor i on the first key after c.Key in order
+func (c *Cursor) after(i int, order int) bool {
+	cur := c.cursors[i]
+	rs := cur.Find(c.Key)
+	if order == 1 {
+		if rs == reader.Found {
+			return cur.Next()
+		}
+		return rs != reader.NotFound
+	}
+	if rs == reader.NotFound {
+		return cur.Last()
+	}
+	return cur.Previous()
+}
+
+// position cursors skipped by Find. moving forward from the found key
+func (c *Cursor) unskip() {
+	for _, i := range c.skipped {
+		if c.after(i, 1) {
+			c.push(i)
+			c.heap.up(len(c.heap.Values) - 1)
+		} else if c.failed(c.cursors[i]) {
+			break
+		}
+	}
+	c.skipped = c.skipped[:0]
+}
+
+// change direction. every cursor except the current one is positioned
+// on the first key past the current key in the new direction
+func (c *Cursor) reposition(order int) {
+	top := c.heap.Values[0]
+	c.heap.Values = append(c.heap.Values[:0], top)
+	for i := range c.cursors {
+		if i == top.Index {
+			continue
+		}
+		if c.after(i, order) {
+			c.push(i)
+		} else if c.failed(c.cursors[i]) {
+			break
+		}
+	}
+	c.skipped = c.skipped[:0]
+	c.heap.Init(order)
+}
+
+// Value() is a value log pointer and not the value itself
+func (c *Cursor) Pointer() bool {
+	p, ok := c.heap.Values[0].Cursor.(pointer)
+	return ok && p.Pointer()
+}
+
+// Key's value is a merge operand. Value returns it folded with the
+// older versions of Key
+func (c *Cursor) Merge() bool {
+	m, ok := c.heap.Values[0].Cursor.(operand)
+	return ok && m.Merge()
+}
+
+// returns nil and sets Err() if the value can't be read
 func (c *Cursor) Value() []byte {
-	return c.heap.Values[0].Cursor.Value()
+	if c.Merge() {
+		return c.fold()
+	}
+	cur := c.heap.Values[0].Cursor
+	v := cur.Value()
+	if v == nil {
+		c.failed(cur)
+	}
+	return v
+}
+
+// merge operands on Key applied to the version under them
+func (c *Cursor) fold() []byte {
+	if c.op == nil {
+		c.fail(errNoOperator)
+		return nil
+	}
+	c.versions = c.Versions(c.versions[:0])
+	if c.err != nil {
+		return nil
+	}
+	visible := c.versions[:0]
+	for _, v := range c.versions {
+		if v.Seq <= c.asOf {
+			visible = append(visible, expire(v, c.now))
+		}
+	}
+	v, _, err := fold(c.op, c.resolve, c.Key, visible, &c.operands, false)
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	return v
+}
+
+func (c *Cursor) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// every version of Key in every source newest first, appended to dst.
+// sources Find skipped can't hold Key. sets Err() on failure
+func (c *Cursor) Versions(dst []shared.Version) []shared.Version {
+	c.same = c.same[:0]
+	for i := range c.heap.Values {
+		if bytes.Equal(c.heap.Values[i].Key, c.Key) {
+			c.same = append(c.same, i)
+		}
+	}
+	// lower index is a newer source
+	sort.Slice(c.same, func(i, j int) bool {
+		return c.heap.Values[c.same[i]].Index < c.heap.Values[c.same[j]].Index
+	})
+	// range tombstones in sources newer than the first are before it
+	from := 0
+	for _, i := range c.same {
+		v := &c.heap.Values[i]
+		dst = c.hidden(dst, from, v.Index)
+		from = v.Index
+		if h, ok := v.Cursor.(history); ok {
+			dst = h.Versions(dst)
+		} else {
+			p, ok := v.Cursor.(pointer)
+			m, isOperand := v.Cursor.(operand)
+			version := shared.Version{
+				Value:   v.Cursor.Value(),
+				Delete:  v.Delete,
+				Pointer: ok && p.Pointer(),
+				Merge:   isOperand && m.Merge(),
+			}
+			if e, ok := v.Cursor.(expiring); ok {
+				version.Expires = e.Expires()
+			}
+			dst = append(dst, version)
+		}
+		if c.failed(v.Cursor) {
+			return dst
+		}
+	}
+	return dst
 }
@@ -0,0 +1,24 @@
+package merge
+
+import (
+	"github.com/stangelandcl/teepeedb/internal/shared"
+)
+
+// true if the entry at p expired by now
+func (c *Cursor) expired(p *Position) bool {
+	e, ok := p.Cursor.(expiring)
+	if !ok {
+		return false
+	}
+	expires := e.Expires()
+	c.failed(p.Cursor)
+	return expires != 0 && expires <= c.now
+}
+
+// v as a delete if it expired by unix nanosecond time now
+func expire(v shared.Version, now int64) shared.Version {
+	if v.Expired(now) {
+		return shared.Version{Seq: v.Seq, Delete: true}
+	}
+	return v
+}
@@ -36,13 +36,11 @@ package merge
 
 import (
 	"bytes"
-
-	"github.com/stangelandcl/teepeedb/internal/reader"
 )
 
 type Position struct {
 	Key    []byte
-	Cursor *reader.Cursor
+	Cursor Source
 	Index  int
 	Delete bool
 }
@@ -0,0 +1,239 @@
+package merge
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/stangelandcl/teepeedb/internal/reader"
+	"github.com/stangelandcl/teepeedb/internal/shared"
+)
+
+// source over a level of files with disjoint key ranges in key order.
+// only the file covering a key is read so a level is one source however
+// many files it has. cursors on files are opened on first use
+type levelCursor struct {
+	files []*reader.File
+	// key range of each file. references the files' pinned index
+	first, last [][]byte
+	cursors     []*reader.Cursor
+	// files lo to hi overlap the bounds
+	lo, hi int
+	// current file. -1 before the first move
+	cur          int
+	lower, upper []byte
+	inclusive    bool
+	asOf         uint64
+	asOfSet      bool
+	err          error
+	// range tombstones of every file including empty ones
+	tombstones []shared.Tombstone
+}
+
+// files sorted by key with disjoint ranges. empty files are skipped
+func newLevelCursor(files []*reader.File) *levelCursor {
+	c := &levelCursor{cur: -1}
+	for _, f := range files {
+		c.tombstones = append(c.tombstones, f.Tombstones()...)
+		first, last := f.Range()
+		if first == nil {
+			continue
+		}
+		c.files = append(c.files, f)
+		c.first = append(c.first, first)
+		c.last = append(c.last, last)
+	}
+	c.cursors = make([]*reader.Cursor, len(c.files))
+	c.hi = len(c.files)
+	return c
+}
+
+// range tombstones of the level. they hide keys in older levels
+func (c *levelCursor) Tombstones() []shared.Tombstone {
+	return c.tombstones
+}
+
+// cursor on file i
+func (c *levelCursor) cursor(i int) *reader.Cursor {
+	if c.cursors[i] == nil {
+		cur := c.files[i].Cursor()
+		cur.SetBounds(c.lower, c.upper, c.inclusive)
+		if c.asOfSet {
+			cur.SetAsOf(c.asOf)
+		}
+		c.cursors[i] = cur
+	}
+	return c.cursors[i]
+}
+
+// true if file i's cursor failed
+func (c *levelCursor) failed(i int) bool {
+	err := c.cursors[i].Err()
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return err != nil
+}
+
+// first file from lo whose last key is >= key
+func (c *levelCursor) search(key []byte) int {
+	return c.lo + sort.Search(c.hi-c.lo, func(i int) bool {
+		return bytes.Compare(c.last[c.lo+i], key) >= 0
+	})
+}
+
+func (c *levelCursor) SetBounds(lower, upper []byte, inclusive bool) bool {
+	c.lower = lower
+	c.upper = upper
+	c.inclusive = inclusive
+	if lower != nil {
+		c.lo = c.search(lower)
+	}
+	if upper != nil {
+		c.hi = c.lo + sort.Search(len(c.files)-c.lo, func(i int) bool {
+			cmp := bytes.Compare(c.first[c.lo+i], upper)
+			return cmp > 0 || cmp == 0 && !inclusive
+		})
+	}
+	return c.lo < c.hi
+}
+
+func (c *levelCursor) SetAsOf(seq uint64) bool {
+	c.asOf = seq
+	c.asOfSet = true
+	for i := c.lo; i < c.hi; i++ {
+		if c.files[i].Footer().MinSequence <= seq {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *levelCursor) MayContain(key []byte) bool {
+	i := c.search(key)
+	return i < c.hi && bytes.Compare(c.first[i], key) <= 0 && c.files[i].MayContain(key)
+}
+
+func (c *levelCursor) First() bool {
+	return c.forward(c.lo, false)
+}
+
+func (c *levelCursor) Last() bool {
+	return c.backward(c.hi-1, false)
+}
+
+func (c *levelCursor) Next() bool {
+	if c.err != nil || c.cur < 0 {
+		return false
+	}
+	return c.forward(c.cur, true)
+}
+
+func (c *levelCursor) Previous() bool {
+	if c.err != nil || c.cur < 0 {
+		return false
+	}
+	return c.backward(c.cur, true)
+}
+
+// move to the next entry in file i or the first of a later file
+func (c *levelCursor) forward(i int, next bool) bool {
+	for ; i < c.hi; i++ {
+		cur := c.cursor(i)
+		var found bool
+		if next {
+			found = cur.Next()
+		} else {
+			found = cur.First()
+		}
+		if found {
+			c.cur = i
+			return true
+		}
+		if c.failed(i) {
+			return false
+		}
+		next = false
+	}
+	return false
+}
+
+// move to the previous entry in file i or the last of an earlier file
+func (c *levelCursor) backward(i int, previous bool) bool {
+	for ; i >= c.lo; i-- {
+		cur := c.cursor(i)
+		var found bool
+		if previous {
+			found = cur.Previous()
+		} else {
+			found = cur.Last()
+		}
+		if found {
+			c.cur = i
+			return true
+		}
+		if c.failed(i) {
+			return false
+		}
+		previous = false
+	}
+	return false
+}
+
+func (c *levelCursor) Find(key []byte) reader.FindResult {
+	if c.err != nil {
+		return reader.NotFound
+	}
+	i := c.search(key)
+	if i >= c.hi {
+		return reader.NotFound
+	}
+	rs := c.cursor(i).Find(key)
+	if rs != reader.NotFound {
+		c.cur = i
+		return rs
+	}
+	if c.failed(i) {
+		return reader.NotFound
+	}
+	// every entry in file i was too new or outside bounds
+	if c.forward(i+1, false) {
+		return reader.FoundGreater
+	}
+	return reader.NotFound
+}
+
+func (c *levelCursor) Key() ([]byte, bool) {
+	return c.cursors[c.cur].Key()
+}
+
+func (c *levelCursor) Value() []byte {
+	v := c.cursors[c.cur].Value()
+	if v == nil {
+		c.failed(c.cur)
+	}
+	return v
+}
+
+func (c *levelCursor) Pointer() bool {
+	return c.cursors[c.cur].Pointer()
+}
+
+func (c *levelCursor) Merge() bool {
+	return c.cursors[c.cur].Merge()
+}
+
+func (c *levelCursor) Expires() int64 {
+	expires := c.cursors[c.cur].Expires()
+	c.failed(c.cur)
+	return expires
+}
+
+func (c *levelCursor) Versions(dst []shared.Version) []shared.Version {
+	dst = c.cursors[c.cur].Versions(dst)
+	c.failed(c.cur)
+	return dst
+}
+
+func (c *levelCursor) Err() error {
+	return c.err
+}
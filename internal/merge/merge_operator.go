@@ -0,0 +1,60 @@
+package merge
+
+import (
+	"errors"
+
+	"github.com/stangelandcl/teepeedb/internal/shared"
+)
+
+// combines merge operands with the value under them.
+// see teepeedb.MergeOperator
+type Operator interface {
+	Merge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// value a value log pointer points to
+type Resolver func(pointer []byte) ([]byte, error)
+
+var errNoOperator = errors.New("teepeedb: merge operand read without a merge operator")
+
+// apply the merge operands at the start of versions, newest first, oldest
+// first onto the version under them. a delete or no version is no
+// value. false if the version under them is needed but missing or it is
+// a pointer and resolve is nil. operands is reused between calls
+func fold(op Operator, resolve Resolver, key []byte, versions []shared.Version, operands *[][]byte, needBase bool) ([]byte, bool, error) {
+	*operands = (*operands)[:0]
+	i := 0
+	for ; i < len(versions) && versions[i].Merge; i++ {
+		*operands = append(*operands, versions[i].Value)
+	}
+	ops := *operands
+	for l, r := 0, len(ops)-1; l < r; l, r = l+1, r-1 {
+		ops[l], ops[r] = ops[r], ops[l]
+	}
+
+	var existing []byte
+	if i == len(versions) && needBase {
+		return nil, false, nil
+	}
+	if i < len(versions) && !versions[i].Delete {
+		existing = versions[i].Value
+		if versions[i].Pointer {
+			if resolve == nil {
+				return nil, false, nil
+			}
+			var err error
+			existing, err = resolve(existing)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	v, err := op.Merge(key, existing, ops)
+	if err != nil {
+		return nil, false, err
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v, true, nil
+}
@@ -2,56 +2,162 @@ package merge
 
 import (
 	"fmt"
+	"math"
+	"os"
 	"sync/atomic"
+	"time"
 
+	"github.com/stangelandcl/teepeedb/internal/cache"
 	"github.com/stangelandcl/teepeedb/internal/reader"
 	"github.com/stangelandcl/teepeedb/internal/shared"
 )
 
 type Reader struct {
-	files    []*reader.File
+	files []*reader.File
+	// files grouped by level newest first. a level with more than one
+	// file has disjoint key ranges in key order and is read as one source
+	levels   [][]*reader.File
 	refcount int64
+	// nil if blocks aren't cached
+	cache *cache.Cache
 }
 
 type Stats struct {
 	Footers []shared.FileFooter
+	// file of each footer
+	Filenames []string
 }
 
 // files in sorted order. newest first
 func NewReader(files []string) (*Reader, error) {
-	r := &Reader{refcount: 1}
-	for _, f := range files {
-		fr, err := reader.NewFile(f)
-		if err != nil {
-			for _, f := range r.files {
-				f.Close()
+	return NewCachedReader(files, nil)
+}
+
+// NewReader that shares blocks with other readers through c.
+// nil c disables caching
+func NewCachedReader(files []string, c *cache.Cache) (*Reader, error) {
+	return newReader(split(files), c, nil)
+}
+
+// reader on levels of files newest first. files in a level have
+// disjoint key ranges in key order and only the one covering a key is
+// read. each level 0 file is its own level. nil c disables caching
+func NewLevelReader(levels [][]string, c *cache.Cache) (*Reader, error) {
+	return newReader(levels, c, nil)
+}
+
+// each file in its own level
+func split(files []string) [][]string {
+	levels := make([][]string, len(files))
+	for i, f := range files {
+		levels[i] = []string{f}
+	}
+	return levels
+}
+
+// NewLevelReader that reuses files r already has open so blocks
+// cached from them are still found. r is unchanged
+func (r *Reader) Reopen(levels [][]string) (*Reader, error) {
+	if !r.Retain() {
+		return newReader(levels, r.cache, nil)
+	}
+	defer r.Close()
+	return newReader(levels, r.cache, r.files)
+}
+
+func newReader(levels [][]string, c *cache.Cache, open []*reader.File) (*Reader, error) {
+	r := &Reader{refcount: 1, cache: c}
+	for _, level := range levels {
+		var files []*reader.File
+		for _, f := range level {
+			fr, err := reuse(f, open)
+			if fr == nil && err == nil {
+				fr, err = reader.NewFile(f)
+				if err == nil {
+					fr.SetCache(c)
+				}
+			}
+			if err != nil {
+				for _, f := range r.files {
+					f.Close()
+				}
+				return nil, fmt.Errorf("teepeedb: merge reader error opening %v: %w", f, err)
 			}
-			return nil, fmt.Errorf("teepeedb: merge reader error opening %v: %v", f, err)
+			r.files = append(r.files, fr)
+			files = append(files, fr)
+		}
+		if len(files) > 0 {
+			r.levels = append(r.levels, files)
 		}
-		r.files = append(r.files, fr)
 	}
 	return r, nil
 }
 
+// open file with filename or nil if none. a merge can rename
+// a new file over an old name so the name alone isn't enough
+func reuse(filename string, open []*reader.File) (*reader.File, error) {
+	if len(open) == 0 {
+		return nil, nil
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range open {
+		if f.Filename() == filename && f.SameFile(fi) {
+			f.Retain()
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
 func (r *Reader) Stats() Stats {
 	s := Stats{}
 	for _, file := range r.files {
 		s.Footers = append(s.Footers, file.Footer())
+		s.Filenames = append(s.Filenames, file.Filename())
 	}
 	return s
 }
 
-func (r *Reader) Cursor() *Cursor {
+// add a user that calls Close once. false if already closed
+func (r *Reader) Retain() bool {
+	if atomic.AddInt64(&r.refcount, 1) <= 1 {
+		atomic.AddInt64(&r.refcount, -1)
+		return false
+	}
+	return true
+}
+
+// true if the reader has file fi open under any name
+func (r *Reader) Has(fi os.FileInfo) bool {
+	for _, f := range r.files {
+		if f.SameFile(fi) {
+			return true
+		}
+	}
+	return false
+}
+
+// newer are sources with data newer than any file such as memtables.
+// newest first
+func (r *Reader) Cursor(newer ...Source) *Cursor {
 	c := &Cursor{
 		reader: r,
+		asOf:   math.MaxUint64,
+		now:    time.Now().UnixNano(),
 	}
-	if atomic.AddInt64(&r.refcount, 1) <= 1 {
-		atomic.AddInt64(&r.refcount, -1)
+	if !r.Retain() {
 		return c // already closed
 	}
-	for _, f := range r.files {
-		cur := f.Cursor()
-		c.cursors = append(c.cursors, cur)
+	c.cursors = append(c.cursors, newer...)
+	for _, level := range r.levels {
+		if len(level) == 1 {
+			c.cursors = append(c.cursors, level[0].Cursor())
+		} else {
+			c.cursors = append(c.cursors, newLevelCursor(level))
+		}
 	}
 	return c
 }
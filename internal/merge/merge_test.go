@@ -1,6 +1,8 @@
 package merge
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"log"
@@ -11,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stangelandcl/teepeedb/internal/cache"
 	"github.com/stangelandcl/teepeedb/internal/reader"
 	"github.com/stangelandcl/teepeedb/internal/shared"
 	"github.com/stangelandcl/teepeedb/internal/writer"
@@ -28,7 +31,7 @@ func TestNoOverlap(t *testing.T) {
 	os.RemoveAll("test.new.db")
 	os.RemoveAll("test.db")
 	os.RemoveAll("test.db.tmp")
-	w := E(writer.NewFile("test.old.db", 16384))
+	w := E(writer.NewFile("test.old.db", 16384, 10))
 
 	count := 100_000
 	kv := shared.KV{}
@@ -45,7 +48,7 @@ func TestNoOverlap(t *testing.T) {
 	w.Commit()
 	w.Close()
 
-	w = E(writer.NewFile("test.new.db", 16384))
+	w = E(writer.NewFile("test.new.db", 16384, 10))
 
 	var err error
 	count = 100_000
@@ -63,11 +66,11 @@ func TestNoOverlap(t *testing.T) {
 	w.Commit()
 	w.Close()
 
-	m, err := NewMerger("test.db", []string{"test.new.db", "test.old.db"}, true, 16384)
+	m, err := NewMerger("test.db", []string{"test.new.db", "test.old.db"}, true, 16384, 10)
 	if err != nil {
 		panic(err)
 	}
-	err = m.Run()
+	err = m.Run(context.Background())
 	if err != nil {
 		panic(err)
 	}
@@ -77,7 +80,7 @@ func TestNoOverlap(t *testing.T) {
 	}
 	m.Close()
 
-	w = E(writer.NewFile("test.new.db", 16384))
+	w = E(writer.NewFile("test.new.db", 16384, 10))
 	count = 100_000
 	kv = shared.KV{}
 	for i := count * 10; i < count*11; i++ {
@@ -93,11 +96,11 @@ func TestNoOverlap(t *testing.T) {
 	w.Commit()
 	w.Close()
 
-	m, err = NewMerger("test.db", []string{"test.new.db"}, true, 16384)
+	m, err = NewMerger("test.db", []string{"test.new.db"}, true, 16384, 10)
 	if err != nil {
 		panic(err)
 	}
-	err = m.Run()
+	err = m.Run(context.Background())
 	if err != nil {
 		panic(err)
 	}
@@ -133,7 +136,7 @@ func TestMerge(t *testing.T) {
 	os.RemoveAll("test.old.db")
 	os.RemoveAll("test.new.db")
 	os.RemoveAll("test.db")
-	w := E(writer.NewFile("test.old.db", 16384))
+	w := E(writer.NewFile("test.old.db", 16384, 10))
 
 	var err error
 	tm := time.Now()
@@ -160,7 +163,7 @@ func TestMerge(t *testing.T) {
 	}
 	fmt.Println("wrote", count, "in", time.Since(tm))
 
-	w = E(writer.NewFile("test.new.db", 16384))
+	w = E(writer.NewFile("test.new.db", 16384, 10))
 
 	tm = time.Now()
 	for i := 0; i < 500_000; i++ {
@@ -274,8 +277,8 @@ func TestMerge(t *testing.T) {
 
 	tm = time.Now()
 
-	m := E(NewMerger("test.db.tmp", []string{"test.new.db", "test.old.db"}, true, 16384))
-	err = m.Run()
+	m := E(NewMerger("test.db.tmp", []string{"test.new.db", "test.old.db"}, true, 16384, 10))
+	err = m.Run(context.Background())
 	if err != nil {
 		panic(err)
 	}
@@ -305,3 +308,946 @@ func TestMerge(t *testing.T) {
 	}
 	fmt.Println("iterated new file", i, "in", time.Since(tm))
 }
+
+func TestFilter(t *testing.T) {
+	os.RemoveAll("test.even.db")
+	os.RemoveAll("test.odd.db")
+	defer os.RemoveAll("test.even.db")
+	defer os.RemoveAll("test.odd.db")
+
+	// keys are interleaved so every file overlaps every other
+	count := 100_000
+	for _, f := range []string{"test.even.db", "test.odd.db"} {
+		w := E(writer.NewFile(f, 4096, 10))
+		kv := shared.KV{}
+		start := 0
+		if f == "test.odd.db" {
+			start = 1
+		}
+		for i := start; i < count; i += 2 {
+			kv.Key = binary.BigEndian.AppendUint32(nil, uint32(i))
+			kv.Value = kv.Key
+			err := w.Add(&kv)
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+
+	r := E(NewReader([]string{"test.even.db", "test.odd.db"}))
+	defer r.Close()
+	c := r.Cursor()
+	defer c.Close()
+
+	buf := make([]byte, 4)
+	for _, i := range rand.Perm(count)[:10_000] {
+		binary.BigEndian.PutUint32(buf, uint32(i))
+		if c.Find(buf) != reader.Found {
+			log.Panicln("missing find", i)
+		}
+		if i+1 < count {
+			if !c.Next() || binary.BigEndian.Uint32(c.Key) != uint32(i+1) {
+				log.Panicln("next after find", i)
+			}
+			if !c.Previous() || binary.BigEndian.Uint32(c.Key) != uint32(i) {
+				log.Panicln("previous after next", i)
+			}
+		}
+		if i > 0 {
+			if !c.Previous() || binary.BigEndian.Uint32(c.Key) != uint32(i-1) {
+				log.Panicln("previous after find", i)
+			}
+		}
+	}
+
+	binary.BigEndian.PutUint32(buf, uint32(count))
+	if c.Find(buf) != reader.NotFound {
+		log.Panicln("find past end")
+	}
+
+	// greater than a key between blocks of both files
+	buf = append(buf[:0], 0, 0, 1, 0, 0)
+	if c.Find(buf) != reader.FoundGreater || binary.BigEndian.Uint32(c.Key) != 257 {
+		log.Panicln("find greater", c.Key)
+	}
+}
+
+func TestBounds(t *testing.T) {
+	os.RemoveAll("test.low.db")
+	os.RemoveAll("test.high.db")
+	defer os.RemoveAll("test.low.db")
+	defer os.RemoveAll("test.high.db")
+
+	// low file holds 0 to 49_999 and high file 50_000 to 99_999
+	count := 100_000
+	for j, f := range []string{"test.low.db", "test.high.db"} {
+		w := E(writer.NewFile(f, 4096, 10))
+		kv := shared.KV{}
+		for i := j * count / 2; i < (j+1)*count/2; i++ {
+			kv.Key = binary.BigEndian.AppendUint32(nil, uint32(i))
+			kv.Value = kv.Key
+			err := w.Add(&kv)
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+
+	r := E(NewReader([]string{"test.low.db", "test.high.db"}))
+	defer r.Close()
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+
+	for _, b := range [][2]int{{10, 20}, {49_990, 50_010}, {60_000, 60_001}, {0, count}} {
+		lo, hi := b[0], b[1]
+		c := r.Cursor()
+		c.SetBounds(key(lo), key(hi), false)
+		if (hi <= count/2 || lo >= count/2) != (len(c.cursors) == 1) {
+			log.Panicln("file not skipped", lo, hi, len(c.cursors))
+		}
+		i := lo
+		for more := c.First(); more; more = c.Next() {
+			if binary.BigEndian.Uint32(c.Key) != uint32(i) {
+				log.Panicln("forward", lo, hi, i)
+			}
+			i++
+		}
+		if i != hi {
+			log.Panicln("forward end", lo, hi, i)
+		}
+		i = hi - 1
+		for more := c.Last(); more; more = c.Previous() {
+			if binary.BigEndian.Uint32(c.Key) != uint32(i) {
+				log.Panicln("backward", lo, hi, i)
+			}
+			i--
+		}
+		if i != lo-1 {
+			log.Panicln("backward end", lo, hi, i)
+		}
+		if lo > 0 && (c.Find(key(lo-1)) != reader.FoundGreater || binary.BigEndian.Uint32(c.Key) != uint32(lo)) {
+			log.Panicln("find below", lo, hi)
+		}
+		if c.Find(key(hi)) != reader.NotFound {
+			log.Panicln("find above", lo, hi)
+		}
+		c.Close()
+	}
+
+	c := r.Cursor()
+	defer c.Close()
+	c.SetBounds(key(10), key(20), true)
+	if !c.Last() || binary.BigEndian.Uint32(c.Key) != 20 {
+		log.Panicln("inclusive last")
+	}
+}
+
+// damaged files return errors from open or Err() and never panic
+// or return wrong data silently
+func TestCorruptFile(t *testing.T) {
+	os.Remove("test.good.db")
+	os.Remove("test.bad.db")
+	defer os.Remove("test.good.db")
+	defer os.Remove("test.bad.db")
+
+	count := 20_000
+	w := E(writer.NewFile("test.good.db", 4096, 10))
+	kv := shared.KV{}
+	for i := 0; i < count; i++ {
+		kv.Key = binary.BigEndian.AppendUint32(nil, uint32(i))
+		kv.Value = kv.Key
+		err := w.Add(&kv)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := w.Commit()
+	if err != nil {
+		panic(err)
+	}
+	w.Close()
+	good := E(os.ReadFile("test.good.db"))
+
+	buf := make([]byte, 4)
+	for j := 0; j < 300; j++ {
+		bad := append([]byte(nil), good...)
+		pos := rand.Intn(len(bad))
+		if j < 50 {
+			// footer and root index
+			pos = len(bad) - 1 - rand.Intn(500)
+		}
+		bad[pos] ^= byte(1 << rand.Intn(8))
+		os.WriteFile("test.bad.db", bad, 0644)
+
+		r, err := NewReader([]string{"test.bad.db"})
+		if err != nil {
+			continue
+		}
+		c := r.Cursor()
+		i := 0
+		for more := c.First(); more; more = c.Next() {
+			v := c.Value()
+			if c.Err() == nil && (binary.BigEndian.Uint32(c.Key) != uint32(i) || binary.BigEndian.Uint32(v) != uint32(i)) {
+				log.Panicln("bad data at", pos, i)
+			}
+			i++
+		}
+		if c.Err() == nil && i != count {
+			log.Panicln("silent truncation at", pos, i)
+		}
+		for more := c.Last(); more; more = c.Previous() {
+		}
+		for k := 0; k < 100; k++ {
+			binary.BigEndian.PutUint32(buf, uint32(rand.Intn(count)))
+			c.Find(buf)
+		}
+		c.Close()
+		r.Close()
+	}
+}
+
+func TestCachedReader(t *testing.T) {
+	os.Remove("test.cache.db")
+	defer os.Remove("test.cache.db")
+
+	count := 20_000
+	// renamed over the old file like a merge does
+	write := func(offset int) {
+		w := E(writer.NewFile("test.cache.db.tmp", 4096, 10))
+		kv := shared.KV{}
+		for i := 0; i < count; i++ {
+			kv.Key = binary.BigEndian.AppendUint32(nil, uint32(i))
+			kv.Value = binary.BigEndian.AppendUint32(nil, uint32(i+offset))
+			err := w.Add(&kv)
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+		err = os.Rename("test.cache.db.tmp", "test.cache.db")
+		if err != nil {
+			panic(err)
+		}
+	}
+	read := func(r *Reader, offset int) {
+		c := r.Cursor()
+		defer c.Close()
+		i := 0
+		for more := c.First(); more; more = c.Next() {
+			if binary.BigEndian.Uint32(c.Value()) != uint32(i+offset) {
+				log.Panicln("bad value at", i)
+			}
+			i++
+		}
+		if c.Err() != nil || i != count {
+			log.Panicln("read", i, c.Err())
+		}
+	}
+
+	bc := cache.New(16 * 1024 * 1024)
+	defer bc.Close()
+	write(0)
+	r := E(NewCachedReader([]string{"test.cache.db"}, bc))
+	read(r, 0)
+	misses := bc.Misses()
+	read(r, 0)
+	if bc.Misses() != misses || bc.Hits() < misses {
+		log.Panicln("second read", bc.Hits(), bc.Misses(), misses)
+	}
+
+	// unchanged file keeps its cached blocks
+	r2 := E(r.Reopen([][]string{{"test.cache.db"}}))
+	r.Close()
+	read(r2, 0)
+	if bc.Misses() != misses {
+		log.Panicln("reopen", bc.Misses(), misses)
+	}
+
+	// a new file under the same name must not return old blocks
+	write(1)
+	r3 := E(r2.Reopen([][]string{{"test.cache.db"}}))
+	r2.Close()
+	read(r3, 1)
+	if bc.Misses() == misses {
+		log.Panicln("replaced file read from cache")
+	}
+	r3.Close()
+}
+
+func TestPinnedIndex(t *testing.T) {
+	os.Remove("test.pinned.db")
+	defer os.Remove("test.pinned.db")
+
+	// small blocks so the file has a root, a second index level
+	// and data blocks
+	count := 20_000
+	w := E(writer.NewFile("test.pinned.db", 512, 10))
+	kv := shared.KV{}
+	for i := 0; i < count; i++ {
+		kv.Key = binary.BigEndian.AppendUint32(nil, uint32(i))
+		kv.Value = kv.Key
+		err := w.Add(&kv)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := w.Commit()
+	if err != nil {
+		panic(err)
+	}
+	w.Close()
+
+	bc := cache.New(16 * 1024 * 1024)
+	defer bc.Close()
+	r := E(NewCachedReader([]string{"test.pinned.db"}, bc))
+	defer r.Close()
+	if r.Stats().Footers[0].IndexBlocks < 3 {
+		log.Panicln("single index block", r.Stats().Footers[0].IndexBlocks)
+	}
+	// pinned index blocks aren't read so each new cursor only
+	// looks up the data block
+	finds := 1000
+	for j := 0; j < finds; j++ {
+		i := rand.Intn(count)
+		c := r.Cursor()
+		if c.Find(binary.BigEndian.AppendUint32(nil, uint32(i))) != reader.Found ||
+			binary.BigEndian.Uint32(c.Value()) != uint32(i) {
+			log.Panicln("find", i)
+		}
+		c.Close()
+	}
+	if bc.Hits()+bc.Misses() != finds {
+		log.Panicln("block reads", bc.Hits()+bc.Misses())
+	}
+}
+
+func TestHistory(t *testing.T) {
+	files := []string{"test.v3.db", "test.v2.db", "test.v1.db"}
+	for _, f := range append(files, "test.history.db", "test.history.db.tmp") {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+
+	// version v of key i holds v. version 3 deletes odd keys
+	count := 5000
+	for j, f := range files {
+		version := len(files) - j
+		w := E(writer.NewFile(f, 4096, 10))
+		w.SetSequence(uint64(version))
+		for i := 0; i < count; i++ {
+			kv := shared.KV{
+				Key:    binary.BigEndian.AppendUint32(nil, uint32(i)),
+				Value:  binary.BigEndian.AppendUint32(nil, uint32(version)),
+				Delete: version == 3 && i%2 == 1,
+				Seq:    uint64(version),
+			}
+			err := w.Add(&kv)
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+
+	// reads at 1 and later must still work after the merge
+	m := E(NewMerger("test.history.db", files, true, 4096, 10))
+	m.SetHorizon(1)
+	err := m.Run(context.Background())
+	if err == nil {
+		err = m.Commit()
+	}
+	if err != nil {
+		panic(err)
+	}
+	m.Close()
+
+	r := E(NewReader([]string{"test.history.db"}))
+	defer r.Close()
+	for version := 1; version <= 4; version++ {
+		c := r.Cursor()
+		c.SetAsOf(uint64(version))
+		i := 0
+		for more := c.First(); more; more = c.Next() {
+			want := version
+			if version > 3 {
+				want = 3
+			}
+			if want == 3 && i%2 == 1 {
+				if !c.Delete {
+					log.Panicln("version", version, "key", i, "not deleted")
+				}
+				i++
+				continue
+			}
+			if c.Delete || binary.BigEndian.Uint32(c.Key) != uint32(i) || binary.BigEndian.Uint32(c.Value()) != uint32(want) {
+				log.Panicln("version", version, "key", i, c.Key, c.Value())
+			}
+			i++
+		}
+		if c.Err() != nil || i != count {
+			log.Panicln("version", version, "count", i, c.Err())
+		}
+		c.Close()
+	}
+
+	// the version at the horizon loses its sequence so reads
+	// older than the horizon see it
+	c := r.Cursor()
+	c.SetAsOf(0)
+	if c.Find([]byte{0, 0, 0, 1}) != reader.Found || binary.BigEndian.Uint32(c.Value()) != 1 {
+		log.Panicln("find at 0")
+	}
+	c.Close()
+	c = r.Cursor()
+	c.SetAsOf(2)
+	if c.Find([]byte{0, 0, 0, 1}) != reader.Found || binary.BigEndian.Uint32(c.Value()) != 2 {
+		log.Panicln("find at 2")
+	}
+	if !c.Last() || binary.BigEndian.Uint32(c.Key) != uint32(count-1) {
+		log.Panicln("last at 2")
+	}
+	c.Close()
+}
+
+func TestLevelReader(t *testing.T) {
+	files := []string{"test.level1.db", "test.level2.db", "test.level3.db", "test.levelnew.db"}
+	for _, f := range files {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	// three files of 1000 keys each in key order then a newer file
+	// with every third key
+	count := 3000
+	for j := 0; j < 3; j++ {
+		w := E(writer.NewFile(files[j], 1024, 10))
+		for i := j * 1000; i < (j+1)*1000; i++ {
+			k := binary.BigEndian.AppendUint32(nil, uint32(i))
+			err := w.Add(&shared.KV{Key: k, Value: k})
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := w.Commit()
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+	w := E(writer.NewFile(files[3], 1024, 10))
+	for i := 0; i < count; i += 3 {
+		k := binary.BigEndian.AppendUint32(nil, uint32(i))
+		err := w.Add(&shared.KV{Key: k, Value: []byte{1}})
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := w.Commit()
+	if err != nil {
+		panic(err)
+	}
+	w.Close()
+
+	want := func(i int) []byte {
+		if i%3 == 0 {
+			return []byte{1}
+		}
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	r := E(NewLevelReader([][]string{{files[3]}, files[:3]}, nil))
+	defer r.Close()
+	c := r.Cursor()
+	i := 0
+	for more := c.First(); more; more = c.Next() {
+		if binary.BigEndian.Uint32(c.Key) != uint32(i) || !bytes.Equal(c.Value(), want(i)) {
+			log.Panicln("next", i, c.Key, c.Value())
+		}
+		i++
+	}
+	if c.Err() != nil || i != count {
+		log.Panicln("next count", i, c.Err())
+	}
+	for more := c.Last(); more; more = c.Previous() {
+		i--
+		if binary.BigEndian.Uint32(c.Key) != uint32(i) || !bytes.Equal(c.Value(), want(i)) {
+			log.Panicln("previous", i, c.Key, c.Value())
+		}
+	}
+	if c.Err() != nil || i != 0 {
+		log.Panicln("previous count", i, c.Err())
+	}
+	for i := 0; i < count; i += 7 {
+		k := binary.BigEndian.AppendUint32(nil, uint32(i))
+		if c.Find(k) != reader.Found || !bytes.Equal(c.Value(), want(i)) {
+			log.Panicln("find", i)
+		}
+	}
+	c.Close()
+
+	// bounds crossing a file boundary
+	c = r.Cursor()
+	c.SetBounds(binary.BigEndian.AppendUint32(nil, 990), binary.BigEndian.AppendUint32(nil, 2010), false)
+	i = 990
+	for more := c.First(); more; more = c.Next() {
+		if binary.BigEndian.Uint32(c.Key) != uint32(i) {
+			log.Panicln("bounds", i, c.Key)
+		}
+		i++
+	}
+	if i != 2010 {
+		log.Panicln("bounds count", i)
+	}
+	c.Close()
+
+	// a canceled merge leaves no output and keeps its inputs
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := E(NewMerger("test.cancel.db", []string{files[3], files[0], files[1], files[2]}, true, 1024, 10))
+	err = m.Run(ctx)
+	m.Close()
+	if err != context.Canceled {
+		log.Panicln("canceled merge", err)
+	}
+	if _, err := os.Stat("test.cancel.db.tmp"); err == nil {
+		log.Panicln("canceled merge output kept")
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			log.Panicln("canceled merge input removed", f)
+		}
+	}
+
+	// split merge output into disjoint files in key order
+	outputs := []string{}
+	defer func() {
+		for _, f := range outputs {
+			os.Remove(f)
+		}
+	}()
+	n := 0
+	m = E(NewMerger("test.split.0.db", []string{files[3], files[0], files[1], files[2]}, true, 1024, 10))
+	m.SetSplit(4096, func() string {
+		n++
+		return fmt.Sprintf("test.split.%d.db", n)
+	})
+	err = m.Run(context.Background())
+	if err == nil {
+		err = m.Commit()
+	}
+	m.Close()
+	if err != nil {
+		panic(err)
+	}
+	outputs = m.Outputs()
+	if len(outputs) < 3 {
+		log.Panicln("outputs", outputs)
+	}
+	// read back as one level. only the file covering a key is read
+	r2 := E(NewLevelReader([][]string{outputs}, nil))
+	defer r2.Close()
+	c = r2.Cursor()
+	defer c.Close()
+	i = 0
+	for more := c.First(); more; more = c.Next() {
+		if binary.BigEndian.Uint32(c.Key) != uint32(i) || !bytes.Equal(c.Value(), want(i)) {
+			log.Panicln("split", i, c.Key, c.Value())
+		}
+		i++
+	}
+	if c.Err() != nil || i != count {
+		log.Panicln("split count", i, c.Err())
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			log.Panicln("input kept", f)
+		}
+	}
+}
+
+// adds big-endian uint64 operands to a big-endian uint64
+type sum struct{}
+
+func (sum) Merge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var n uint64
+	if existing != nil {
+		n = binary.BigEndian.Uint64(existing)
+	}
+	for _, op := range operands {
+		n += binary.BigEndian.Uint64(op)
+	}
+	return binary.BigEndian.AppendUint64(nil, n), nil
+}
+
+func TestMergeOperands(t *testing.T) {
+	files := []string{"test.operand.new.db", "test.operand.old.db", "test.operand.db", "test.operand.all.db"}
+	for _, f := range files {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	number := func(n int) []byte {
+		return binary.BigEndian.AppendUint64(nil, uint64(n))
+	}
+	// old has i for 0-99. new adds 10 to the even keys and to 100
+	w := E(writer.NewFile(files[1], 1024, 10))
+	for i := 0; i < 100; i++ {
+		err := w.Add(&shared.KV{Key: binary.BigEndian.AppendUint32(nil, uint32(i)), Value: number(i)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := w.Commit(); err != nil {
+		panic(err)
+	}
+	w.Close()
+	w = E(writer.NewFile(files[0], 1024, 10))
+	for i := 0; i <= 100; i += 2 {
+		err := w.Add(&shared.KV{Key: binary.BigEndian.AppendUint32(nil, uint32(i)), Value: number(10), Merge: true})
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := w.Commit(); err != nil {
+		panic(err)
+	}
+	w.Close()
+
+	want := func(i int) int {
+		if i == 100 {
+			return 10
+		}
+		if i%2 == 0 {
+			return i + 10
+		}
+		return i
+	}
+	check := func(c *Cursor, operands bool) {
+		defer c.Close()
+		n := 0
+		for more := c.First(); more; more = c.Next() {
+			i := int(binary.BigEndian.Uint32(c.Key))
+			if c.Merge() != (operands && i%2 == 0) || !bytes.Equal(c.Value(), number(want(i))) {
+				log.Panicln("key", i, c.Merge(), c.Value(), c.Err())
+			}
+			n++
+		}
+		if n != 101 || c.Err() != nil {
+			log.Panicln("count", n, c.Err())
+		}
+	}
+
+	// operands stay without the values under them
+	m := E(NewMerger(files[2], []string{files[0]}, false, 1024, 10))
+	m.SetMergeOperator(sum{}, nil)
+	err := m.Rewrite()
+	if err == nil {
+		err = m.Run(context.Background())
+	}
+	if err == nil {
+		err = m.Rename()
+	}
+	m.Close()
+	if err != nil {
+		panic(err)
+	}
+	r := E(NewReader([]string{files[2], files[1]}))
+	c := r.Cursor()
+	c.SetMergeOperator(sum{}, nil)
+	check(c, true)
+	// reading operands needs an operator
+	c = r.Cursor()
+	if c.Find(binary.BigEndian.AppendUint32(nil, 0)) != reader.Found || c.Value() != nil || c.Err() == nil {
+		log.Panicln("read without operator", c.Err())
+	}
+	c.Close()
+	r.Close()
+
+	// and are folded with them
+	m = E(NewMerger(files[3], []string{files[2], files[1]}, true, 1024, 10))
+	m.SetMergeOperator(sum{}, nil)
+	err = m.Run(context.Background())
+	if err == nil {
+		err = m.Rename()
+	}
+	m.Close()
+	if err != nil {
+		panic(err)
+	}
+	r = E(NewReader([]string{files[3]}))
+	defer r.Close()
+	check(r.Cursor(), false)
+}
+
+func TestRangeTombstones(t *testing.T) {
+	files := []string{"test.range.new.db", "test.range.old.db", "test.range.older.db"}
+	for _, f := range files {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	var outputs []string
+	defer func() {
+		for _, f := range outputs {
+			os.Remove(f)
+		}
+	}()
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	// older and old have keys 0-99. new deletes 20-49 at sequence 3
+	// and writes 30 in the same batch
+	for j, seq := range []uint64{1, 2} {
+		w := E(writer.NewFile(files[2-j], 1024, 10))
+		w.SetSequence(seq)
+		for i := 0; i < 100; i++ {
+			err := w.Add(&shared.KV{Key: key(i), Value: bytes.Repeat([]byte{byte(j)}, 100), Seq: seq})
+			if err != nil {
+				panic(err)
+			}
+		}
+		if err := w.Commit(); err != nil {
+			panic(err)
+		}
+		w.Close()
+	}
+	w := E(writer.NewFile(files[0], 1024, 10))
+	w.SetSequence(3)
+	if err := w.Add(&shared.KV{Key: key(30), Value: []byte{2}, Seq: 3}); err != nil {
+		panic(err)
+	}
+	if err := w.AddTombstone(shared.Tombstone{Start: key(20), End: key(50), Seq: 3}); err != nil {
+		panic(err)
+	}
+	if err := w.Commit(); err != nil {
+		panic(err)
+	}
+	w.Close()
+
+	deleted := func(i int) bool {
+		return i >= 20 && i < 50 && i != 30
+	}
+	check := func(c *Cursor, asOf uint64) {
+		defer c.Close()
+		n := 0
+		for more := c.First(); more; more = c.Next() {
+			i := int(binary.BigEndian.Uint32(c.Key))
+			if c.Delete != (asOf >= 3 && deleted(i)) {
+				log.Panicln("delete", i, c.Delete)
+			}
+			if !c.Delete {
+				n++
+			}
+		}
+		want := 100
+		if asOf >= 3 {
+			want = 71
+		}
+		if n != want || c.Err() != nil {
+			log.Panicln("count", asOf, n, c.Err())
+		}
+		// versions under the tombstone are deleted from its sequence.
+		// the bottom level has none
+		if c.Find(key(25)) != reader.Found {
+			if asOf >= 3 && c.Err() == nil {
+				return
+			}
+			log.Panicln("find", c.Err())
+		}
+		versions := c.Versions(nil)
+		if len(versions) < 2 || versions[0].Seq != 3 || !versions[0].Delete {
+			log.Panicln("versions", versions)
+		}
+	}
+	r := E(NewReader(files))
+	check(r.Cursor(), math.MaxUint64)
+	c := r.Cursor()
+	c.SetAsOf(2)
+	check(c, 2)
+	// the tombstone file is outside of bounds but still hides keys
+	c = r.Cursor()
+	c.SetBounds(key(40), key(45), false)
+	if c.First() && !c.Delete {
+		log.Panicln("bounded", c.Key)
+	}
+	c.Close()
+	r.Close()
+
+	merge := func(files []string, delete bool, horizon uint64) {
+		name := 0
+		next := func() string {
+			name++
+			return fmt.Sprintf("test.range.out%v.db", name)
+		}
+		m := E(NewMerger(next(), files, delete, 1024, 10))
+		m.SetHorizon(horizon)
+		m.SetSplit(256, next)
+		err := m.Rewrite()
+		if err == nil {
+			err = m.Run(context.Background())
+		}
+		if err == nil {
+			err = m.Rename()
+		}
+		outputs = m.Outputs()
+		m.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
+	// above the bottom level the tombstone is split across the outputs
+	// and the keys it covers are dropped without point deletes
+	merge(files[:2], false, math.MaxUint64)
+	r = E(NewLevelReader([][]string{outputs, {files[2]}}, nil))
+	deletes, tombstones := 0, 0
+	for _, f := range r.Stats().Footers {
+		deletes += f.Deletes
+		tombstones += f.TombstoneSize
+	}
+	if len(outputs) < 2 || deletes != 0 || tombstones == 0 {
+		log.Panicln("carry", len(outputs), deletes, tombstones)
+	}
+	check(r.Cursor(), math.MaxUint64)
+	r.Close()
+
+	// snapshots before the tombstone still see the keys it covers
+	merge(files[:2], false, 2)
+	r = E(NewLevelReader([][]string{outputs, {files[2]}}, nil))
+	c = r.Cursor()
+	c.SetAsOf(2)
+	check(c, 2)
+	check(r.Cursor(), math.MaxUint64)
+	r.Close()
+
+	// the bottom level drops it
+	merge(files, true, math.MaxUint64)
+	r = E(NewReader(outputs))
+	defer r.Close()
+	for _, f := range r.Stats().Footers {
+		if f.TombstoneSize != 0 || f.Deletes != 0 {
+			log.Panicln("bottom", f.TombstoneSize, f.Deletes)
+		}
+	}
+	check(r.Cursor(), math.MaxUint64)
+}
+
+func TestExpiry(t *testing.T) {
+	files := []string{"test.expire.new.db", "test.expire.old.db", "test.expire.out.db"}
+	for _, f := range files {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	key := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	// old has keys 0-99 where even keys expire at 100. new has keys
+	// 0-9 expiring at 200 over an older version expiring at 50
+	w := E(writer.NewFile(files[1], 1024, 10))
+	for i := 0; i < 100; i++ {
+		kv := shared.KV{Key: key(i), Value: key(i)}
+		if i%2 == 0 {
+			kv.Expires = 100
+		}
+		if err := w.Add(&kv); err != nil {
+			panic(err)
+		}
+	}
+	if err := w.Commit(); err != nil {
+		panic(err)
+	}
+	w.Close()
+	w = E(writer.NewFile(files[0], 1024, 10))
+	w.SetSequence(2)
+	for i := 0; i < 10; i++ {
+		kv := shared.KV{Key: key(i), Value: []byte("new"), Seq: 2, Expires: 200,
+			Older: []shared.Version{{Seq: 1, Value: []byte("older"), Expires: 50}}}
+		if err := w.Add(&kv); err != nil {
+			panic(err)
+		}
+	}
+	if err := w.Commit(); err != nil {
+		panic(err)
+	}
+	w.Close()
+
+	r := E(NewReader(files[:2]))
+	for _, f := range r.Stats().Footers {
+		if f.Expires != 0 && f.Expires != 200 {
+			log.Panicln("footer expiry", f.Expires)
+		}
+	}
+	count := func(now int64, asOf uint64) int {
+		c := r.Cursor()
+		defer c.Close()
+		c.SetNow(now)
+		c.SetAsOf(asOf)
+		n := 0
+		for more := c.First(); more; more = c.Next() {
+			if !c.Delete {
+				n++
+			}
+		}
+		if c.Err() != nil {
+			panic(c.Err())
+		}
+		return n
+	}
+	// expired versions hide the versions under them
+	if n := count(0, math.MaxUint64); n != 100 {
+		log.Panicln("before expiry", n)
+	}
+	if n := count(100, math.MaxUint64); n != 55 {
+		log.Panicln("after old expiry", n)
+	}
+	if n := count(60, 1); n != 90 {
+		log.Panicln("as of after older expiry", n)
+	}
+	if n := count(200, math.MaxUint64); n != 45 {
+		log.Panicln("after new expiry", n)
+	}
+	r.Close()
+
+	// merges drop expired entries like deletes
+	m := E(NewMerger(files[2], files[:2], true, 1024, 10))
+	m.SetNow(100)
+	m.SetHorizon(1)
+	err := m.Run(context.Background())
+	if err == nil {
+		err = m.Rename()
+	}
+	m.Close()
+	if err != nil {
+		panic(err)
+	}
+	r = E(NewReader(files[2:]))
+	defer r.Close()
+	if f := r.Stats().Footers[0]; f.Deletes != 0 || f.Inserts != 55 || f.Expires != 0 {
+		log.Panicln("merged", f.Deletes, f.Inserts, f.Expires)
+	}
+	c := r.Cursor()
+	defer c.Close()
+	c.SetNow(100)
+	if c.Find(key(0)) != reader.Found || string(c.Value()) != "new" {
+		log.Panicln("merged value", c.Value())
+	}
+	versions := c.Versions(nil)
+	// the expired older version was every read's delete at the horizon
+	if len(versions) != 1 || versions[0].Expires != 200 || versions[0].Seq != 2 {
+		log.Panicln("merged versions", versions)
+	}
+}
@@ -0,0 +1,87 @@
+package merge
+
+import (
+	"sort"
+
+	"github.com/stangelandcl/teepeedb/internal/shared"
+)
+
+// range tombstone of source
+type tombstone struct {
+	shared.Tombstone
+	source int
+}
+
+func hasTombstones(s Source) bool {
+	r, ok := s.(ranged)
+	return ok && len(r.Tombstones()) > 0
+}
+
+func (c *Cursor) loadTombstones() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+	for i, cur := range c.cursors {
+		if r, ok := cur.(ranged); ok {
+			for _, t := range r.Tombstones() {
+				c.tombstones = append(c.tombstones, tombstone{Tombstone: t, source: i})
+			}
+		}
+	}
+}
+
+// true if a range tombstone at or before asOf in a source newer than
+// source covers key. tombstones are few so they are scanned
+func (c *Cursor) covered(key []byte, source int) bool {
+	c.loadTombstones()
+	for i := range c.tombstones {
+		t := &c.tombstones[i]
+		if t.source < source && t.Seq <= c.asOf && t.Covers(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// true if a range tombstone at or before seq in any source covers Key.
+// reads from seq on see older versions of Key in any source as deleted
+func (c *Cursor) Covered(seq uint64) bool {
+	c.loadTombstones()
+	for i := range c.tombstones {
+		t := &c.tombstones[i]
+		if t.Seq <= seq && t.Covers(c.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// append a delete version newest first for each range tombstone in
+// sources from up to but not including to that covers Key. versions
+// under them are in older sources
+func (c *Cursor) hidden(dst []shared.Version, from, to int) []shared.Version {
+	c.loadTombstones()
+	n := len(dst)
+	for i := range c.tombstones {
+		t := &c.tombstones[i]
+		if t.source >= from && t.source < to && t.Covers(c.Key) {
+			dst = append(dst, shared.Version{Seq: t.Seq, Delete: true})
+		}
+	}
+	added := dst[n:]
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].Seq > added[j].Seq
+	})
+	return dst
+}
+
+// range tombstones of every source
+func (c *Cursor) Tombstones() []shared.Tombstone {
+	c.loadTombstones()
+	ts := make([]shared.Tombstone, len(c.tombstones))
+	for i, t := range c.tombstones {
+		ts[i] = t.Tombstone
+	}
+	return ts
+}
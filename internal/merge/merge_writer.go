@@ -1,10 +1,15 @@
 package merge
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"time"
 
+	"github.com/stangelandcl/teepeedb/internal/ratelimit"
 	"github.com/stangelandcl/teepeedb/internal/shared"
 	"github.com/stangelandcl/teepeedb/internal/writer"
 )
@@ -16,22 +21,53 @@ type merger struct {
 	files     []string
 	dstfile   string
 	committed bool
+	// versions newer than horizon are kept
+	horizon  uint64
+	versions []shared.Version
+	// a new output file named by next is started once one reaches
+	// maxSize. 0 writes one file
+	maxSize    int
+	next       func() string
+	outputs    []string
+	blockSize  int
+	bitsPerKey int
+	// reads and writes wait on limit. nil is unlimited. ctx of Run
+	// ends the waits
+	limit *ratelimit.Limiter
+	ctx   context.Context
+	// folds merge operands. nil keeps them
+	op       Operator
+	resolve  Resolver
+	operands [][]byte
+	// range tombstones of the inputs carried into the outputs. the
+	// current output gets the part of each from lower on
+	tombstones []shared.Tombstone
+	lower      []byte
+	// versions expired by this unix nanosecond time are merged as deletes
+	now int64
 }
 
 // files in order newest to oldest
 // hardDelete means remove from file instead of inserting a delete tombstone
 // fixedValueSize < 0 == variable size
+// bitsPerKey <= 0 writes no bloom filter
 func NewMerger(
 	dstfile string,
 	files []string,
 	hardDelete bool,
-	blockSize int) (merger, error) {
+	blockSize int,
+	bitsPerKey int) (merger, error) {
 	if len(files) == 0 {
 		return merger{}, fmt.Errorf("teepeedb: no files to merge")
 	}
 	w := merger{
-		files:   files,
-		dstfile: dstfile,
+		files:      files,
+		dstfile:    dstfile,
+		horizon:    math.MaxUint64,
+		now:        time.Now().UnixNano(),
+		outputs:    []string{dstfile},
+		blockSize:  blockSize,
+		bitsPerKey: bitsPerKey,
 	}
 	var err error
 	if len(files) > 1 {
@@ -39,7 +75,7 @@ func NewMerger(
 		if err != nil {
 			return w, err
 		}
-		w.w, err = writer.NewFile(dstfile+".tmp", blockSize)
+		w.w, err = writer.NewFile(dstfile+".tmp", blockSize, bitsPerKey)
 		if err != nil {
 			w.r.Close()
 			return w, err
@@ -50,53 +86,269 @@ func NewMerger(
 	return w, nil
 }
 
-func (w *merger) Run() error {
-	if len(w.files) == 1 {
+// rewrite a single file instead of renaming it so deletes and old
+// versions are dropped. call before Run
+func (w *merger) Rewrite() error {
+	if w.r != nil {
 		return nil
 	}
+	var err error
+	w.r, err = NewReader(w.files)
+	if err != nil {
+		return err
+	}
+	w.w, err = writer.NewFile(w.dstfile+".tmp", w.blockSize, w.bitsPerKey)
+	if err != nil {
+		w.r.Close()
+		w.r = nil
+		return err
+	}
+	return nil
+}
+
+// throttle reads and writes to l. call before Run
+func (w *merger) SetLimiter(l *ratelimit.Limiter) {
+	w.limit = l
+}
+
+// fold merge operands with op onto the version under them when both are
+// in the merge or the merge drops deletes. resolve reads values that are
+// value log pointers. nil resolve keeps operands on them. call before Run
+func (w *merger) SetMergeOperator(op Operator, resolve Resolver) {
+	w.op = op
+	w.resolve = resolve
+}
+
+// keep versions newer than sequence seq for snapshots and as of reads.
+// by default only the newest version of each key is kept
+func (w *merger) SetHorizon(seq uint64) {
+	w.horizon = seq
+}
+
+// merge versions expired by unix nanosecond time now as deletes so
+// they are dropped like any other. defaults to when the merger was
+// created. call before Run
+func (w *merger) SetNow(now int64) {
+	w.now = now
+}
+
+// split the output into files of about maxSize bytes with disjoint
+// key ranges. files after dstfile are named by next
+func (w *merger) SetSplit(maxSize int, next func() string) {
+	w.maxSize = maxSize
+	w.next = next
+}
+
+// files written in key order. dstfile first
+func (w *merger) Outputs() []string {
+	return w.outputs
+}
+
+// merge the inputs into the .tmp outputs. ctx is checked about once
+// per block read so a canceled merge stops quickly. Close removes the
+// outputs of a merge that didn't finish
+func (w *merger) Run(ctx context.Context) error {
+	if w.r == nil {
+		return nil
+	}
+	w.ctx = ctx
+	w.w.SetLimiter(ctx, w.limit)
 	c := w.r.Cursor()
 	defer c.Close()
+	// with deletes dropped no older level has keys to hide
+	if !w.delete {
+		w.tombstones = c.Tombstones()
+	}
 
 	more := c.First()
-	i := 0
+	kv := shared.KV{}
+	unchecked := 0
 	for more {
-		if !c.Delete || !w.delete {
-			kv := shared.KV{
-				Key:    c.Key,
-				Value:  c.Value(),
-				Delete: c.Delete,
+		w.versions = c.Versions(w.versions[:0])
+		if c.Err() != nil {
+			break
+		}
+		for i := range w.versions {
+			w.versions[i] = expire(w.versions[i], w.now)
+		}
+		read := len(c.Key)
+		for _, v := range w.versions {
+			read += len(v.Value)
+		}
+		err := w.limit.Wait(ctx, read)
+		if err != nil {
+			return err
+		}
+		unchecked += read
+		if unchecked >= w.blockSize {
+			unchecked = 0
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		if w.op != nil {
+			err := w.fold(c.Key)
+			if err != nil {
+				return err
 			}
-			err := w.w.Add(&kv)
+		}
+		// value log pointers are copied as is so merges
+		// don't rewrite large values
+		kv.Key = c.Key
+		// a delete every read sees under a range tombstone every read
+		// sees is left to the tombstone
+		if shared.Collapse(&kv, w.versions, w.horizon, w.delete) &&
+			!(kv.Delete && len(kv.Older) == 0 && c.Covered(w.horizon)) {
+			err := w.add(&kv)
 			if err != nil {
 				return err
 			}
 		}
 
 		more = c.Next()
-		i++
+	}
+	// a corrupt input would otherwise commit a truncated file
+	// and delete the inputs
+	if c.Err() != nil {
+		return c.Err()
 	}
 
-	err := w.w.Commit()
+	if w.w == nil && w.uncarried() {
+		err := w.open()
+		if err != nil {
+			return err
+		}
+	}
+	if w.w == nil {
+		return nil
+	}
+	err := w.carry(nil)
 	if err != nil {
 		return err
 	}
+	return w.w.Commit()
+}
+
+// true if part of a range tombstone is after the last output
+func (w *merger) uncarried() bool {
+	for _, t := range w.tombstones {
+		if w.lower == nil || bytes.Compare(t.End, w.lower) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// add the part of each range tombstone from lower up to upper to the
+// current output. nil upper is unbounded
+func (w *merger) carry(upper []byte) error {
+	for _, t := range w.tombstones {
+		if w.lower != nil && bytes.Compare(t.Start, w.lower) < 0 {
+			t.Start = w.lower
+		}
+		if upper != nil && bytes.Compare(t.End, upper) > 0 {
+			t.End = upper
+		}
+		if bytes.Compare(t.Start, t.End) >= 0 {
+			continue
+		}
+		err := w.w.AddTombstone(t)
+		if err != nil {
+			return err
+		}
+	}
+	w.lower = upper
+	return nil
+}
+
+// start the next output file
+func (w *merger) open() error {
+	dst := w.next()
+	w.outputs = append(w.outputs, dst)
+	var err error
+	w.w, err = writer.NewFile(dst+".tmp", w.blockSize, w.bitsPerKey)
+	if err != nil {
+		return err
+	}
+	w.w.SetLimiter(w.ctx, w.limit)
+	return nil
+}
+
+// replace the merge operands every read from horizon on sees and the
+// version under them with their folded value
+func (w *merger) fold(key []byte) error {
+	i := 0
+	for i < len(w.versions) && w.versions[i].Seq > w.horizon {
+		i++
+	}
+	if i == len(w.versions) || !w.versions[i].Merge {
+		return nil
+	}
+	// with deletes dropped no older level has the key
+	v, ok, err := fold(w.op, w.resolve, key, w.versions[i:], &w.operands, !w.delete)
+	if !ok {
+		return err
+	}
+	w.versions[i] = shared.Version{Seq: w.versions[i].Seq, Value: v}
+	w.versions = w.versions[:i+1]
 	return nil
 }
 
+func (w *merger) add(kv *shared.KV) error {
+	if w.w == nil {
+		err := w.open()
+		if err != nil {
+			return err
+		}
+	}
+	err := w.w.Add(kv)
+	if err != nil || w.maxSize <= 0 || w.w.Len() < w.maxSize {
+		return err
+	}
+	// the next output starts after kv.Key
+	err = w.carry(append(append([]byte{}, kv.Key...), 0))
+	if err == nil {
+		err = w.w.Commit()
+	}
+	w.w.Close()
+	w.w = nil
+	return err
+}
+
+// rename the new file into place and remove the merged files
 func (w *merger) Commit() error {
+	err := w.Rename()
+	if err != nil {
+		return err
+	}
+	w.RemoveInputs()
+	return nil
+}
+
+// rename the new file into place. the merged files are kept until
+// RemoveInputs so the change can be recorded first
+func (w *merger) Rename() error {
 	var err error
-	if len(w.files) == 1 {
+	if w.r == nil {
 		err = os.Rename(w.files[0], w.dstfile)
 	} else {
-		err = os.Rename(w.dstfile+".tmp", w.dstfile)
+		for _, dst := range w.outputs {
+			err = os.Rename(dst+".tmp", dst)
+			if err != nil {
+				break
+			}
+		}
 	}
 	if err != nil {
-		os.Remove(w.dstfile + ".tmp")
+		w.removeOutputs()
 		log.Println("merge failed", w.dstfile, err)
 		return err
 	}
 	w.committed = true
+	return nil
+}
 
+func (w *merger) RemoveInputs() {
 	// remove in reverse order so LSM tree is never in an invalid state
 	// removing newest first would leave older entries as the top level values
 	// before they get deletes and the new file becomes the top level
@@ -105,7 +357,6 @@ func (w *merger) Commit() error {
 			os.Remove(w.files[i])
 		}
 	}
-	return nil
 }
 
 func (m *merger) Close() {
@@ -117,9 +368,16 @@ func (m *merger) Close() {
 	// happens when moving a single file instead of merging
 	if m.w != nil {
 		m.w.Close()
+		m.w = nil
 	}
 	if !m.committed {
-		os.Remove(m.dstfile + ".tmp")
+		m.removeOutputs()
 		m.committed = true
 	}
 }
+
+func (m *merger) removeOutputs() {
+	for _, dst := range m.outputs {
+		os.Remove(dst + ".tmp")
+	}
+}
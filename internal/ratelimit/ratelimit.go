@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// token bucket of bytes per second shared by every merge. waiters that
+// take more than there is go into debt and sleep it off so large
+// requests still go through at the rate
+type Limiter struct {
+	lock sync.Mutex
+	// 0 is unlimited
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// 0 is unlimited
+func New(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// change the rate. takes effect for the next Wait
+func (l *Limiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(time.Now())
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = float64(rate)
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+}
+
+func (l *Limiter) Rate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int64(l.rate)
+}
+
+// tokens saved up while idle. a tenth of a second
+func (l *Limiter) burst() float64 {
+	return l.rate / 10
+}
+
+// caller must hold lock
+func (l *Limiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+	}
+	l.last = now
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+}
+
+// take n bytes, sleeping until the rate allows them or ctx is done.
+// a canceled wait gives back the bytes it didn't sleep off. nil is
+// unlimited
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	if l.rate == 0 {
+		l.lock.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.refill(now)
+	l.tokens -= float64(n)
+	var sleep time.Duration
+	if l.tokens < 0 {
+		sleep = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+	if sleep <= 0 {
+		return nil
+	}
+	t := time.NewTimer(sleep)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	left := float64(sleep-time.Since(now)) / float64(time.Second) * l.rate
+	if left > float64(n) {
+		left = float64(n)
+	}
+	if left > 0 {
+		l.tokens += left
+	}
+	return ctx.Err()
+}
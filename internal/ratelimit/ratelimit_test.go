@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	var l *Limiter
+	l.Wait(context.Background(), 1<<30)
+	l = New(0)
+	l.Wait(context.Background(), 1<<30)
+
+	// 1 MB at 4 MB/s shared by 4 writers
+	l.SetRate(4 << 20)
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 64; j++ {
+				l.Wait(context.Background(), 4096)
+			}
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+		log.Panicln("took", d)
+	}
+
+	// raising the rate applies to the next wait
+	l.SetRate(1 << 40)
+	start = time.Now()
+	l.Wait(context.Background(), 1<<20)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		log.Panicln("took", d)
+	}
+	if l.Rate() != 1<<40 {
+		log.Panicln("rate", l.Rate())
+	}
+
+	// a canceled wait returns early and gives back what it didn't use
+	l.SetRate(1 << 20)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err := l.Wait(ctx, 1<<30)
+	if d := time.Since(start); err != context.DeadlineExceeded || d > time.Second {
+		log.Panicln("canceled wait", err, d)
+	}
+	start = time.Now()
+	l.Wait(context.Background(), 1<<10)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		log.Panicln("debt kept", d)
+	}
+}
@@ -1,40 +1,320 @@
 package reader
 
 import (
+	"bytes"
+	"math"
+
+	"github.com/stangelandcl/teepeedb/internal/block"
 	"github.com/stangelandcl/teepeedb/internal/shared"
 )
 
+// as of sequence that reads the newest version of every entry
+const latest = math.MaxUint64
+
 type Cursor struct {
 	r       *File
 	block   Block
 	indexes []Index
+	// first read or checksum error. cursor stops moving once set
+	err error
+	// Next and Previous stop before loading blocks outside of bounds
+	lower, upper []byte
+	inclusive    bool
+	// entries with no version at or before asOf are skipped
+	asOf uint64
+	// version of the current entry visible as of asOf. set by
+	// settle or on first use when reading the latest version
+	cur    shared.Version
+	parsed bool
+	older  []shared.Version
+}
+
+// read versions as of sequence seq. call before any move.
+// returns false if every version in the file is newer
+func (c *Cursor) SetAsOf(seq uint64) bool {
+	c.asOf = seq
+	return c.err != nil || c.r.footer.MinSequence <= seq
+}
+
+// skip blocks entirely outside of lower and upper. nil is unbounded.
+// returns false if the whole file is outside
+func (c *Cursor) SetBounds(lower, upper []byte, inclusive bool) bool {
+	c.lower = lower
+	c.upper = upper
+	c.inclusive = inclusive
+	if len(c.indexes) == 0 {
+		return c.err != nil
+	}
+	root := &c.indexes[0].b
+	first, _ := root.rb.Key(0)
+	n := root.rb.Count - 1
+	key, _ := root.rb.Key(n)
+	last := convert(key, root.rb.Value(n)).LastKey
+	return c.overlaps(first, last)
+}
+
+// false if no key from first to last can be inside bounds
+func (c *Cursor) overlaps(first, last []byte) bool {
+	if c.upper != nil {
+		cmp := bytes.Compare(first, c.upper)
+		if cmp > 0 || cmp == 0 && !c.inclusive {
+			return false
+		}
+	}
+	return c.lower == nil || bytes.Compare(last, c.lower) >= 0
 }
 
 func (c *Cursor) Key() ([]byte, bool) {
-	return c.block.rb.Key(c.block.idx)
+	key, delete := c.block.rb.Key(c.block.idx)
+	if c.parsed {
+		delete = c.cur.Delete
+	}
+	return key, delete
 }
 
 func (c *Cursor) Value() []byte {
-	return c.block.Value(c.block.idx)
+	if c.block.rb.Flags(c.block.idx)&block.FlagVersion == 0 {
+		_, v := c.body()
+		return v
+	}
+	if !c.parsed && !c.parse() {
+		return nil
+	}
+	return c.cur.Value
+}
+
+func (c *Cursor) raw() []byte {
+	v := c.block.Value(c.block.idx)
+	if err := c.block.rb.Err(); err != nil && c.err == nil {
+		c.err = c.r.corrupt(c.block.position, err)
+	}
+	return v
+}
+
+// raw value without its expiry prefix and the expiry. 0 if the entry
+// never expires. nil and Err() set on error
+func (c *Cursor) body() (int64, []byte) {
+	v := c.raw()
+	if c.block.rb.Flags(c.block.idx)&block.FlagExpire == 0 || v == nil && c.err != nil {
+		return 0, v
+	}
+	expires, v, err := shared.ParseExpiry(v)
+	if err != nil {
+		c.err = c.r.corrupt(c.block.position, err)
+		return 0, nil
+	}
+	return expires, v
+}
+
+// unix nanosecond time the version Key and Value return expires at.
+// 0 if it never expires
+func (c *Cursor) Expires() int64 {
+	if c.parsed {
+		return c.cur.Expires
+	}
+	flags := c.block.rb.Flags(c.block.idx)
+	if flags&block.FlagExpire == 0 {
+		return 0
+	}
+	if flags&block.FlagVersion != 0 {
+		if !c.parse() {
+			return 0
+		}
+		return c.cur.Expires
+	}
+	expires, _ := c.body()
+	return expires
+}
+
+// value is a pointer into a value log
+func (c *Cursor) Pointer() bool {
+	if c.parsed {
+		return c.cur.Pointer
+	}
+	return c.block.rb.Flags(c.block.idx)&block.FlagPointer != 0
+}
+
+// value is a merge operand
+func (c *Cursor) Merge() bool {
+	if c.parsed {
+		return c.cur.Merge
+	}
+	return c.block.rb.Flags(c.block.idx)&block.FlagMerge != 0
+}
+
+// sequence of the version Key and Value return
+func (c *Cursor) Sequence() uint64 {
+	if c.block.rb.Flags(c.block.idx)&block.FlagVersion == 0 {
+		return c.r.footer.Sequence
+	}
+	if !c.parsed && !c.parse() {
+		return 0
+	}
+	return c.cur.Seq
+}
+
+// every version of the current entry newest first ignoring asOf.
+// appended to dst. unchanged and Err() set on error
+func (c *Cursor) Versions(dst []shared.Version) []shared.Version {
+	flags := c.block.rb.Flags(c.block.idx)
+	expires, v := c.body()
+	if v == nil && c.err != nil {
+		return dst
+	}
+	if flags&block.FlagVersion == 0 {
+		return append(dst, shared.Version{
+			Seq:     c.r.footer.Sequence,
+			Value:   v,
+			Delete:  flags&block.FlagDelete != 0,
+			Pointer: flags&block.FlagPointer != 0,
+			Merge:   flags&block.FlagMerge != 0,
+			Expires: expires,
+		})
+	}
+	seq, value, older, err := shared.ParseVersions(v, c.older[:0])
+	if err != nil {
+		c.err = c.r.corrupt(c.block.position, err)
+		return dst
+	}
+	c.older = older
+	dst = append(dst, shared.Version{
+		Seq:     seq,
+		Value:   value,
+		Delete:  flags&block.FlagDelete != 0,
+		Pointer: flags&block.FlagPointer != 0,
+		Merge:   flags&block.FlagMerge != 0,
+		Expires: expires,
+	})
+	return append(dst, older...)
+}
+
+// set cur to the newest version of the current entry at or before
+// asOf. false if there is none or the header is corrupt
+func (c *Cursor) parse() bool {
+	flags := c.block.rb.Flags(c.block.idx)
+	expires, v := c.body()
+	if v == nil && c.err != nil {
+		return false
+	}
+	c.parsed = true
+	c.cur = shared.Version{
+		Seq:     c.r.footer.Sequence,
+		Value:   v,
+		Delete:  flags&block.FlagDelete != 0,
+		Pointer: flags&block.FlagPointer != 0,
+		Merge:   flags&block.FlagMerge != 0,
+		Expires: expires,
+	}
+	if flags&block.FlagVersion == 0 {
+		return c.cur.Seq <= c.asOf
+	}
+	seq, value, older, err := shared.ParseVersions(v, c.older[:0])
+	if err != nil {
+		c.err = c.r.corrupt(c.block.position, err)
+		return false
+	}
+	c.older = older
+	c.cur.Seq = seq
+	c.cur.Value = value
+	if seq <= c.asOf {
+		return true
+	}
+	for _, o := range older {
+		if o.Seq <= c.asOf {
+			c.cur = o
+			return true
+		}
+	}
+	return false
+}
+
+// true if the current entry has a version visible as of asOf
+func (c *Cursor) settle() bool {
+	c.parsed = false
+	if c.asOf == latest {
+		return true
+	}
+	return c.parse()
+}
+
+// skip entries with no visible version moving in dir
+func (c *Cursor) visible(more bool, dir Move) bool {
+	for more && !c.settle() {
+		if c.err != nil {
+			return false
+		}
+		more = c.nextPrev(dir)
+	}
+	return more
+}
+
+// error that stopped the cursor. Value() returns nil for
+// values that fail to decompress and sets this
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// false if key is definitely not in file
+func (c *Cursor) MayContain(key []byte) bool {
+	return c.r.MayContain(key)
 }
 
 func (c *Cursor) First() bool {
-	return c.firstLast(First)
+	return c.visible(c.firstLast(First), Next)
 }
 
 func (c *Cursor) Last() bool {
-	return c.firstLast(Last)
+	return c.visible(c.firstLast(Last), Previous)
 }
 
 func (c *Cursor) Next() bool {
-	return c.nextPrev(Next)
+	return c.visible(c.nextPrev(Next), Next)
 }
 
 func (c *Cursor) Previous() bool {
-	return c.nextPrev(Previous)
+	return c.visible(c.nextPrev(Previous), Previous)
+}
+
+func (c *Cursor) pushIndex(pos int) bool {
+	rb, err := c.r.readIndex(pos)
+	if err != nil {
+		c.err = err
+		return false
+	}
+	c.indexes = append(c.indexes, NewIndex(rb))
+	return true
+}
+
+func (c *Cursor) loadBlock(pos int) bool {
+	if c.block.Match(pos) {
+		return true
+	}
+	c.block.Close()
+	rb, err := c.r.readBlock(pos)
+	if err != nil {
+		c.err = err
+		return false
+	}
+	c.block = NewBlock(rb, pos)
+	return true
 }
 
 func (c *Cursor) Find(key []byte) FindResult {
+	rs := c.find(key)
+	if rs == NotFound || c.settle() {
+		return rs
+	}
+	if !c.visible(c.err == nil && c.nextPrev(Next), Next) {
+		return NotFound
+	}
+	return FoundGreater
+}
+
+func (c *Cursor) find(key []byte) FindResult {
+	if len(c.indexes) == 0 || c.err != nil {
+		// no data in file
+		return NotFound
+	}
 	if c.block.InRange(key) {
 		return c.block.Find(key, false)
 	}
@@ -50,7 +330,19 @@ func (c *Cursor) Find(key []byte) FindResult {
 	ikv.Position = -1
 	for i := len(c.indexes) - 1; i < len(c.indexes); i++ {
 		if !c.indexes[i].LessOrEqual(key) {
-			return NotFound
+			// key is after the last entry or between two entries
+			// so the next key is the first key of the next entry
+			if !c.indexes[i].Move(Next) {
+				return NotFound
+			}
+			ikv = c.indexes[i].Get()
+			if ikv.Type == shared.IndexBlock && !c.pushIndex(ikv.Position) {
+				return NotFound
+			}
+			if !c.follow(First, &ikv, i+1) || !c.block.Move(First) {
+				return NotFound
+			}
+			return FoundGreater
 		}
 
 		ikv = c.indexes[i].Get()
@@ -58,15 +350,13 @@ func (c *Cursor) Find(key []byte) FindResult {
 			break
 		}
 
-		buf := c.r.readBlock(ikv.Position)
-		idx := NewIndex(buf)
-		c.indexes = append(c.indexes, idx)
+		if !c.pushIndex(ikv.Position) {
+			return NotFound
+		}
 	}
 
-	if !c.block.Match(ikv.Position) {
-		c.block.Close()
-		buf := c.r.readBlock(ikv.Position)
-		c.block = NewBlock(buf, ikv.Position)
+	if !c.loadBlock(ikv.Position) {
+		return NotFound
 	}
 	return c.block.Find(key, false)
 }
@@ -84,21 +374,16 @@ func (c *Cursor) follow(dir Move, ikv *IndexKV, i int) bool {
 			c.indexes = c.indexes[:i+1]
 			break
 		}
-		buf := c.r.readBlock(ikv.Position)
-		idx := NewIndex(buf)
-		c.indexes = append(c.indexes, idx)
+		if !c.pushIndex(ikv.Position) {
+			return false
+		}
 	}
 
-	if !c.block.Match(ikv.Position) {
-		c.block.Close()
-		buf := c.r.readBlock(ikv.Position)
-		c.block = NewBlock(buf, ikv.Position)
-	}
-	return true
+	return c.loadBlock(ikv.Position)
 }
 
 func (c *Cursor) firstLast(dir Move) bool {
-	if len(c.indexes) == 0 {
+	if len(c.indexes) == 0 || c.err != nil {
 		// no data in file
 		return false
 	}
@@ -115,6 +400,9 @@ func (c *Cursor) firstLast(dir Move) bool {
 }
 
 func (c *Cursor) nextPrev(dir Move) bool {
+	if c.err != nil || c.block.rb == nil {
+		return false
+	}
 	if c.block.Move(dir) {
 		return true
 	}
@@ -133,9 +421,12 @@ func (c *Cursor) nextPrev(dir Move) bool {
 	}
 	c.indexes = c.indexes[:i+1]
 	ikv := c.indexes[len(c.indexes)-1].Get()
-	if ikv.Type == shared.IndexBlock {
-		buf := c.r.readBlock(ikv.Position)
-		c.indexes = append(c.indexes, NewIndex(buf))
+	if !c.overlaps(ikv.Key, ikv.LastKey) {
+		// moved past a bound. the block can't hold anything wanted
+		return false
+	}
+	if ikv.Type == shared.IndexBlock && !c.pushIndex(ikv.Position) {
+		return false
 	}
 	switch dir {
 	case Previous:
@@ -149,3 +440,8 @@ func (c *Cursor) nextPrev(dir Move) bool {
 	}
 	return c.block.Move(dir)
 }
+
+// range tombstones of the file. they hide keys in older files
+func (c *Cursor) Tombstones() []shared.Tombstone {
+	return c.r.tombstones
+}
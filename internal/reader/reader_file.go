@@ -1,59 +1,319 @@
 package reader
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"os"
+	"sync/atomic"
 
 	"github.com/stangelandcl/teepeedb/internal/block"
+	"github.com/stangelandcl/teepeedb/internal/bloom"
+	"github.com/stangelandcl/teepeedb/internal/cache"
 	"github.com/stangelandcl/teepeedb/internal/shared"
 )
 
+var (
+	errTooShort = errors.New("file too short")
+	errFilter   = errors.New("filter out of range or checksum mismatch")
+	errFooter   = errors.New("index position out of range")
+	errRanges   = errors.New("range tombstones out of range or checksum mismatch")
+)
+
+// block cache key for each opened file
+var nextID uint64
+
 type File struct {
 	f      Mmap
 	footer shared.FileFooter
+	// references mmapped file. nil if file has no filter
+	filter []byte
+	// range tombstones referencing the mmapped file
+	tombstones []shared.Tombstone
+	// unique while the process runs. files are reopened under
+	// the same name after a merge so the name can't be the key
+	id    uint64
+	cache *cache.Cache
+	info  os.FileInfo
+	// readers sharing this file. unmapped when it reaches zero
+	refs int64
+	// root index and the index blocks it points to. decoded on open
+	// and shared read only by every cursor so creating a cursor and
+	// most lookups only decompress the data block. keyed by position
+	pinned map[int]*block.ReadBlock
 }
 
 // return pointer because cursor references it it so it can't be
 // put in a list or moved otherwise
 func NewFile(filename string) (*File, error) {
-	r := &File{}
+	r := &File{
+		id:   atomic.AddUint64(&nextID, 1),
+		refs: 1,
+	}
 
 	f, err := NewMmap(filename)
 	if err != nil {
 		return nil, err
 	}
 	r.f = f
+	r.info, err = f.f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 	buf := f.Bytes
+	if len(buf) < 4 {
+		f.Close()
+		return nil, r.corrupt(0, errTooShort)
+	}
 	footerSize := int(binary.LittleEndian.Uint32(buf[len(buf)-4:]))
 	start := len(buf) - 4 - footerSize
-	r.footer.Unmarshal(buf[start : start+footerSize])
-	if r.footer.BlockFormat != 1 {
+	if footerSize > len(buf)-4 {
+		f.Close()
+		return nil, r.corrupt(0, errTooShort)
+	}
+	err = r.footer.Unmarshal(buf[start : start+footerSize])
+	if err != nil {
+		f.Close()
+		return nil, r.corrupt(start, err)
+	}
+	if r.footer.BlockFormat < block.Format1 || r.footer.BlockFormat > block.Format7 {
 		f.Close()
 		return nil, fmt.Errorf("teepeedb: invalid block format: %v", r.footer.BlockFormat)
 	}
+	if r.footer.FilterSize > 0 {
+		if r.footer.FilterPosition < 0 || r.footer.FilterSize > start-r.footer.FilterPosition {
+			f.Close()
+			return nil, r.corrupt(start, errFilter)
+		}
+		r.filter = buf[r.footer.FilterPosition : r.footer.FilterPosition+r.footer.FilterSize]
+		// a damaged filter would hide keys that are in the file
+		if r.footer.FilterChecksum >= 0 && r.footer.FilterChecksum != shared.Checksum(r.filter) {
+			f.Close()
+			return nil, r.corrupt(r.footer.FilterPosition, errFilter)
+		}
+	}
+	if r.footer.TombstoneSize > 0 {
+		pos := r.footer.TombstonePosition
+		if pos < 0 || r.footer.TombstoneSize > start-pos {
+			f.Close()
+			return nil, r.corrupt(start, errRanges)
+		}
+		b := buf[pos : pos+r.footer.TombstoneSize]
+		if r.footer.TombstoneChecksum != shared.Checksum(b) {
+			f.Close()
+			return nil, r.corrupt(pos, errRanges)
+		}
+		r.tombstones, err = shared.ParseTombstones(b, nil)
+		if err != nil {
+			f.Close()
+			return nil, r.corrupt(pos, err)
+		}
+	}
+	if r.footer.LastIndexPosition >= start {
+		f.Close()
+		return nil, r.corrupt(start, errFooter)
+	}
+	if r.footer.LastIndexPosition >= 0 {
+		// a damaged root fails to open instead of failing
+		// the first cursor
+		err = r.pin()
+		if err != nil {
+			r.unpin()
+			f.Close()
+			return nil, err
+		}
+	}
 
 	return r, nil
 }
 
+// read the top two index levels
+func (r *File) pin() error {
+	r.pinned = map[int]*block.ReadBlock{}
+	root, err := r.pinIndex(r.footer.LastIndexPosition)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < root.Count; i++ {
+		key, _ := root.Key(i)
+		ikv := convert(key, root.Value(i))
+		if ikv.Type != shared.IndexBlock {
+			continue
+		}
+		_, err = r.pinIndex(ikv.Position)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *File) pinIndex(pos int) (*block.ReadBlock, error) {
+	if rb, ok := r.pinned[pos]; ok {
+		return rb, nil
+	}
+	if pos < 0 || pos >= len(r.f.Bytes) {
+		return nil, r.corrupt(pos, block.ErrInvalid)
+	}
+	rb, err := block.Read(r.f.Bytes[pos:], r.footer.BlockFormat)
+	if err != nil {
+		return nil, r.corrupt(pos, err)
+	}
+	// shared by cursors so must not change after
+	err = rb.Decompress()
+	if err != nil {
+		rb.Close()
+		return nil, r.corrupt(pos, err)
+	}
+	r.pinned[pos] = rb
+	return rb, nil
+}
+
+func (r *File) unpin() {
+	for _, rb := range r.pinned {
+		rb.Close()
+	}
+	r.pinned = nil
+}
+
+// share blocks read from this file through c. call before Cursor
+func (r *File) SetCache(c *cache.Cache) {
+	r.cache = c
+}
+
+// true if fi describes this file and not one renamed over it since
+func (r *File) SameFile(fi os.FileInfo) bool {
+	return os.SameFile(r.info, fi)
+}
+
+// add an owner. each owner calls Close once
+func (r *File) Retain() {
+	atomic.AddInt64(&r.refs, 1)
+}
+
+func (r *File) Filename() string {
+	return r.f.Filename
+}
+
+func (r *File) Size() int64 {
+	return r.info.Size()
+}
+
+// first and last key in the file from the root index. nil if the file
+// is empty. valid until Close
+func (r *File) Range() (first, last []byte) {
+	root := r.pinned[r.footer.LastIndexPosition]
+	if root == nil {
+		return nil, nil
+	}
+	first, _ = root.Key(0)
+	key, _ := root.Key(root.Count - 1)
+	last = convert(key, root.Value(root.Count-1)).LastKey
+	return first, last
+}
+
+// range tombstones in the file. valid until Close
+func (r *File) Tombstones() []shared.Tombstone {
+	return r.tombstones
+}
+
+// smallest start and largest end of the file's range tombstones. nil if
+// it has none. valid until Close
+func (r *File) TombstoneRange() (start, end []byte) {
+	for i, t := range r.tombstones {
+		if i == 0 || bytes.Compare(t.Start, start) < 0 {
+			start = t.Start
+		}
+		if i == 0 || bytes.Compare(t.End, end) > 0 {
+			end = t.End
+		}
+	}
+	return start, end
+}
+
 func (r *File) Footer() shared.FileFooter {
 	return r.footer
 }
 
-func (r *File) readBlock(pos int) *block.ReadBlock {
-	return block.Read(r.f.Bytes[pos:])
+// false if key is definitely not in file
+func (r *File) MayContain(key []byte) bool {
+	if r.filter == nil {
+		return true
+	}
+	return bloom.MayContain(r.filter, key)
+}
+
+func (r *File) corrupt(pos int, err error) error {
+	return &shared.ErrCorrupt{File: r.f.Filename, Offset: pos, Err: err}
+}
+
+func (r *File) readBlock(pos int) (*block.ReadBlock, error) {
+	if r.cache != nil {
+		if rb := r.cache.Get(r.id, pos); rb != nil {
+			return rb, nil
+		}
+	}
+	if pos < 0 || pos >= len(r.f.Bytes) {
+		return nil, r.corrupt(pos, block.ErrInvalid)
+	}
+	rb, err := block.Read(r.f.Bytes[pos:], r.footer.BlockFormat)
+	if err != nil {
+		return nil, r.corrupt(pos, err)
+	}
+	if r.cache != nil {
+		// cached blocks are shared by cursors so must not change after
+		err = rb.Decompress()
+		if err != nil {
+			rb.Close()
+			return nil, r.corrupt(pos, err)
+		}
+		r.cache.Put(r.id, pos, rb)
+	}
+	return rb, nil
+}
+
+// index values are always needed so decompress them up front.
+// afterwards reading index entries can't fail
+func (r *File) readIndex(pos int) (*block.ReadBlock, error) {
+	if rb, ok := r.pinned[pos]; ok {
+		rb.Retain()
+		return rb, nil
+	}
+	rb, err := r.readBlock(pos)
+	if err != nil {
+		return nil, err
+	}
+	rb.Value(0)
+	if rb.Err() != nil {
+		err = rb.Err()
+		rb.Close()
+		return nil, r.corrupt(pos, err)
+	}
+	return rb, nil
 }
 
 func (r *File) Cursor() *Cursor {
-	c := &Cursor{r: r}
+	c := &Cursor{r: r, asOf: latest}
 	if r.footer.LastIndexPosition < 0 {
 		// empty file
 		return c
 	}
-	block := r.readBlock(r.footer.LastIndexPosition)
-	c.indexes = append(c.indexes, NewIndex(block))
+	rb, err := r.readIndex(r.footer.LastIndexPosition)
+	if err != nil {
+		c.err = err
+		return c
+	}
+	c.indexes = append(c.indexes, NewIndex(rb))
 	return c
 }
 
+// drop an owner and unmap the file after the last one
 func (r *File) Close() error {
+	if atomic.AddInt64(&r.refs, -1) != 0 {
+		return nil
+	}
+	r.unpin()
 	return r.f.Close()
 }
@@ -2,10 +2,10 @@ package reader
 
 import (
 	"bytes"
+	"encoding/binary"
 
 	"github.com/stangelandcl/teepeedb/internal/block"
 	"github.com/stangelandcl/teepeedb/internal/shared"
-	"github.com/stangelandcl/teepeedb/internal/varint"
 )
 
 type Index struct {
@@ -25,11 +25,15 @@ func NewIndex(rb *block.ReadBlock) Index {
 
 func convert(key, val []byte) (ikv IndexKV) {
 	ikv.Key = key
-	pos := 0
-	p := varint.Read(val, &pos)
-	ikv.Position = p >> 1
+	p, n := binary.Uvarint(val)
+	if n <= 0 {
+		// corrupt. reading position -1 returns ErrCorrupt
+		ikv.Position = -1
+		return ikv
+	}
+	ikv.Position = int(p >> 1)
 	ikv.Type = shared.BlockType(p & 1)
-	ikv.LastKey = val[pos:]
+	ikv.LastKey = val[n:]
 	return ikv
 }
 
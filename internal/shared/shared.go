@@ -2,7 +2,9 @@ package shared
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 )
 
 type BlockType byte
@@ -14,6 +16,9 @@ const (
 	// slightly arbitrary but 4 keys must fit in less than 32768 bytes (minus some extra fluff)
 	// because index has to hold 2 keys + the values for two keys which are also keys so 4 keys
 	MaxKeySize = 4096 - 1 // -1 is arbitrary to keep less size in less than 12 bits
+	// values are read into memory whole so keep them well under
+	// the 4 GiB of a 32 bit block offset
+	MaxValueSize = 1 << 30
 )
 
 type IndexValue struct {
@@ -26,6 +31,17 @@ type KV struct {
 	Key    []byte
 	Value  []byte
 	Delete bool
+	// Value is a pointer into a value log
+	Pointer bool
+	// Value is a merge operand applied to the older value of Key
+	Merge bool
+	// sequence of the write. see FileFooter.Sequence
+	Seq uint64
+	// unix nanosecond time the entry expires at. 0 never
+	Expires int64
+	// versions of Key overwritten by this one still needed by
+	// snapshots or as of reads. newest first
+	Older []Version
 }
 
 type FileFooter struct {
@@ -41,13 +57,63 @@ type FileFooter struct {
 	ValueSize            int
 	RawKeyBytes          int
 	RawValueBytes        int
+	// bloom filter over all keys. size 0 means no filter
+	FilterPosition int
+	FilterSize     int
+	// crc32c of the filter. -1 if the file was written without one
+	FilterChecksum int
+	// sequence of entries without a version header. 0 for merged
+	// files and files written before sequences
+	Sequence uint64
+	// lowest and highest sequence of any version in the file
+	MinSequence uint64
+	MaxSequence uint64
+	// range tombstone block. size 0 means none
+	TombstonePosition int
+	TombstoneSize     int
+	// crc32c of the range tombstone block
+	TombstoneChecksum int
+	// unix nanosecond time every entry in the file except deletes has
+	// expired by. 0 if one never expires
+	Expires int64
+	// crc32c of the footer bytes before it. always the last field.
+	// set by Marshal and checked by Unmarshal when BlockFormat >= 2
+	Checksum int
 }
 
 // Key was greater than shared.MaxKeySize
 var ErrKeyTooBig = fmt.Errorf("teepee: key too big")
 
+// Value was greater than shared.MaxValueSize
+var ErrValueTooBig = fmt.Errorf("teepee: value too big")
+
+var errFooter = errors.New("footer checksum mismatch or too short")
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32c used for footer and filter checksums
+func Checksum(buf []byte) int {
+	return int(crc32.Checksum(buf, table))
+}
+
+// returned instead of panicking when a file fails a checksum
+// or contains lengths or offsets outside the file
+type ErrCorrupt struct {
+	File   string
+	Offset int
+	Err    error
+}
+
+func (e *ErrCorrupt) Error() string {
+	return fmt.Sprintf("teepeedb: corrupt file %v at offset %v: %v", e.File, e.Offset, e.Err)
+}
+
+func (e *ErrCorrupt) Unwrap() error {
+	return e.Err
+}
+
 func (h *FileFooter) Marshal() []byte {
-	buf := make([]byte, 12*8) // fields x sizeof(uint64)
+	buf := make([]byte, 23*8) // fields x sizeof(uint64)
 	i := 0
 	binary.LittleEndian.PutUint64(buf[i:], uint64(h.BlockSize))
 	i += 8
@@ -73,10 +139,52 @@ func (h *FileFooter) Marshal() []byte {
 	i += 8
 	binary.LittleEndian.PutUint64(buf[i:], uint64(h.RawValueBytes))
 	i += 8
-	return buf
+	binary.LittleEndian.PutUint64(buf[i:], uint64(h.FilterPosition))
+	i += 8
+	binary.LittleEndian.PutUint64(buf[i:], uint64(h.FilterSize))
+	i += 8
+	binary.LittleEndian.PutUint64(buf[i:], uint64(h.FilterChecksum))
+	i += 8
+	binary.LittleEndian.PutUint64(buf[i:], h.Sequence)
+	i += 8
+	binary.LittleEndian.PutUint64(buf[i:], h.MinSequence)
+	i += 8
+	binary.LittleEndian.PutUint64(buf[i:], h.MaxSequence)
+	i += 8
+	binary.LittleEndian.PutUint64(buf[i:], uint64(h.TombstonePosition))
+	i += 8
+	binary.LittleEndian.PutUint64(buf[i:], uint64(h.TombstoneSize))
+	i += 8
+	binary.LittleEndian.PutUint64(buf[i:], uint64(h.TombstoneChecksum))
+	i += 8
+	binary.LittleEndian.PutUint64(buf[i:], uint64(h.Expires))
+	i += 8
+	if h.BlockFormat >= 2 {
+		h.Checksum = int(crc32.Checksum(buf[:i], table))
+		binary.LittleEndian.PutUint64(buf[i:], uint64(h.Checksum))
+		i += 8
+	}
+	return buf[:i]
 }
 
-func (h *FileFooter) Unmarshal(buf []byte) {
+func (h *FileFooter) Unmarshal(buf []byte) error {
+	// oldest footer has 10 fields
+	if len(buf) < 10*8 {
+		return errFooter
+	}
+	// checksum is last so fields can still be added before it
+	if binary.LittleEndian.Uint64(buf[8:]) >= 2 {
+		n := len(buf) - 8
+		h.Checksum = int(binary.LittleEndian.Uint64(buf[n:]))
+		if h.Checksum != int(crc32.Checksum(buf[:n], table)) {
+			return errFooter
+		}
+		buf = buf[:n]
+		if len(buf) < 10*8 {
+			return errFooter
+		}
+	}
+
 	i := 0
 	h.BlockSize = int(binary.LittleEndian.Uint64(buf[i:]))
 	i += 8
@@ -99,13 +207,61 @@ func (h *FileFooter) Unmarshal(buf []byte) {
 	h.ValueSize = int(binary.LittleEndian.Uint64(buf[i:]))
 	i += 8
 	// other fields were added later. maintain backwards compatibility
-	if i == len(buf) {
+	if len(buf) < i+2*8 {
 		h.RawKeyBytes = 0
 		h.RawValueBytes = 0
-		return
+		h.FilterChecksum = -1
+		return nil
 	}
 	h.RawKeyBytes = int(binary.LittleEndian.Uint64(buf[i:]))
 	i += 8
 	h.RawValueBytes = int(binary.LittleEndian.Uint64(buf[i:]))
 	i += 8
+	if len(buf) < i+2*8 {
+		h.FilterPosition = 0
+		h.FilterSize = 0
+		h.FilterChecksum = -1
+		return nil
+	}
+	h.FilterPosition = int(binary.LittleEndian.Uint64(buf[i:]))
+	i += 8
+	h.FilterSize = int(binary.LittleEndian.Uint64(buf[i:]))
+	i += 8
+	if len(buf) < i+8 {
+		h.FilterChecksum = -1
+		return nil
+	}
+	h.FilterChecksum = int(binary.LittleEndian.Uint64(buf[i:]))
+	i += 8
+	if len(buf) < i+3*8 {
+		h.Sequence = 0
+		h.MinSequence = 0
+		h.MaxSequence = 0
+		return nil
+	}
+	h.Sequence = binary.LittleEndian.Uint64(buf[i:])
+	i += 8
+	h.MinSequence = binary.LittleEndian.Uint64(buf[i:])
+	i += 8
+	h.MaxSequence = binary.LittleEndian.Uint64(buf[i:])
+	i += 8
+	if len(buf) < i+3*8 {
+		h.TombstonePosition = 0
+		h.TombstoneSize = 0
+		h.TombstoneChecksum = 0
+		return nil
+	}
+	h.TombstonePosition = int(binary.LittleEndian.Uint64(buf[i:]))
+	i += 8
+	h.TombstoneSize = int(binary.LittleEndian.Uint64(buf[i:]))
+	i += 8
+	h.TombstoneChecksum = int(binary.LittleEndian.Uint64(buf[i:]))
+	i += 8
+	if len(buf) < i+8 {
+		h.Expires = 0
+		return nil
+	}
+	h.Expires = int64(binary.LittleEndian.Uint64(buf[i:]))
+	i += 8
+	return nil
 }
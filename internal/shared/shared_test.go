@@ -18,6 +18,16 @@ func TestFooter(t *testing.T) {
 		BlockFormat:          1,
 		RawKeyBytes:          10,
 		RawValueBytes:        11,
+		FilterPosition:       12,
+		FilterSize:           13,
+		FilterChecksum:       14,
+		Sequence:             15,
+		MinSequence:          16,
+		MaxSequence:          17,
+		TombstonePosition:    18,
+		TombstoneSize:        19,
+		TombstoneChecksum:    20,
+		Expires:              21,
 	}
 
 	buf := x.Marshal()
@@ -60,4 +70,155 @@ func TestFooter(t *testing.T) {
 	if x.RawValueBytes != y.RawValueBytes {
 		panic("val bytes")
 	}
+	if x.FilterPosition != y.FilterPosition {
+		panic("filter position")
+	}
+	if x.FilterSize != y.FilterSize {
+		panic("filter size")
+	}
+	if x.FilterChecksum != y.FilterChecksum {
+		panic("filter checksum")
+	}
+	if x.Sequence != y.Sequence || x.MinSequence != y.MinSequence || x.MaxSequence != y.MaxSequence {
+		panic("sequence")
+	}
+	if x.TombstonePosition != y.TombstonePosition || x.TombstoneSize != y.TombstoneSize || x.TombstoneChecksum != y.TombstoneChecksum {
+		panic("tombstones")
+	}
+	if x.Expires != y.Expires {
+		panic("expires")
+	}
+
+	// checksum is only written from block format 2
+	x.BlockFormat = 2
+	buf = x.Marshal()
+	y = FileFooter{}
+	if y.Unmarshal(buf) != nil || y.FilterSize != x.FilterSize || y.Checksum == 0 {
+		panic("checksum")
+	}
+	buf[3] ^= 1
+	if y.Unmarshal(buf) == nil {
+		panic("checksum mismatch")
+	}
+	x.BlockFormat = 1
+	buf = x.Marshal()
+
+	// footers written before the filter fields existed
+	y = FileFooter{}
+	y.Unmarshal(buf[:12*8])
+	if y.RawValueBytes != x.RawValueBytes || y.FilterSize != 0 || y.FilterChecksum != -1 {
+		panic("old footer")
+	}
+	y = FileFooter{}
+	y.Unmarshal(buf[:14*8])
+	if y.FilterSize != x.FilterSize || y.FilterChecksum != -1 {
+		panic("footer without filter checksum")
+	}
+	y = FileFooter{}
+	y.Unmarshal(buf[:15*8])
+	if y.FilterChecksum != x.FilterChecksum || y.Sequence != 0 || y.MaxSequence != 0 {
+		panic("footer without sequences")
+	}
+	y = FileFooter{}
+	y.Unmarshal(buf[:18*8])
+	if y.MaxSequence != x.MaxSequence || y.TombstoneSize != 0 {
+		panic("footer without tombstones")
+	}
+	y = FileFooter{}
+	y.Unmarshal(buf[:21*8])
+	if y.TombstoneChecksum != x.TombstoneChecksum || y.Expires != 0 {
+		panic("footer without expiry")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	kv := KV{
+		Value: []byte("new"),
+		Seq:   9,
+		Older: []Version{
+			{Seq: 7, Delete: true},
+			{Seq: 5, Value: []byte("ptr"), Pointer: true, Expires: 1 << 40},
+			{Seq: 2, Value: []byte("old")},
+		},
+	}
+	buf := AppendVersions(nil, &kv)
+	seq, value, older, err := ParseVersions(buf, nil)
+	if err != nil || seq != 9 || string(value) != "new" || len(older) != 3 {
+		panic("parse")
+	}
+	for i, v := range older {
+		o := kv.Older[i]
+		if v.Seq != o.Seq || string(v.Value) != string(o.Value) || v.Delete != o.Delete || v.Pointer != o.Pointer || v.Expires != o.Expires {
+			panic("older version")
+		}
+	}
+	for i := 0; i < len(buf)-len(value); i++ {
+		if _, _, _, err = ParseVersions(buf[:i], nil); err == nil {
+			panic("truncated header")
+		}
+	}
+
+	// horizon 6 keeps 9 and 7 plus 5, which reads at 6 see
+	versions := append([]Version{{Seq: 9, Value: []byte("new")}}, kv.Older...)
+	out := KV{}
+	if !Collapse(&out, versions, 6, false) || out.Seq != 9 || len(out.Older) != 2 ||
+		out.Older[1].Seq != 0 || !out.Older[1].Pointer {
+		panic("collapse")
+	}
+	// 7 is a delete every read sees so nothing is left at the bottom level
+	versions = append(versions[:0], Version{Seq: 7, Delete: true}, Version{Seq: 2})
+	if Collapse(&out, versions, 8, true) {
+		panic("hard delete")
+	}
+
+	// operands every read sees keep the operands and version under them
+	versions = append(versions[:0],
+		Version{Seq: 9, Value: []byte("+1"), Merge: true},
+		Version{Seq: 4, Value: []byte("+2"), Merge: true},
+		Version{Seq: 3, Value: []byte("+3"), Merge: true},
+		Version{Seq: 2, Value: []byte("old")},
+		Version{Seq: 1, Value: []byte("older")})
+	if !Collapse(&out, versions, 5, false) || !out.Merge || len(out.Older) != 3 ||
+		out.Older[1].Seq != 0 || !out.Older[1].Merge || out.Older[2].Merge {
+		panic("collapse operands")
+	}
+	_, _, older, err = ParseVersions(AppendVersions(nil, &out), nil)
+	if err != nil || len(older) != 3 || !older[0].Merge || !older[1].Merge || older[2].Merge {
+		panic("parse operands")
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	ts := []Tombstone{
+		{Start: []byte("a"), End: []byte("c"), Seq: 3},
+		{Start: []byte{}, End: []byte("zz"), Seq: 0},
+	}
+	buf := AppendTombstones(nil, ts)
+	out, err := ParseTombstones(buf, nil)
+	if err != nil || len(out) != 2 || out[0].Seq != 3 || string(out[1].End) != "zz" || len(out[1].Start) != 0 {
+		panic("parse tombstones")
+	}
+	if !out[0].Covers([]byte("a")) || !out[0].Covers([]byte("bz")) || out[0].Covers([]byte("c")) {
+		panic("covers")
+	}
+	for i := 0; i < len(buf); i++ {
+		if _, err = ParseTombstones(buf[:i], nil); err == nil {
+			panic("truncated tombstones")
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	buf := AppendExpiry(nil, 1<<50)
+	expires, value, err := ParseExpiry(append(buf, "value"...))
+	if err != nil || expires != 1<<50 || string(value) != "value" {
+		panic("parse expiry")
+	}
+	if _, _, err = ParseExpiry(buf[:len(buf)-1]); err == nil {
+		panic("truncated expiry")
+	}
+	v := Version{Expires: 10}
+	if v.Expired(9) || !v.Expired(10) || (&Version{}).Expired(1<<62) {
+		panic("expired")
+	}
 }
@@ -0,0 +1,71 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errTombstones = errors.New("invalid range tombstone block")
+
+// deletes every key from Start up to but not including End written
+// before Seq. it hides keys in older files only, never keys in the file
+// holding it
+type Tombstone struct {
+	Start []byte
+	End   []byte
+	Seq   uint64
+}
+
+// true if key is in [Start, End)
+func (t *Tombstone) Covers(key []byte) bool {
+	return bytes.Compare(t.Start, key) <= 0 && bytes.Compare(key, t.End) < 0
+}
+
+// range tombstone block:
+// 1. unsigned varint count of tombstones
+// 2. each tombstone: unsigned varint sequence, unsigned varint start
+// length, start, unsigned varint end length, end
+func AppendTombstones(dst []byte, tombstones []Tombstone) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(tombstones)))
+	for _, t := range tombstones {
+		dst = binary.AppendUvarint(dst, t.Seq)
+		dst = binary.AppendUvarint(dst, uint64(len(t.Start)))
+		dst = append(dst, t.Start...)
+		dst = binary.AppendUvarint(dst, uint64(len(t.End)))
+		dst = append(dst, t.End...)
+	}
+	return dst
+}
+
+// tombstones written by AppendTombstones appended to dst. they
+// reference buf
+func ParseTombstones(buf []byte, dst []Tombstone) ([]Tombstone, error) {
+	count, n := binary.Uvarint(buf)
+	// every tombstone takes at least 3 bytes
+	if n <= 0 || count > uint64(len(buf))/3 {
+		return dst, errTombstones
+	}
+	buf = buf[n:]
+	for i := 0; i < int(count); i++ {
+		t := Tombstone{}
+		t.Seq, n = binary.Uvarint(buf)
+		if n <= 0 {
+			return dst, errTombstones
+		}
+		buf = buf[n:]
+		for _, b := range []*[]byte{&t.Start, &t.End} {
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || size > uint64(len(buf)-n) {
+				return dst, errTombstones
+			}
+			*b = buf[n : n+int(size)]
+			buf = buf[n+int(size):]
+		}
+		dst = append(dst, t)
+	}
+	if len(buf) != 0 {
+		return dst, errTombstones
+	}
+	return dst, nil
+}
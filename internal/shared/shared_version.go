@@ -0,0 +1,177 @@
+package shared
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// flags byte of an older version
+const (
+	versionDelete  = 1
+	versionPointer = 2
+	versionMerge   = 4
+	versionExpire  = 8
+)
+
+var (
+	errVersions = errors.New("invalid version header")
+	errExpiry   = errors.New("invalid expiry")
+)
+
+// version of a key older than the entry holding it
+type Version struct {
+	Seq     uint64
+	Value   []byte
+	Delete  bool
+	Pointer bool
+	Merge   bool
+	// unix nanosecond time the version expires at. 0 never
+	Expires int64
+}
+
+// true if the version expired at or before unix nanosecond time now
+func (v *Version) Expired(now int64) bool {
+	return v.Expires != 0 && v.Expires <= now
+}
+
+// value of an entry with a version header:
+// 1. unsigned varint sequence of the entry
+// 2. unsigned varint count of older versions
+// 3. each older version newest first: unsigned varint sequence,
+// flags byte (1 delete, 2 pointer, 4 merge, 8 expire), unsigned varint
+// expiry if 8 is set, unsigned varint value length, value
+// 4. value of the entry
+func AppendVersions(dst []byte, kv *KV) []byte {
+	dst = binary.AppendUvarint(dst, kv.Seq)
+	dst = binary.AppendUvarint(dst, uint64(len(kv.Older)))
+	for _, v := range kv.Older {
+		var flags byte
+		if v.Delete {
+			flags |= versionDelete
+		}
+		if v.Pointer {
+			flags |= versionPointer
+		}
+		if v.Merge {
+			flags |= versionMerge
+		}
+		if v.Expires != 0 {
+			flags |= versionExpire
+		}
+		dst = binary.AppendUvarint(dst, v.Seq)
+		dst = append(dst, flags)
+		if v.Expires != 0 {
+			dst = binary.AppendUvarint(dst, uint64(v.Expires))
+		}
+		dst = binary.AppendUvarint(dst, uint64(len(v.Value)))
+		dst = append(dst, v.Value...)
+	}
+	return append(dst, kv.Value...)
+}
+
+// split a value written by AppendVersions. older versions are appended
+// to dst and reference buf
+func ParseVersions(buf []byte, dst []Version) (seq uint64, value []byte, older []Version, err error) {
+	seq, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, nil, dst, errVersions
+	}
+	buf = buf[n:]
+	count, n := binary.Uvarint(buf)
+	// every version takes at least 3 bytes
+	if n <= 0 || count > uint64(len(buf))/3 {
+		return 0, nil, dst, errVersions
+	}
+	buf = buf[n:]
+	for i := 0; i < int(count); i++ {
+		v := Version{}
+		v.Seq, n = binary.Uvarint(buf)
+		if n <= 0 || n >= len(buf) {
+			return 0, nil, dst, errVersions
+		}
+		flags := buf[n]
+		v.Delete = flags&versionDelete != 0
+		v.Pointer = flags&versionPointer != 0
+		v.Merge = flags&versionMerge != 0
+		buf = buf[n+1:]
+		if flags&versionExpire != 0 {
+			expires, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return 0, nil, dst, errVersions
+			}
+			v.Expires = int64(expires)
+			buf = buf[n:]
+		}
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || size > uint64(len(buf)-n) {
+			return 0, nil, dst, errVersions
+		}
+		v.Value = buf[n : n+int(size)]
+		buf = buf[n+int(size):]
+		dst = append(dst, v)
+	}
+	return seq, buf, dst, nil
+}
+
+// prefix of a value whose entry expires. see block.FlagExpire
+func AppendExpiry(dst []byte, expires int64) []byte {
+	return binary.AppendUvarint(dst, uint64(expires))
+}
+
+// split a value written after AppendExpiry
+func ParseExpiry(buf []byte) (expires int64, value []byte, err error) {
+	x, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, nil, errExpiry
+	}
+	return int64(x), buf[n:], nil
+}
+
+// number of versions newest first that reads from horizon on can still
+// see. the rest are garbage once Collapse runs
+func Readable(versions []Version, horizon uint64) int {
+	for i := range versions {
+		if versions[i].Seq > horizon {
+			continue
+		}
+		j := i
+		for versions[j].Merge && j+1 < len(versions) {
+			j++
+		}
+		return j + 1
+	}
+	return len(versions)
+}
+
+// set kv from versions of one key newest first keeping those newer than
+// horizon and the newest at or before it, the one every read from
+// horizon on sees. its sequence is dropped. if it is a merge operand
+// the older operands and the version under them are kept too.
+// hardDelete drops it if it is a delete. false if no version is left
+func Collapse(kv *KV, versions []Version, horizon uint64, hardDelete bool) bool {
+	n := Readable(versions, horizon)
+	versions = versions[:n]
+	for i := range versions {
+		if versions[i].Seq > horizon {
+			continue
+		}
+		for k := i; k < n; k++ {
+			versions[k].Seq = 0
+		}
+		if hardDelete && versions[i].Delete {
+			versions = versions[:i]
+		}
+		break
+	}
+	if len(versions) == 0 {
+		return false
+	}
+	kv.Value = versions[0].Value
+	kv.Delete = versions[0].Delete
+	kv.Pointer = versions[0].Pointer
+	kv.Merge = versions[0].Merge
+	kv.Seq = versions[0].Seq
+	kv.Expires = versions[0].Expires
+	kv.Older = versions[1:]
+	return true
+}
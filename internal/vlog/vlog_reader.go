@@ -0,0 +1,145 @@
+package vlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+var ErrInvalid = errors.New("value log record checksum or length mismatch")
+
+// location of a record in a value log. stored in data blocks in place
+// of the value
+type Pointer struct {
+	File   int64
+	Offset int64
+	Size   int
+}
+
+// unsigned varints of file, offset and size
+func (p Pointer) Append(dst []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(p.File))
+	dst = binary.AppendUvarint(dst, uint64(p.Offset))
+	dst = binary.AppendUvarint(dst, uint64(p.Size))
+	return dst
+}
+
+func DecodePointer(buf []byte) (Pointer, error) {
+	p := Pointer{}
+	file, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return p, ErrInvalid
+	}
+	buf = buf[n:]
+	offset, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return p, ErrInvalid
+	}
+	buf = buf[n:]
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || n != len(buf) {
+		return p, ErrInvalid
+	}
+	p.File = int64(file)
+	p.Offset = int64(offset)
+	p.Size = int(size)
+	return p, nil
+}
+
+// read record at p into buf and return its value. buf is reused
+// if large enough. val references buf
+func Read(f *os.File, p Pointer, buf []byte) (val, newbuf []byte, err error) {
+	if p.Offset < 0 || p.Size < 0 {
+		return nil, buf, ErrInvalid
+	}
+	if cap(buf) < p.Size {
+		// don't trust a corrupt pointer with a large allocation
+		st, err := f.Stat()
+		if err != nil {
+			return nil, buf, err
+		}
+		if int64(p.Size) > st.Size()-p.Offset {
+			return nil, buf, ErrInvalid
+		}
+		buf = make([]byte, p.Size)
+	}
+	buf = buf[:p.Size]
+	_, err = f.ReadAt(buf, p.Offset)
+	if err != nil {
+		return nil, buf, err
+	}
+	_, val, n := parse(buf)
+	if n != p.Size {
+		return nil, buf, ErrInvalid
+	}
+	return val, buf, nil
+}
+
+// parse record at start of buf. n is 0 if buf doesn't start
+// with a whole valid record
+func parse(buf []byte) (key, val []byte, n int) {
+	size, i := binary.Uvarint(buf)
+	if i <= 0 || len(buf) < i+4 {
+		return nil, nil, 0
+	}
+	crc := binary.LittleEndian.Uint32(buf[i:])
+	body := buf[i+4:]
+	if size > uint64(len(body)) {
+		return nil, nil, 0
+	}
+	body = body[:size]
+	if crc32.Checksum(body, table) != crc {
+		return nil, nil, 0
+	}
+	klen, j := binary.Uvarint(body)
+	if j <= 0 || klen > uint64(len(body)-j) {
+		return nil, nil, 0
+	}
+	key = body[j : j+int(klen)]
+	val = body[j+int(klen):]
+	return key, val, i + 4 + int(size)
+}
+
+// call fn with the pointer and key of every record in write order.
+// stops without error at a torn or corrupt tail
+func Scan(filename string, number int64, fn func(p Pointer, key []byte) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	var buf []byte
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil
+		}
+		if size > 1<<31 {
+			// larger than any key and value
+			return nil
+		}
+		// header + payload so the record parses the same as Read
+		buf = binary.AppendUvarint(buf[:0], size)
+		n := len(buf) + 4 + int(size)
+		buf = append(buf, make([]byte, n-len(buf))...)
+		_, err = io.ReadFull(r, buf[n-4-int(size):])
+		if err != nil {
+			return nil
+		}
+		key, _, m := parse(buf)
+		if m != n {
+			return nil
+		}
+		err = fn(Pointer{File: number, Offset: offset, Size: n}, key)
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+}
@@ -0,0 +1,88 @@
+package vlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	os.Remove("test.vlog")
+	defer os.Remove("test.vlog")
+
+	w, err := Create("test.vlog", 7)
+	if err != nil {
+		panic(err)
+	}
+	count := 1000
+	value := func(i int) []byte {
+		return bytes.Repeat(binary.BigEndian.AppendUint32(nil, uint32(i)), i)
+	}
+	var pointers [][]byte
+	for i := 0; i < count; i++ {
+		p, err := w.Append(binary.BigEndian.AppendUint32(nil, uint32(i)), value(i))
+		if err != nil {
+			panic(err)
+		}
+		pointers = append(pointers, p.Append(nil))
+	}
+	err = w.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	f, err := os.Open("test.vlog")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	var buf []byte
+	for i := count - 1; i >= 0; i-- {
+		p, err := DecodePointer(pointers[i])
+		if err != nil || p.File != 7 {
+			log.Panicln("pointer", i, p, err)
+		}
+		var val []byte
+		val, buf, err = Read(f, p, buf)
+		if err != nil || !bytes.Equal(val, value(i)) {
+			log.Panicln("read", i, err)
+		}
+	}
+
+	i := 0
+	err = Scan("test.vlog", 7, func(p Pointer, key []byte) error {
+		if !bytes.Equal(p.Append(nil), pointers[i]) || int(binary.BigEndian.Uint32(key)) != i {
+			log.Panicln("scan", i, p)
+		}
+		i++
+		return nil
+	})
+	if err != nil || i != count {
+		log.Panicln("scanned", i, err)
+	}
+
+	// flipped bit fails the read and stops the scan
+	data, _ := os.ReadFile("test.vlog")
+	p, _ := DecodePointer(pointers[count/2])
+	data[p.Offset+int64(p.Size)/2] ^= 0x10
+	os.WriteFile("test.vlog", data, 0644)
+	_, _, err = Read(f, p, buf)
+	if err == nil {
+		log.Panicln("corruption not detected")
+	}
+	// size past the end of the file fails before allocating
+	_, _, err = Read(f, Pointer{File: 7, Offset: p.Offset, Size: 1 << 40}, nil)
+	if err != ErrInvalid {
+		log.Panicln("huge pointer", err)
+	}
+	i = 0
+	Scan("test.vlog", 7, func(p Pointer, key []byte) error {
+		i++
+		return nil
+	})
+	if i != count/2 {
+		log.Panicln("scanned corrupt", i)
+	}
+}
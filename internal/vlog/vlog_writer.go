@@ -0,0 +1,98 @@
+package vlog
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+)
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+// append only file of values too large to copy on every merge.
+// data blocks store a Pointer instead of the value
+//
+// each record is:
+// 1. unsigned varint length of payload
+// 2. little-endian uint32 crc32c of payload
+// 3. payload: unsigned varint key length, key, value
+//
+// the key is kept so garbage collection can look up whether
+// a record is still live
+type Writer struct {
+	Filename string
+	Number   int64
+	f        *os.File
+	buf      []byte
+	size     int64
+	err      error
+}
+
+func Create(filename string, number int64) (*Writer, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		Filename: filename,
+		Number:   number,
+		f:        f,
+	}, nil
+}
+
+// append record and return a pointer to it. not safe for concurrent use
+func (w *Writer) Append(key, val []byte) (Pointer, error) {
+	if w.err != nil {
+		return Pointer{}, w.err
+	}
+	// reserve room for the header then fill it in once the payload is known
+	hdr := binary.MaxVarintLen64 + 4
+	w.buf = append(w.buf[:0], make([]byte, hdr)...)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(key)))
+	w.buf = append(w.buf, key...)
+	w.buf = append(w.buf, val...)
+
+	body := w.buf[hdr:]
+	tmp := [binary.MaxVarintLen64 + 4]byte{}
+	i := binary.PutUvarint(tmp[:], uint64(len(body)))
+	binary.LittleEndian.PutUint32(tmp[i:], crc32.Checksum(body, table))
+	i += 4
+	start := hdr - i
+	copy(w.buf[start:], tmp[:i])
+	record := w.buf[start:]
+
+	_, err := w.f.Write(record)
+	if err != nil {
+		// a partial record would corrupt every pointer after it
+		w.err = err
+		return Pointer{}, err
+	}
+	p := Pointer{
+		File:   w.Number,
+		Offset: w.size,
+		Size:   len(record),
+	}
+	w.size += int64(len(record))
+	return p, nil
+}
+
+// bytes written
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
+// values must be on disk before a file pointing to them is committed
+func (w *Writer) Sync() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.f.Sync()
+}
+
+func (w *Writer) Close() error {
+	err := w.f.Sync()
+	err2 := w.f.Close()
+	if err != nil {
+		return err
+	}
+	return err2
+}
@@ -0,0 +1,60 @@
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+)
+
+// call fn for every record in log in write order. seq is 0 for
+// records written before sequences.
+// stops at the first torn or corrupt record since everything after it
+// was never acknowledged as synced. returns number of records read
+func Replay(filename string, fn func(kind Kind, key, val []byte, seq uint64)) (int, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for len(buf) > 0 {
+		n, i := binary.Uvarint(buf)
+		if i <= 0 || len(buf) < i+4 {
+			break
+		}
+		crc := binary.LittleEndian.Uint32(buf[i:])
+		buf = buf[i+4:]
+		if n > uint64(len(buf)) {
+			break
+		}
+		payload := buf[:n]
+		buf = buf[n:]
+		if crc32.Checksum(payload, table) != crc {
+			break
+		}
+
+		if len(payload) == 0 {
+			break
+		}
+		kind := Kind(payload[0])
+		payload = payload[1:]
+		var seq uint64
+		if kind&hasSequence != 0 {
+			kind &^= hasSequence
+			seq, i = binary.Uvarint(payload)
+			if i <= 0 {
+				break
+			}
+			payload = payload[i:]
+		}
+		klen, i := binary.Uvarint(payload)
+		if i <= 0 || klen > uint64(len(payload)-i) {
+			break
+		}
+		key := payload[i : i+int(klen)]
+		val := payload[i+int(klen):]
+		fn(kind, key, val, seq)
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,111 @@
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	os.Remove("test.log")
+	defer os.Remove("test.log")
+
+	l, err := Create("test.log")
+	if err != nil {
+		panic(err)
+	}
+
+	count := 10_000
+	wg := sync.WaitGroup{}
+	lock := sync.Mutex{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < count; i += 4 {
+				k := binary.BigEndian.AppendUint32(nil, uint32(i))
+				kind := Put
+				if i%5 == 0 {
+					kind = Delete
+				}
+				lock.Lock()
+				pos, err := l.Append(kind, k, k, uint64(i+1), SyncNone)
+				lock.Unlock()
+				if err != nil {
+					panic(err)
+				}
+				if i%100 == 0 {
+					err = l.Sync(pos)
+					if err != nil {
+						panic(err)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	err = l.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	seen := make([]bool, count)
+	n, err := Replay("test.log", func(kind Kind, key, val []byte, seq uint64) {
+		i := binary.BigEndian.Uint32(key)
+		if (kind == Delete) != (i%5 == 0) || binary.BigEndian.Uint32(val) != i || seq != uint64(i+1) {
+			log.Panicln("bad record", i, kind)
+		}
+		seen[i] = true
+	})
+	if err != nil {
+		panic(err)
+	}
+	if n != count {
+		log.Panicln("replayed", n, "of", count)
+	}
+	for i, ok := range seen {
+		if !ok {
+			log.Panicln("missing", i)
+		}
+	}
+
+	// torn write at the end stops replay without error
+	buf, _ := os.ReadFile("test.log")
+	os.WriteFile("test.log", buf[:len(buf)-3], 0644)
+	n, err = Replay("test.log", func(kind Kind, key, val []byte, seq uint64) {})
+	if err != nil || n != count-1 {
+		log.Panicln("torn", n, err)
+	}
+
+	// flipped bit stops replay at that record
+	buf[len(buf)/2] ^= 0x10
+	os.WriteFile("test.log", buf, 0644)
+	n, err = Replay("test.log", func(kind Kind, key, val []byte, seq uint64) {})
+	if err != nil || n >= count-1 {
+		log.Panicln("corrupt", n, err)
+	}
+}
+
+func TestLogWithoutSequence(t *testing.T) {
+	os.Remove("test.log")
+	defer os.Remove("test.log")
+
+	// record as written before sequences: kind, key length, key, value
+	payload := []byte{byte(Delete), 1, 'k', 'v'}
+	buf := binary.AppendUvarint(nil, uint64(len(payload)))
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(payload, table))
+	buf = append(buf, payload...)
+	os.WriteFile("test.log", buf, 0644)
+
+	n, err := Replay("test.log", func(kind Kind, key, val []byte, seq uint64) {
+		if kind != Delete || string(key) != "k" || string(val) != "v" || seq != 0 {
+			log.Panicln("bad record", kind, key, val, seq)
+		}
+	})
+	if err != nil || n != 1 {
+		log.Panicln("replayed", n, err)
+	}
+}
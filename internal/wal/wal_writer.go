@@ -0,0 +1,169 @@
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"sync"
+)
+
+type SyncMode int
+
+const (
+	// write to the OS but don't fsync. survives a process crash
+	// but not power loss
+	SyncNone SyncMode = iota
+	// fsync before every write returns
+	SyncAlways
+	// writes waiting on a sync share one fsync
+	SyncGroup
+)
+
+type Kind byte
+
+const (
+	Put    Kind = 0
+	Delete Kind = 1
+
+	// set in the kind byte of records followed by a sequence.
+	// logs written before sequences don't have it
+	hasSequence = 0x80
+)
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+// append only log segment
+//
+// each record is:
+// 1. unsigned varint length of payload
+// 2. little-endian uint32 crc32c of payload
+// 3. payload: kind byte, unsigned varint sequence, unsigned varint key
+// length, key, value
+type Log struct {
+	Filename string
+	f        *os.File
+	buf      []byte
+	err      error
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	written int64
+	synced  int64
+	syncing bool
+	closed  bool
+}
+
+func Create(filename string) (*Log, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{
+		Filename: filename,
+		f:        f,
+	}
+	l.cond = sync.NewCond(&l.lock)
+	return l, nil
+}
+
+// append record and return position to pass to Sync.
+// caller orders appends. with SyncAlways the record is on disk on return
+func (l *Log) Append(kind Kind, key, val []byte, seq uint64, mode SyncMode) (int64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// reserve room for the header then fill it in once the payload is known
+	hdr := binary.MaxVarintLen64 + 4
+	l.buf = append(l.buf[:0], make([]byte, hdr)...)
+	l.buf = append(l.buf, byte(kind)|hasSequence)
+	l.buf = binary.AppendUvarint(l.buf, seq)
+	l.buf = binary.AppendUvarint(l.buf, uint64(len(key)))
+	l.buf = append(l.buf, key...)
+	l.buf = append(l.buf, val...)
+
+	payload := l.buf[hdr:]
+	tmp := [binary.MaxVarintLen64 + 4]byte{}
+	i := binary.PutUvarint(tmp[:], uint64(len(payload)))
+	binary.LittleEndian.PutUint32(tmp[i:], crc32.Checksum(payload, table))
+	i += 4
+	start := hdr - i
+	copy(l.buf[start:], tmp[:i])
+	record := l.buf[start:]
+
+	if l.err != nil {
+		return 0, l.err
+	}
+	_, err := l.f.Write(record)
+	if err != nil {
+		// a partial record would hide every record after it on replay
+		l.err = err
+		return 0, err
+	}
+	l.written += int64(len(record))
+	if mode == SyncAlways {
+		err = l.f.Sync()
+		if err != nil {
+			l.err = err
+			return 0, err
+		}
+		l.synced = l.written
+	}
+	return l.written, nil
+}
+
+// wait until everything up to pos is on disk. concurrent callers
+// share one fsync (group commit)
+func (l *Log) Sync(pos int64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for l.synced < pos {
+		if l.err != nil {
+			return l.err
+		}
+		if l.syncing {
+			l.cond.Wait()
+			continue
+		}
+		// become leader and sync for every write so far
+		l.syncing = true
+		target := l.written
+		l.lock.Unlock()
+		err := l.f.Sync()
+		l.lock.Lock()
+		l.syncing = false
+		if err != nil {
+			l.err = err
+		} else if target > l.synced {
+			l.synced = target
+		}
+		l.cond.Broadcast()
+	}
+	return nil
+}
+
+// sync and close. writers waiting in Sync are released
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	for l.syncing {
+		l.cond.Wait()
+	}
+	l.closed = true
+	err := l.f.Sync()
+	if err == nil {
+		l.synced = l.written
+	} else if l.err == nil {
+		l.err = err
+	}
+	l.cond.Broadcast()
+	err2 := l.f.Close()
+	if err != nil {
+		return err
+	}
+	return err2
+}
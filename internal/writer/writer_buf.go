@@ -2,7 +2,10 @@ package writer
 
 import (
 	"bufio"
+	"context"
 	"os"
+
+	"github.com/stangelandcl/teepeedb/internal/ratelimit"
 )
 
 // buffered file with position
@@ -11,6 +14,10 @@ type Buffered struct {
 	f        *os.File
 	Position int
 	closed   bool
+	// writes wait on limit. nil is unlimited. a wait ended by ctx
+	// fails the write
+	limit *ratelimit.Limiter
+	ctx   context.Context
 }
 
 func NewBuffered(filename string) (*Buffered, error) {
@@ -24,6 +31,10 @@ func NewBuffered(filename string) (*Buffered, error) {
 	}, nil
 }
 func (b *Buffered) Write(buf []byte) (int, error) {
+	err := b.limit.Wait(b.ctx, len(buf))
+	if err != nil {
+		return 0, err
+	}
 	n, err := b.w.Write(buf)
 	b.Position += n
 	return n, err
@@ -1,9 +1,12 @@
 package writer
 
 import (
+	"context"
 	"encoding/binary"
 
 	"github.com/stangelandcl/teepeedb/internal/block"
+	"github.com/stangelandcl/teepeedb/internal/bloom"
+	"github.com/stangelandcl/teepeedb/internal/ratelimit"
 	"github.com/stangelandcl/teepeedb/internal/shared"
 )
 
@@ -13,9 +16,23 @@ type File struct {
 	blockWriter block.Writer
 	block       block.WriteBlock
 	footer      shared.FileFooter
+	filter      bloom.Builder
+	bitsPerKey  int
+	// value with version header
+	buf []byte
+	// a sequence was added to the footer range
+	seen bool
+	// range tombstones in the order added
+	tombstones []shared.Tombstone
+	// latest expiry of any version. forever if one never expires
+	expires int64
+	forever bool
+	// value with expiry prefix
+	expiring []byte
 }
 
-func NewFile(filename string, blockSize int) (*File, error) {
+// bitsPerKey <= 0 writes no bloom filter
+func NewFile(filename string, blockSize, bitsPerKey int) (*File, error) {
 	if blockSize < 512 {
 		blockSize = 512
 	}
@@ -27,8 +44,9 @@ func NewFile(filename string, blockSize int) (*File, error) {
 		footer: shared.FileFooter{
 			BlockSize:   blockSize,
 			ValueSize:   -1,
-			BlockFormat: 1,
+			BlockFormat: block.Format7,
 		},
+		bitsPerKey: bitsPerKey,
 	}
 	f, err := NewBuffered(filename)
 	if err != nil {
@@ -39,6 +57,19 @@ func NewFile(filename string, blockSize int) (*File, error) {
 	return fw, nil
 }
 
+// sequence of entries added without a version header. entries with
+// another sequence or older versions are written with one
+func (f *File) SetSequence(seq uint64) {
+	f.footer.Sequence = seq
+}
+
+// throttle writes to l. nil is unlimited. writes waiting on l fail
+// once ctx is done
+func (f *File) SetLimiter(ctx context.Context, l *ratelimit.Limiter) {
+	f.f.limit = l
+	f.f.ctx = ctx
+}
+
 func (f *File) Len() int {
 	return f.footer.CompressedDataBytes + f.footer.CompressedIndexBytes
 }
@@ -91,6 +122,29 @@ func (f *File) Commit() error {
 		// this file has no blocks, only footer
 		f.footer.LastIndexPosition = -1
 	}
+	if f.filter.Len() > 0 {
+		filter := f.filter.Build(f.bitsPerKey)
+		f.footer.FilterPosition = f.f.Position
+		f.footer.FilterSize = len(filter)
+		f.footer.FilterChecksum = shared.Checksum(filter)
+		_, err = f.f.Write(filter)
+		if err != nil {
+			return err
+		}
+	}
+	if len(f.tombstones) > 0 {
+		buf := shared.AppendTombstones(nil, f.tombstones)
+		f.footer.TombstonePosition = f.f.Position
+		f.footer.TombstoneSize = len(buf)
+		f.footer.TombstoneChecksum = shared.Checksum(buf)
+		_, err = f.f.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	if !f.forever {
+		f.footer.Expires = f.expires
+	}
 	h := f.footer.Marshal()
 	_, err = f.f.Write(h)
 	if err != nil {
@@ -119,17 +173,42 @@ func (f *File) Add(kv *shared.KV) error {
 	if len(kv.Key) > shared.MaxKeySize {
 		return shared.ErrKeyTooBig
 	}
+	if len(kv.Value) > shared.MaxValueSize {
+		return shared.ErrValueTooBig
+	}
 
 	f.footer.RawKeyBytes += len(kv.Key)
+	if f.bitsPerKey > 0 {
+		f.filter.Add(kv.Key)
+	}
 	if kv.Delete {
 		f.footer.Deletes++
 	} else {
 		f.footer.Inserts++
 		f.footer.RawValueBytes += len(kv.Value)
 	}
+	f.sequence(kv.Seq)
+	f.expiry(kv.Expires, kv.Delete)
+	val := kv.Value
+	flags := flags(kv)
+	if kv.Seq != f.footer.Sequence || len(kv.Older) > 0 {
+		for _, v := range kv.Older {
+			f.sequence(v.Seq)
+			f.expiry(v.Expires, v.Delete)
+		}
+		f.buf = shared.AppendVersions(f.buf[:0], kv)
+		val = f.buf
+		flags |= block.FlagVersion
+	}
+	if kv.Expires != 0 {
+		f.expiring = shared.AppendExpiry(f.expiring[:0], kv.Expires)
+		f.expiring = append(f.expiring, val...)
+		val = f.expiring
+		flags |= block.FlagExpire
+	}
 
-	if f.block.HasSpace(len(kv.Key), len(kv.Value), f.footer.BlockSize, 0) {
-		f.block.Put(kv.Key, kv.Value, kv.Delete)
+	if f.block.HasSpace(len(kv.Key), len(val), f.footer.BlockSize, 0) {
+		f.block.PutFlags(kv.Key, val, flags)
 		return nil
 	}
 
@@ -151,10 +230,65 @@ func (f *File) Add(kv *shared.KV) error {
 	if err != nil {
 		return err
 	}
-	f.block.Put(kv.Key, kv.Value, kv.Delete)
+	f.block.PutFlags(kv.Key, val, flags)
+	return nil
+}
+
+// add a range tombstone to the file's tombstone block. start and end
+// are copied. tombstones may be added in any order
+func (f *File) AddTombstone(t shared.Tombstone) error {
+	if len(t.Start) > shared.MaxKeySize || len(t.End) > shared.MaxKeySize+1 {
+		return shared.ErrKeyTooBig
+	}
+	f.sequence(t.Seq)
+	t.Start = append([]byte{}, t.Start...)
+	t.End = append([]byte{}, t.End...)
+	f.tombstones = append(f.tombstones, t)
 	return nil
 }
 
+// number of range tombstones added
+func (f *File) Tombstones() int {
+	return len(f.tombstones)
+}
+
+// widen the footer sequence range to include seq
+func (f *File) sequence(seq uint64) {
+	if !f.seen || seq < f.footer.MinSequence {
+		f.footer.MinSequence = seq
+	}
+	if !f.seen || seq > f.footer.MaxSequence {
+		f.footer.MaxSequence = seq
+	}
+	f.seen = true
+}
+
+// widen the footer expiry to include a version expiring at expires.
+// deletes are never read so don't need to expire
+func (f *File) expiry(expires int64, delete bool) {
+	switch {
+	case delete:
+	case expires == 0:
+		f.forever = true
+	case expires > f.expires:
+		f.expires = expires
+	}
+}
+
+func flags(kv *shared.KV) uint32 {
+	var f uint32
+	if kv.Delete {
+		f |= block.FlagDelete
+	}
+	if kv.Pointer {
+		f |= block.FlagPointer
+	}
+	if kv.Merge {
+		f |= block.FlagMerge
+	}
+	return f
+}
+
 func (f *File) addToIndex(key []byte, iInfo shared.IndexValue, i int) error {
 	for ; i < len(f.indexes); i++ {
 		if f.indexes[i].HasSpace(key, iInfo, f.footer.BlockSize) {
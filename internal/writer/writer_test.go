@@ -12,7 +12,7 @@ import (
 
 func TestWrite(t *testing.T) {
 	os.RemoveAll("test.db")
-	f, err := NewFile("test.db", 16384)
+	f, err := NewFile("test.db", 16384, 0)
 	if err != nil {
 		panic(err)
 	}